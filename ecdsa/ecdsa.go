@@ -238,6 +238,13 @@ func UnblindPublicKey(c elliptic.Curve, pk *PublicKey, bk *PrivateKey) (*PublicK
 	return UnblindPublicKeyWithContext(c, pk, bk, nil)
 }
 
+// BlindScalarWithContext returns the scalar by which a blind and context string
+// multiply a key pair, so that signatures by the blinded key can be computed by
+// a signer that only holds the unblinded private key.
+func BlindScalarWithContext(c elliptic.Curve, bk *PrivateKey, context []byte) (*big.Int, error) {
+	return hashBlind(c, bk, context)
+}
+
 // BlindKeySignWithContext blinds the signing key by a blind, with a context string, and then produces a signature over the hashed input.
 func BlindKeySignWithContext(rand io.Reader, skS *PrivateKey, skB *PrivateKey, hash []byte, context []byte) (r, s *big.Int, err error) {
 	pkB, err := BlindPublicKeyWithContext(skS.Curve, &skS.PublicKey, skB, context)
@@ -1,6 +1,12 @@
 package tokens
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"math"
+
+	"github.com/cloudflare/pat-go/util"
 	"golang.org/x/crypto/cryptobyte"
 )
 
@@ -38,3 +44,91 @@ func (t Token) Marshal() []byte {
 	b.AddBytes(t.Authenticator)
 	return b.BytesOrPanic()
 }
+
+// RedemptionKey returns the SHA-256 digest of the marshaled token, for use as
+// the key of a redemption store that origins consult to reject replayed tokens.
+// The digest covers every field, including the nonce and authenticator, so
+// storing the full token is unnecessary: the key alone identifies it.
+func (t Token) RedemptionKey() [32]byte {
+	return sha256.Sum256(t.Marshal())
+}
+
+// AuthorizationHeaderValue returns the value of the Authorization header that
+// presents the token to an origin, i.e., the PrivateToken scheme with the
+// base64url-encoded token as its token parameter.
+func (t Token) AuthorizationHeaderValue() string {
+	return "PrivateToken token=" + base64.RawURLEncoding.EncodeToString(t.Marshal())
+}
+
+// CBOR map keys for Token fields.
+const (
+	cborKeyTokenType     = 1
+	cborKeyNonce         = 2
+	cborKeyContext       = 3
+	cborKeyKeyID         = 4
+	cborKeyAuthenticator = 5
+)
+
+// MarshalCBOR encodes the token as a deterministic CBOR map with integer keys.
+// This is a transport convenience for ecosystems that prefer CBOR, not the
+// Privacy Pass wire format; use Marshal for interoperability.
+func (t Token) MarshalCBOR() ([]byte, error) {
+	return util.MarshalCBORMap(map[uint64]interface{}{
+		cborKeyTokenType:     uint64(t.TokenType),
+		cborKeyNonce:         t.Nonce,
+		cborKeyContext:       t.Context,
+		cborKeyKeyID:         t.KeyID,
+		cborKeyAuthenticator: t.Authenticator,
+	})
+}
+
+// UnmarshalCBOR decodes a token encoded with MarshalCBOR.
+func (t *Token) UnmarshalCBOR(data []byte) error {
+	fields, err := util.UnmarshalCBORMap(data)
+	if err != nil {
+		return err
+	}
+	if len(fields) != 5 {
+		return util.ErrInvalidCBOR
+	}
+
+	tokenType, ok := util.CBORUint(fields, cborKeyTokenType)
+	if !ok || tokenType > math.MaxUint16 {
+		return util.ErrInvalidCBOR
+	}
+	nonce, ok1 := util.CBORBytes(fields, cborKeyNonce)
+	context, ok2 := util.CBORBytes(fields, cborKeyContext)
+	keyID, ok3 := util.CBORBytes(fields, cborKeyKeyID)
+	authenticator, ok4 := util.CBORBytes(fields, cborKeyAuthenticator)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return util.ErrInvalidCBOR
+	}
+
+	*t = Token{
+		TokenType:     uint16(tokenType),
+		Nonce:         nonce,
+		Context:       context,
+		KeyID:         keyID,
+		Authenticator: authenticator,
+	}
+	return nil
+}
+
+// SameIssuer reports whether two tokens have the same token type and were
+// issued under the same token key, comparing key IDs in constant time.
+func SameIssuer(a, b Token) bool {
+	return a.TokenType == b.TokenType && subtle.ConstantTimeCompare(a.KeyID, b.KeyID) == 1
+}
+
+// MatchesAnyChallenge reports whether the token context is the SHA-256 digest
+// of any of the given challenges, so an origin rotating challenges can accept
+// tokens for challenges still in flight. All challenges are compared in
+// constant time.
+func (t Token) MatchesAnyChallenge(challenges [][]byte) bool {
+	match := 0
+	for _, challenge := range challenges {
+		context := sha256.Sum256(challenge)
+		match |= subtle.ConstantTimeCompare(context[:], t.Context)
+	}
+	return match == 1
+}
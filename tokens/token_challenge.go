@@ -2,13 +2,21 @@ package tokens
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/cryptobyte"
 )
 
+// maxRedemptionNonceLen is the maximum redemption nonce (redemption context)
+// length of a TokenChallenge.
+const maxRedemptionNonceLen = 32
+
 //	struct {
 //	    uint16_t token_type;
 //	    opaque issuer_name<1..2^16-1>;
@@ -47,6 +55,10 @@ func (c TokenChallenge) Marshal() []byte {
 	return b.BytesOrPanic()
 }
 
+// UnmarshalTokenChallenge decodes a TokenChallenge, rejecting truncated inputs
+// and redemption nonces longer than 32 bytes. An empty origin info decodes to a
+// nil OriginInfo, which re-encodes to the same challenge. Trailing data is
+// ignored, as deployed issuers have sent challenges with a trailing byte.
 func UnmarshalTokenChallenge(data []byte) (TokenChallenge, error) {
 	s := cryptobyte.String(data)
 
@@ -63,7 +75,7 @@ func UnmarshalTokenChallenge(data []byte) (TokenChallenge, error) {
 	challenge.IssuerName = string(issuerName)
 
 	var redemptionNonce cryptobyte.String
-	if !s.ReadUint8LengthPrefixed(&redemptionNonce) {
+	if !s.ReadUint8LengthPrefixed(&redemptionNonce) || len(redemptionNonce) > maxRedemptionNonceLen {
 		return TokenChallenge{}, fmt.Errorf("invalid TokenChallenge encoding")
 	}
 	challenge.RedemptionNonce = make([]byte, len(redemptionNonce))
@@ -71,9 +83,56 @@ func UnmarshalTokenChallenge(data []byte) (TokenChallenge, error) {
 
 	var originInfo cryptobyte.String
 	if !s.ReadUint16LengthPrefixed(&originInfo) {
-		return TokenChallenge{}, fmt.Errorf("invalid TokenRequest encoding")
+		return TokenChallenge{}, fmt.Errorf("invalid TokenChallenge encoding")
+	}
+	if !originInfo.Empty() {
+		challenge.OriginInfo = strings.Split(string(originInfo), ",")
 	}
-	challenge.OriginInfo = strings.Split(string(originInfo), ",")
 
 	return challenge, nil
 }
+
+// An expiring redemption nonce is the 8-byte big-endian Unix expiry time (in
+// seconds) followed by 16 random bytes. Its length distinguishes it from the
+// empty and 32-byte random redemption nonces clients otherwise see.
+const expiringRedemptionNonceLen = 8 + 16
+
+var (
+	ErrChallengeExpired = errors.New("token challenge expired")
+)
+
+// NewExpiringRedemptionNonce returns a redemption nonce that makes challenges
+// carrying it expire at expiry.
+//
+// The token only commits to sha256(challenge), and in some token types the
+// issuer never even sees that, so the expiry can only be enforced by parties
+// that hold the challenge itself: the client before it requests a token, and
+// the origin when the token is redeemed (see CheckFreshness). Origins must
+// therefore keep the challenge, not just its digest, until redemption.
+func NewExpiringRedemptionNonce(expiry time.Time) ([]byte, error) {
+	nonce := make([]byte, expiringRedemptionNonceLen)
+	binary.BigEndian.PutUint64(nonce, uint64(expiry.Unix()))
+	if _, err := rand.Read(nonce[8:]); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// Expiry returns the expiry time carried by the challenge's redemption nonce,
+// if it was created with NewExpiringRedemptionNonce.
+func (c TokenChallenge) Expiry() (time.Time, bool) {
+	if len(c.RedemptionNonce) != expiringRedemptionNonceLen {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(c.RedemptionNonce)), 0), true
+}
+
+// CheckFreshness returns ErrChallengeExpired if the challenge carries an
+// expiry that is not after now. Challenges without an expiry are always fresh.
+func (c TokenChallenge) CheckFreshness(now time.Time) error {
+	expiry, ok := c.Expiry()
+	if ok && !now.Before(expiry) {
+		return fmt.Errorf("%w at %s", ErrChallengeExpired, expiry.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
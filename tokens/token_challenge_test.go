@@ -9,12 +9,14 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	util "github.com/cloudflare/pat-go/util"
 )
@@ -107,6 +109,49 @@ func TestTokenChallengeUnmarshal(t *testing.T) {
 	}
 }
 
+func TestTokenChallengeRoundTrip(t *testing.T) {
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+
+	challenges := []TokenChallenge{
+		createTokenChallenge(0x0003, nonce, "issuer.example", []string{"origin.example"}),
+		createTokenChallenge(0x0003, nil, "issuer.example", []string{"foo.example", "bar.example"}),
+		createTokenChallenge(0x0003, nonce, "issuer.example", nil),
+		createTokenChallenge(0x0003, nil, "issuer.example", nil),
+	}
+	for _, challenge := range challenges {
+		challengeEnc := challenge.Marshal()
+		recoveredChallenge, err := UnmarshalTokenChallenge(challengeEnc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !challenge.Equals(recoveredChallenge) {
+			t.Fatalf("challenge mismatch: %+v, recovered %+v", challenge, recoveredChallenge)
+		}
+		if !bytes.Equal(recoveredChallenge.Marshal(), challengeEnc) {
+			t.Fatal("challenge did not re-encode to the same bytes")
+		}
+	}
+}
+
+func TestTokenChallengeUnmarshalMalformed(t *testing.T) {
+	challengeEnc := createTokenChallenge(0x0003, nil, "issuer.example", []string{"origin.example"}).Marshal()
+	for n := 0; n < len(challengeEnc); n++ {
+		if _, err := UnmarshalTokenChallenge(challengeEnc[:n]); err == nil {
+			t.Fatalf("accepted %d-byte truncation", n)
+		}
+	}
+
+	longNonce := createTokenChallenge(0x0003, make([]byte, 33), "issuer.example", nil).Marshal()
+	if _, err := UnmarshalTokenChallenge(longNonce); err == nil {
+		t.Fatal("accepted 33-byte redemption nonce")
+	}
+	noIssuer := createTokenChallenge(0x0003, nil, "", nil).Marshal()
+	if _, err := UnmarshalTokenChallenge(noIssuer); err == nil {
+		t.Fatal("accepted empty issuer name")
+	}
+}
+
 func TestBase64(t *testing.T) {
 	v := "MIICUjA9BgkqhkiG9w0BAQowMKANMAsGCWCGSAFlAwQCAqEaMBgGCSqGSIb3DQEBCDALBglghkgBZQMEAgKiAwIBMAOCAg8AMIICCgKCAgEAqf6VmRe_ws8ZWvoxAZ847LQpleN6I0daqdxBY61GVim4bRv9g6xAxaZWcKpu58TbWpDVU6sQw7l58W-C1jmJvobGqtZF4WHqtvqdQZdSbkxbpcgwVJsGuwyJjMNs7koEUfB50Tb2XgdmnuFS0gAxRxVIZghxPkfjgBnT0cQpNDxLf-uO9C-NnoonU4rhoPhiA1IdlApOk2mJuks335nfT4fyAcPbMOsd__XL0dSs_T5s4lxkuKo12p0mURg_Zs1OEucgGxDpVrRA-kZ6iFQKIJNZ_fZ396Yok8jAvRyhEBJbqyhApFG9d3v2-3CmGUuJgyzcb2lI0y86EuCf9A_DR2FK2aV0_fxfRiXji1WER-LTUsM-SqwYYhouFFXIHrXUsI4H5RiDE_4EEAqh4duhaenTne7SDl8Talr2IK-gXFffdkI6g6X2xDg159xT-LeSWE0tk_lFAJkS3GhqZVfB7ikZtpxsJs2pIf26XpRPBydhQgTY2rKx9KuMJoQStolRNAv7b_Z8CfrJj6ZMWaodntmZ0TZ6p6mIq5kKpgsx8kDf125Bwxv0XL-sDO2vhWzCvK6dLWefxrm8aj_F5tz0aL8asgLCr9aFtNbQl96TzcEJcYGCq5BbsqeoIBt2W6nfr3LDHb22zmiiyaH6Pb5eTfDjWTSPEfJ8mjQOZsiD1GsCAwEAAQ"
 	_, err := base64.RawURLEncoding.DecodeString(v)
@@ -388,3 +433,38 @@ func TestVectorVerifyToken(t *testing.T) {
 
 	verifyTokenTestVectors(t, encoded)
 }
+
+func TestTokenChallengeFreshness(t *testing.T) {
+	now := time.Now()
+	nonce, err := NewExpiringRedemptionNonce(now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := createTokenChallenge(0x0003, nonce, "issuer.example", []string{"origin.example"})
+	recoveredChallenge, err := UnmarshalTokenChallenge(challenge.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiry, ok := recoveredChallenge.Expiry()
+	if !ok || expiry.Unix() != now.Add(time.Minute).Unix() {
+		t.Fatalf("unexpected expiry %v", expiry)
+	}
+	if err := recoveredChallenge.CheckFreshness(now); err != nil {
+		t.Fatal(err)
+	}
+	if err := recoveredChallenge.CheckFreshness(now.Add(time.Hour)); !errors.Is(err, ErrChallengeExpired) {
+		t.Fatalf("expected ErrChallengeExpired, got %v", err)
+	}
+
+	// Challenges with regular redemption nonces never expire
+	randomNonce := make([]byte, 32)
+	rand.Reader.Read(randomNonce)
+	challenge = createTokenChallenge(0x0003, randomNonce, "issuer.example", []string{"origin.example"})
+	if _, ok := challenge.Expiry(); ok {
+		t.Fatal("random redemption nonce parsed as expiring")
+	}
+	if err := challenge.CheckFreshness(now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+}
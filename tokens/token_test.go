@@ -0,0 +1,94 @@
+package tokens
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+)
+
+func randomTestToken(tokenType uint16, keyID []byte) Token {
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+	context := make([]byte, 32)
+	rand.Reader.Read(context)
+	authenticator := make([]byte, 256)
+	rand.Reader.Read(authenticator)
+
+	return Token{
+		TokenType:     tokenType,
+		Nonce:         nonce,
+		Context:       context,
+		KeyID:         keyID,
+		Authenticator: authenticator,
+	}
+}
+
+func TestSameIssuer(t *testing.T) {
+	keyIDA := make([]byte, 32)
+	rand.Reader.Read(keyIDA)
+	keyIDB := make([]byte, 32)
+	rand.Reader.Read(keyIDB)
+
+	tokenA1 := randomTestToken(0x0003, keyIDA)
+	tokenA2 := randomTestToken(0x0003, keyIDA)
+	tokenB := randomTestToken(0x0003, keyIDB)
+	tokenOtherType := randomTestToken(0x0002, keyIDA)
+
+	if !SameIssuer(tokenA1, tokenA2) {
+		t.Fatal("expected tokens under the same key to match")
+	}
+	if SameIssuer(tokenA1, tokenB) {
+		t.Fatal("expected tokens under different keys not to match")
+	}
+	if SameIssuer(tokenA1, tokenOtherType) {
+		t.Fatal("expected tokens of different types not to match")
+	}
+}
+
+func TestTokenCBORRoundTrip(t *testing.T) {
+	keyID := make([]byte, 32)
+	rand.Reader.Read(keyID)
+	token := randomTestToken(0x0003, keyID)
+
+	encoded, err := token.MarshalCBOR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recovered Token
+	if err := recovered.UnmarshalCBOR(encoded); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(token.Marshal(), recovered.Marshal()) {
+		t.Fatal("CBOR round trip mismatch")
+	}
+
+	if err := recovered.UnmarshalCBOR(encoded[:len(encoded)-1]); err == nil {
+		t.Fatal("truncated CBOR token decoded")
+	}
+	if err := recovered.UnmarshalCBOR(append(encoded, 0x00)); err == nil {
+		t.Fatal("CBOR token with trailing data decoded")
+	}
+}
+
+func TestTokenMatchesAnyChallenge(t *testing.T) {
+	challenges := make([][]byte, 3)
+	for i := range challenges {
+		challenges[i] = make([]byte, 64)
+		rand.Reader.Read(challenges[i])
+	}
+
+	token := randomTestToken(0x0003, make([]byte, 32))
+	context := sha256.Sum256(challenges[1])
+	token.Context = context[:]
+
+	if !token.MatchesAnyChallenge(challenges) {
+		t.Fatal("token did not match its challenge")
+	}
+	if token.MatchesAnyChallenge([][]byte{challenges[0], challenges[2]}) {
+		t.Fatal("token matched unrelated challenges")
+	}
+	if token.MatchesAnyChallenge(nil) {
+		t.Fatal("token matched an empty challenge set")
+	}
+}
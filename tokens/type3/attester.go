@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"crypto"
 	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/sha512"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"math/big"
+	"sync/atomic"
 
 	"golang.org/x/crypto/cryptobyte"
 	"golang.org/x/crypto/hkdf"
@@ -19,8 +23,29 @@ import (
 var (
 	labelResponseKey   = "key"
 	labelResponseNonce = "nonce"
+	labelClientBlind   = "ClientBlind"
+	labelIssuerBlind   = "IssuerBlind"
 )
 
+var (
+	ErrBadBlind      = errors.New("invalid request blind")
+	ErrUnblindFailed = errors.New("failed to unblind request key")
+	ErrIndexKDF      = errors.New("failed to derive origin index")
+)
+
+// Overridden in tests to exercise internal failure paths of FinalizeIndex.
+var (
+	unblindRequestKey = ecdsa.UnblindPublicKeyWithContext
+	deriveIndex       = computeEpochIndex
+)
+
+func blindContext(label string) []byte {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16(RateLimitedTokenType)
+	b.AddBytes([]byte(label))
+	return b.BytesOrPanic()
+}
+
 type ClientState struct {
 	originIndices map[string]string // map from anonymous origin ID to anonymous issuer origin ID
 	clientIndices map[string]string // map from anonymous issuer origin ID to anonyous origin ID
@@ -28,7 +53,9 @@ type ClientState struct {
 }
 
 type RateLimitedAttester struct {
-	cache ClientStateCache
+	cache      ClientStateCache
+	rateLimits RateLimitStore
+	epoch      uint64 // accessed atomically
 }
 
 type ClientStateCache interface {
@@ -38,7 +65,8 @@ type ClientStateCache interface {
 
 func NewRateLimitedAttester(cache ClientStateCache) *RateLimitedAttester {
 	return &RateLimitedAttester{
-		cache: cache,
+		cache:      cache,
+		rateLimits: NewMemoryRateLimitStore(),
 	}
 }
 
@@ -53,25 +81,53 @@ func unmarshalPublicKey(curve elliptic.Curve, encodedKey []byte) (*ecdsa.PublicK
 	return publicKey, nil
 }
 
-func (a *RateLimitedAttester) innerVerifyRequest(tokenRequest RateLimitedTokenRequest) error {
+var (
+	ErrRequestKeyMismatch      = errors.New("request key does not match the key on file")
+	ErrInvalidRequestSignature = errors.New("invalid request signature")
+)
+
+// VerifyRequestSignature checks the request signature against requestKeyEnc,
+// the (client-blinded) request key the attester has on file for the request,
+// without decrypting anything. The curve of the request key follows from its
+// size, so requests on every supported curve are accepted.
+//
+// This verifies that the request was signed by the holder of the request key
+// over the token type, request key, name key ID, and encrypted origin token
+// request, so garbage or modified requests can be dropped before they reach the
+// issuer. It does not verify anything inside the encrypted origin token
+// request (origin name, token key ID, or blinded message), nor that the request
+// decrypts under the issuer's name key; only the issuer can check those. Nor
+// does it check that the request key belongs to a given client; VerifyRequest
+// does that using the client key and blind.
+func VerifyRequestSignature(req *RateLimitedTokenRequest, requestKeyEnc []byte) error {
+	if !bytes.Equal(req.RequestKey, requestKeyEnc) {
+		return ErrRequestKeyMismatch
+	}
+
 	// Deserialize the request key
-	curve := elliptic.P384()
-	requestKey, err := unmarshalPublicKey(curve, tokenRequest.RequestKey)
+	curve, err := curveForRequestKey(requestKeyEnc)
+	if err != nil {
+		return err
+	}
+	requestKey, err := unmarshalPublicKey(curve, requestKeyEnc)
 	if err != nil {
 		return err
 	}
 
 	scalarLen := (curve.Params().Params().BitSize + 7) / 8
-	r := new(big.Int).SetBytes(tokenRequest.Signature[:scalarLen])
-	s := new(big.Int).SetBytes(tokenRequest.Signature[scalarLen:])
+	if len(req.Signature) != 2*scalarLen {
+		return ErrInvalidRequestSignature
+	}
+	r := new(big.Int).SetBytes(req.Signature[:scalarLen])
+	s := new(big.Int).SetBytes(req.Signature[scalarLen:])
 
 	// Verify the request signature
 	b := cryptobyte.NewBuilder(nil)
 	b.AddUint16(RateLimitedTokenType)
-	b.AddBytes(tokenRequest.RequestKey)
-	b.AddBytes(tokenRequest.NameKeyID)
+	b.AddBytes(req.RequestKey)
+	b.AddBytes(req.NameKeyID)
 	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-		b.AddBytes(tokenRequest.EncryptedTokenRequest)
+		b.AddBytes(req.EncryptedTokenRequest)
 	})
 	message := b.BytesOrPanic()
 
@@ -81,27 +137,30 @@ func (a *RateLimitedAttester) innerVerifyRequest(tokenRequest RateLimitedTokenRe
 
 	valid := ecdsa.Verify(requestKey, digest, r, s)
 	if !valid {
-		return fmt.Errorf("Request signature invalid")
+		return ErrInvalidRequestSignature
 	}
 
 	return nil
 }
 
 func (a *RateLimitedAttester) VerifyRequest(tokenRequest RateLimitedTokenRequest, blindKeyEnc, clientKeyEnc, anonymousOrigin []byte) error {
-	err := a.innerVerifyRequest(tokenRequest)
+	err := VerifyRequestSignature(&tokenRequest, tokenRequest.RequestKey)
 	if err != nil {
-		return nil
+		return err
 	}
 
-	curve := elliptic.P384()
+	curve, err := curveForRequestKey(tokenRequest.RequestKey)
+	if err != nil {
+		return err
+	}
 	clientKey, err := unmarshalPublicKey(curve, clientKeyEnc)
 	if err != nil {
 		return err
 	}
 
-	blindKey, err := ecdsa.CreateKey(curve, blindKeyEnc)
+	blindKey, err := parseBlind(curve, blindKeyEnc)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	b := cryptobyte.NewBuilder(nil)
@@ -131,8 +190,31 @@ func (a *RateLimitedAttester) VerifyRequest(tokenRequest RateLimitedTokenRequest
 	return nil
 }
 
+// computeIndex derives the anonymous issuer origin ID from the client key and
+// index key using HKDF-SHA384. The HKDF accounts for well under 1% of
+// FinalizeIndex (see BenchmarkFinalizeIndex), which is dominated by the
+// P-384 scalar multiplication in the unblinding step, so caching the HMAC state
+// across indices is not worthwhile.
 func computeIndex(clientKey, indexKey []byte) ([]byte, error) {
-	hkdf := hkdf.New(sha512.New384, indexKey, clientKey, []byte("IssuerOriginAlias"))
+	return computeEpochIndex(clientKey, indexKey, 0)
+}
+
+// indexInfo returns the HKDF info for computing indices in epoch. Epoch 0 uses
+// the info from the specification, so indices only deviate from it once the
+// attester rotates its index epoch.
+func indexInfo(epoch uint64) []byte {
+	info := []byte("IssuerOriginAlias")
+	if epoch == 0 {
+		return info
+	}
+	epochEnc := make([]byte, 8)
+	binary.BigEndian.PutUint64(epochEnc, epoch)
+	return append(info, epochEnc...)
+}
+
+// computeEpochIndex is computeIndex for the given index epoch.
+func computeEpochIndex(clientKey, indexKey []byte, epoch uint64) ([]byte, error) {
+	hkdf := hkdf.New(sha512.New384, indexKey, clientKey, indexInfo(epoch))
 	clientOriginIndex := make([]byte, crypto.SHA384.Size())
 	if _, err := io.ReadFull(hkdf, clientOriginIndex); err != nil {
 		return nil, err
@@ -140,33 +222,70 @@ func computeIndex(clientKey, indexKey []byte) ([]byte, error) {
 	return clientOriginIndex, nil
 }
 
+// IndexEpoch returns the epoch FinalizeIndex currently computes indices in.
+func (a *RateLimitedAttester) IndexEpoch() uint64 {
+	return atomic.LoadUint64(&a.epoch)
+}
+
+// RotateIndexEpoch advances the index epoch and returns the new one. The epoch
+// is mixed into the derivation of every index, so the indices of a client and
+// origin in the new epoch cannot be linked to those in earlier epochs without
+// the client key and the origin's index key, and logs of old indices cannot be
+// correlated with new ones. Clients compute matching indices with
+// RateLimitedClient.PredictEpochIndex.
+//
+// Indices computed before the rotation remain valid, but only within their
+// epoch: per-client state keyed by an old index does not match the new index
+// for the same origin, so per-index counts start fresh. Attesters should tag
+// stored indices with their epoch (see IndexEpoch) and drop state from the
+// previous epoch once the requests in flight across the boundary have been
+// finalized.
+func (a *RateLimitedAttester) RotateIndexEpoch() uint64 {
+	return atomic.AddUint64(&a.epoch, 1)
+}
+
+// CommitIndex returns an HMAC-SHA384 commitment to an anonymous issuer origin
+// ID (index) under salt, so an attester can persist commitments instead of the
+// client-linkable index and still count per index as long as it keeps the salt.
+func CommitIndex(index, salt []byte) []byte {
+	mac := hmac.New(sha512.New384, salt)
+	mac.Write(index)
+	return mac.Sum(nil)
+}
+
+// VerifyIndexCommitment reports whether commitment is the commitment to index
+// under salt, in constant time.
+func VerifyIndexCommitment(index, salt, commitment []byte) bool {
+	return hmac.Equal(CommitIndex(index, salt), commitment)
+}
+
+// FinalizeIndex trusts that the issuer blinded the request key with the
+// origin's index key. The attester cannot check this, even given the blind and
+// the origin's public index key (see RateLimitedIssuer.OriginIndexPublicKey):
+// with sk the client secret key, b the blind scalar, and k the index scalar, it
+// knows G*sk*b, G*k, and the claimed G*sk*b*k, and deciding whether the latter
+// is correct is the decisional Diffie-Hellman problem on the request key curve.
+// Checking it would take a proof of discrete log equality from the issuer.
+//
+// The curve, P-384 or P-256 (see RateLimitedParamsForCurve), is that of the
+// blinded request key, which the issuer returns on the client's curve; the
+// blind must be a scalar for the same curve.
+//
 // https://ietf-wg-privacypass.github.io/draft-ietf-privacypass-rate-limit-tokens/draft-ietf-privacypass-rate-limit-tokens.html#name-attester-behavior-index-com
 func (a *RateLimitedAttester) FinalizeIndex(clientKey, blindEnc, blindedRequestKeyEnc, anonOriginId []byte) ([]byte, error) {
-	curve := elliptic.P384()
-	blindedRequestKey, err := unmarshalPublicKey(curve, blindedRequestKeyEnc)
+	curve, err := curveForRequestKey(blindedRequestKeyEnc)
 	if err != nil {
 		return nil, err
 	}
-
-	blindKey, err := ecdsa.CreateKey(curve, blindEnc)
-	if err != nil {
-		return nil, err
-	}
-
-	b := cryptobyte.NewBuilder(nil)
-	b.AddUint16(RateLimitedTokenType)
-	b.AddBytes([]byte("ClientBlind"))
-	ctx := b.BytesOrPanic()
-	indexKey, err := ecdsa.UnblindPublicKeyWithContext(curve, blindedRequestKey, blindKey, ctx)
+	indexKeyEnc, err := unblindIndexKey(curve, blindEnc, blindedRequestKeyEnc)
 	if err != nil {
 		return nil, err
 	}
 
 	// Compute the anonymous issuer origin ID (index)
-	indexKeyEnc := elliptic.MarshalCompressed(curve, indexKey.X, indexKey.Y)
-	index, err := computeIndex(clientKey, indexKeyEnc)
+	index, err := deriveIndex(clientKey, indexKeyEnc, a.IndexEpoch())
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrIndexKDF, err)
 	}
 
 	// Look up per-client cached state
@@ -197,3 +316,84 @@ func (a *RateLimitedAttester) FinalizeIndex(clientKey, blindEnc, blindedRequestK
 
 	return index, nil
 }
+
+// parseBlind decodes the client blind blindEnc, a scalar in [1, N-1]. The
+// blind is supplied by the client, so failures here are client errors rather
+// than internal ones, and are reported with ErrBadBlind.
+func parseBlind(curve elliptic.Curve, blindEnc []byte) (*ecdsa.PrivateKey, error) {
+	scalarLen := (curve.Params().BitSize + 7) / 8
+	blindScalar := new(big.Int).SetBytes(blindEnc)
+	if len(blindEnc) > scalarLen || blindScalar.Sign() == 0 || blindScalar.Cmp(curve.Params().N) >= 0 {
+		return nil, ErrBadBlind
+	}
+	blindKey, err := ecdsa.CreateKey(curve, blindEnc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadBlind, err)
+	}
+	return blindKey, nil
+}
+
+// unblindIndexKey removes the client blind from the blinded request key the
+// issuer returned, yielding the compressed index key the index is derived from.
+func unblindIndexKey(curve elliptic.Curve, blindEnc, blindedRequestKeyEnc []byte) ([]byte, error) {
+	blindedRequestKey, err := unmarshalPublicKey(curve, blindedRequestKeyEnc)
+	if err != nil {
+		return nil, err
+	}
+
+	blindKey, err := parseBlind(curve, blindEnc)
+	if err != nil {
+		return nil, err
+	}
+
+	indexKey, err := unblindRequestKey(curve, blindedRequestKey, blindKey, blindContext(labelClientBlind))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnblindFailed, err)
+	}
+	if indexKey.X.Sign() == 0 && indexKey.Y.Sign() == 0 {
+		return nil, ErrUnblindFailed
+	}
+
+	return elliptic.MarshalCompressed(curve, indexKey.X, indexKey.Y), nil
+}
+
+// ClientFromIndexKeys reports, for each index key (the compressed, unblinded
+// request key FinalizeIndex derives the index from), whether the candidate
+// client key reproduces an index this attester has observed for that client
+// in the current index epoch. An index key that is malformed, or whose index
+// was not observed for the candidate, is reported as false.
+//
+// Indices are per origin, so they cannot be linked to each other on their own.
+// This links them to a specific client, and thus to each other, given index
+// keys retained from earlier requests. That undoes the unlinkability the
+// protocol provides for the affected requests, so it is only meant for abuse
+// investigations with the client's cooperation or under legal compulsion, for
+// a specific candidate client. Attesters should not retain index keys longer
+// than such investigations require, and must not use this to attribute
+// requests in bulk.
+func (a *RateLimitedAttester) ClientFromIndexKeys(indexKeysEnc [][]byte, candidateClientKey []byte) []bool {
+	matches := make([]bool, len(indexKeysEnc))
+
+	state, ok := a.cache.Get(hex.EncodeToString(candidateClientKey))
+	if !ok {
+		return matches
+	}
+
+	epoch := a.IndexEpoch()
+	for j, indexKeyEnc := range indexKeysEnc {
+		curve, err := curveForRequestKey(indexKeyEnc)
+		if err != nil {
+			continue
+		}
+		if _, err := unmarshalPublicKey(curve, indexKeyEnc); err != nil {
+			continue
+		}
+		index, err := computeEpochIndex(candidateClientKey, indexKeyEnc, epoch)
+		if err != nil {
+			continue
+		}
+		_, matches[j] = state.clientIndices[hex.EncodeToString(index)]
+	}
+
+	return matches
+}
@@ -0,0 +1,175 @@
+package type3
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+var (
+	ErrAuditLogTampered = errors.New("audit log chain is broken")
+)
+
+const (
+	AuditOutcomeIssued   uint8 = 0x00
+	AuditOutcomeRejected uint8 = 0x01
+)
+
+// AuditEntry is a single issuance event. Only a hash of the origin name is
+// recorded, never the name itself or any key material.
+type AuditEntry struct {
+	PreviousHash []byte // Hash of the previous entry, all zeros for the first entry
+	Timestamp    time.Time
+	OriginHash   []byte // Hash of the origin name, all zeros if it could not be decrypted
+	KeyID        []byte // ID of the token key that signed, or empty if none was selected
+	Outcome      uint8
+}
+
+func (e AuditEntry) marshalContent() []byte {
+	timestamp := make([]byte, 8)
+	binary.BigEndian.PutUint64(timestamp, uint64(e.Timestamp.UnixNano()))
+
+	b := cryptobyte.NewBuilder(nil)
+	b.AddBytes(e.PreviousHash)
+	b.AddBytes(timestamp)
+	b.AddBytes(e.OriginHash)
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(e.KeyID)
+	})
+	b.AddUint8(e.Outcome)
+	return b.BytesOrPanic()
+}
+
+// Hash returns the hash that the next entry in the log chains to.
+func (e AuditEntry) Hash() []byte {
+	digest := sha256.Sum256(e.marshalContent())
+	return digest[:]
+}
+
+// marshal encodes the entry as a length-prefixed record followed by its hash,
+// so that a modified entry is detected even if it is the last one in the log.
+func (e AuditEntry) marshal() []byte {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(e.marshalContent())
+		b.AddBytes(e.Hash())
+	})
+	return b.BytesOrPanic()
+}
+
+// AuditLog writes an append-only, hash-chained log of issuance events. Each
+// entry includes the hash of the previous one, so modifying or removing an
+// entry breaks the chain for every entry after it. Truncating the log after
+// its last entry can only be detected by comparing Head against a value
+// recorded elsewhere.
+type AuditLog struct {
+	mu   sync.Mutex
+	w    io.Writer
+	head [sha256.Size]byte
+	now  func() time.Time
+
+	originKeyer *OriginStatKeyer
+}
+
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{
+		w:   w,
+		now: time.Now,
+	}
+}
+
+// SetOriginStatKeyer makes the log record origin names by their keyed
+// OriginStatKeyer digest instead of their plain SHA-256 hash, which anyone can
+// reverse for known origin names. The hex encoding of the recorded hash then
+// matches the key used for the origin in metrics.
+func (l *AuditLog) SetOriginStatKeyer(keyer OriginStatKeyer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.originKeyer = &keyer
+}
+
+// Head returns the hash of the last entry written to the log.
+func (l *AuditLog) Head() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	head := l.head
+	return head[:]
+}
+
+func (l *AuditLog) append(originName string, keyID []byte, outcome uint8) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	originHash := make([]byte, sha256.Size)
+	if originName != "" && l.originKeyer != nil {
+		copy(originHash, l.originKeyer.originStatDigest(originName))
+	} else if originName != "" {
+		digest := sha256.Sum256([]byte(originName))
+		copy(originHash, digest[:])
+	}
+
+	entry := AuditEntry{
+		PreviousHash: l.head[:],
+		Timestamp:    l.now(),
+		OriginHash:   originHash,
+		KeyID:        keyID,
+		Outcome:      outcome,
+	}
+	if _, err := l.w.Write(entry.marshal()); err != nil {
+		return err
+	}
+	copy(l.head[:], entry.Hash())
+
+	return nil
+}
+
+// VerifyAuditLog reads a log written by AuditLog and checks that every entry is
+// intact and chains to the one before it.
+func VerifyAuditLog(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	previousHash := make([]byte, sha256.Size)
+	s := cryptobyte.String(data)
+	for index := 0; !s.Empty(); index++ {
+		var record cryptobyte.String
+		if !s.ReadUint16LengthPrefixed(&record) {
+			return fmt.Errorf("%w: truncated entry %d", ErrAuditLogTampered, index)
+		}
+
+		var entry AuditEntry
+		var timestamp []byte
+		var keyID cryptobyte.String
+		var entryHash []byte
+		if !record.ReadBytes(&entry.PreviousHash, sha256.Size) ||
+			!record.ReadBytes(&timestamp, 8) ||
+			!record.ReadBytes(&entry.OriginHash, sha256.Size) ||
+			!record.ReadUint8LengthPrefixed(&keyID) ||
+			!record.ReadUint8(&entry.Outcome) ||
+			!record.ReadBytes(&entryHash, sha256.Size) ||
+			!record.Empty() {
+			return fmt.Errorf("%w: malformed entry %d", ErrAuditLogTampered, index)
+		}
+		entry.Timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(timestamp)))
+		entry.KeyID = keyID
+
+		if subtle.ConstantTimeCompare(entry.PreviousHash, previousHash) != 1 {
+			return fmt.Errorf("%w: entry %d does not chain to its predecessor", ErrAuditLogTampered, index)
+		}
+		previousHash = entry.Hash()
+		if subtle.ConstantTimeCompare(entryHash, previousHash) != 1 {
+			return fmt.Errorf("%w: entry %d hash mismatch", ErrAuditLogTampered, index)
+		}
+	}
+
+	return nil
+}
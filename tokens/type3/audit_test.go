@@ -0,0 +1,110 @@
+package type3
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/cloudflare/pat-go/ecdsa"
+)
+
+func TestAuditLog(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	var buf bytes.Buffer
+	log := NewAuditLog(&buf)
+	issuer.SetAuditLog(log)
+
+	for i := 0; i < 2; i++ {
+		_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+		if _, _, err := issuer.Evaluate(requestState.Request().Marshal()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, requestState := createTestTokenRequest(t, issuer, "unknown.example")
+	if _, _, err := issuer.Evaluate(requestState.Request().Marshal()); !errors.Is(err, ErrUnknownOrigin) {
+		t.Fatalf("expected ErrUnknownOrigin, got %v", err)
+	}
+
+	logData := buf.Bytes()
+	if err := VerifyAuditLog(bytes.NewReader(logData)); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(logData, []byte(testOrigin)) || bytes.Contains(logData, []byte("unknown.example")) {
+		t.Fatal("audit log contains a raw origin name")
+	}
+	originHash := sha256.Sum256([]byte(testOrigin))
+	if !bytes.Contains(logData, originHash[:]) {
+		t.Fatal("audit log does not contain the hashed origin name")
+	}
+
+	entryHash := logData[len(logData)-sha256.Size:]
+	if !bytes.Equal(log.Head(), entryHash) {
+		t.Fatal("log head does not match the last entry")
+	}
+
+	for i := range logData {
+		tampered := make([]byte, len(logData))
+		copy(tampered, logData)
+		tampered[i] ^= 0x01
+		if err := VerifyAuditLog(bytes.NewReader(tampered)); !errors.Is(err, ErrAuditLogTampered) {
+			t.Fatalf("flipped byte %d not detected: %v", i, err)
+		}
+	}
+}
+
+func TestAuditLogSigningKey(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+	currentKeyID := issuer.TokenKeyID()
+
+	var otherKey *rsa.PrivateKey
+	var otherKeyID []byte
+	for otherKey == nil || otherKeyID[0] == currentKeyID[0] {
+		var err error
+		otherKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherKeyID, err = FullKeyID(&otherKey.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := issuer.AddTokenKey(otherKey); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	issuer.SetAuditLog(NewAuditLog(&buf))
+
+	// The entry names the key that signed, not the current key
+	client, _ := createTestTokenRequest(t, issuer, testOrigin)
+	nonce := make([]byte, 32)
+	blindKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestState, err := client.CreateTokenRequest(nonce, nonce, blindKey.D.Bytes(), otherKeyID, &otherKey.PublicKey, testOrigin, issuer.NameKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := issuer.Evaluate(requestState.Request().Marshal()); err != nil {
+		t.Fatal(err)
+	}
+
+	logData := buf.Bytes()
+	if !bytes.Contains(logData, otherKeyID) {
+		t.Fatal("audit log does not contain the ID of the signing key")
+	}
+	if bytes.Contains(logData, currentKeyID) {
+		t.Fatal("audit log contains the ID of the current key")
+	}
+}
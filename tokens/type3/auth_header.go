@@ -0,0 +1,243 @@
+package type3
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/pat-go/tokens"
+	"github.com/cloudflare/pat-go/util"
+)
+
+const privateTokenScheme = "PrivateToken"
+
+var (
+	ErrInvalidAuthHeader = errors.New("invalid PrivateToken authentication header")
+	ErrNoChallenge       = errors.New("no rate-limited PrivateToken challenge")
+	ErrNoToken           = errors.New("no PrivateToken credentials")
+)
+
+// PrivateTokenChallenge is a PrivateToken challenge an origin sent in a
+// WWW-Authenticate header, decoded into the inputs of CreateTokenRequest.
+type PrivateTokenChallenge struct {
+	Challenge      []byte                // Encoded TokenChallenge, the challenge input of CreateTokenRequest
+	TokenChallenge tokens.TokenChallenge // Decoded Challenge
+	TokenKey       *rsa.PublicKey
+	TokenKeyID     []byte        // SHA-256 digest of the encoded token key
+	MaxAge         time.Duration // How long the challenge may be reused, zero if it must not be
+}
+
+type authParam struct {
+	name  string
+	value string
+}
+
+type authChallenge struct {
+	scheme string
+	params []authParam
+}
+
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+func skipSpace(header string, i int) int {
+	for i < len(header) && (header[i] == ' ' || header[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+// readAuthParamValue reads a quoted-string or a bare value starting at i,
+// returning the value and the position after it. Bare values run until the
+// next comma or whitespace, so that base64 padding needs no quoting.
+func readAuthParamValue(header string, i int) (string, int, error) {
+	if i < len(header) && header[i] == '"' {
+		var value strings.Builder
+		for i++; i < len(header); i++ {
+			switch header[i] {
+			case '"':
+				return value.String(), i + 1, nil
+			case '\\':
+				i++
+				if i == len(header) {
+					return "", 0, fmt.Errorf("%w: unterminated quoted string", ErrInvalidAuthHeader)
+				}
+			}
+			value.WriteByte(header[i])
+		}
+		return "", 0, fmt.Errorf("%w: unterminated quoted string", ErrInvalidAuthHeader)
+	}
+
+	start := i
+	for i < len(header) && header[i] != ',' && header[i] != ' ' && header[i] != '\t' {
+		i++
+	}
+	return header[start:i], i, nil
+}
+
+// parseAuthChallenges splits a WWW-Authenticate header value into challenges,
+// each a scheme followed by comma-separated name=value parameters.
+func parseAuthChallenges(header string) ([]authChallenge, error) {
+	var challenges []authChallenge
+	i := 0
+	for {
+		for i < len(header) && (header[i] == ',' || header[i] == ' ' || header[i] == '\t') {
+			i++
+		}
+		if i == len(header) {
+			return challenges, nil
+		}
+
+		start := i
+		for i < len(header) && isTokenChar(header[i]) {
+			i++
+		}
+		if i == start {
+			return nil, fmt.Errorf("%w: unexpected %q at offset %d", ErrInvalidAuthHeader, header[i], i)
+		}
+		name := header[start:i]
+
+		next := skipSpace(header, i)
+		if next == len(header) || header[next] != '=' {
+			challenges = append(challenges, authChallenge{scheme: name})
+			continue
+		}
+		if len(challenges) == 0 {
+			return nil, fmt.Errorf("%w: parameter %s before any scheme", ErrInvalidAuthHeader, name)
+		}
+		value, end, err := readAuthParamValue(header, skipSpace(header, next+1))
+		if err != nil {
+			return nil, err
+		}
+		current := &challenges[len(challenges)-1]
+		current.params = append(current.params, authParam{name: strings.ToLower(name), value: value})
+		i = end
+	}
+}
+
+// ParseWWWAuthenticate parses the PrivateToken challenges for the rate-limited
+// token type in a WWW-Authenticate header value. Multiple challenges,
+// including those of other schemes and token types, may be listed separated by
+// commas, and multiple WWW-Authenticate headers can be joined with ", ". The
+// challenge and token-key parameters are base64url-encoded, with or without
+// padding, and max-age is in seconds. Unknown parameters are ignored. It fails
+// with ErrNoChallenge if the header has no rate-limited challenge.
+func ParseWWWAuthenticate(header string) ([]PrivateTokenChallenge, error) {
+	authChallenges, err := parseAuthChallenges(header)
+	if err != nil {
+		return nil, err
+	}
+
+	var challenges []PrivateTokenChallenge
+	for _, authChallenge := range authChallenges {
+		if !strings.EqualFold(authChallenge.scheme, privateTokenScheme) {
+			continue
+		}
+		params := make(map[string]string)
+		for _, param := range authChallenge.params {
+			if _, ok := params[param.name]; ok {
+				return nil, fmt.Errorf("%w: duplicate parameter %s", ErrInvalidAuthHeader, param.name)
+			}
+			params[param.name] = param.value
+		}
+
+		challengeEnc, err := decodeDirectoryValue(params["challenge"])
+		if err != nil || len(challengeEnc) == 0 {
+			return nil, fmt.Errorf("%w: missing or invalid challenge", ErrInvalidAuthHeader)
+		}
+		tokenChallenge, err := tokens.UnmarshalTokenChallenge(challengeEnc)
+		if err != nil {
+			return nil, fmt.Errorf("%w: challenge: %v", ErrInvalidAuthHeader, err)
+		}
+		if tokenChallenge.TokenType != RateLimitedTokenType {
+			continue
+		}
+
+		tokenKeyEnc, err := decodeDirectoryValue(params["token-key"])
+		if err != nil || len(tokenKeyEnc) == 0 {
+			return nil, fmt.Errorf("%w: missing or invalid token-key", ErrInvalidAuthHeader)
+		}
+		tokenKey, err := util.UnmarshalTokenKey(tokenKeyEnc)
+		if err != nil {
+			return nil, fmt.Errorf("%w: token-key: %v", ErrInvalidAuthHeader, err)
+		}
+		tokenKeyID := sha256.Sum256(tokenKeyEnc)
+
+		var maxAge time.Duration
+		if value, ok := params["max-age"]; ok {
+			seconds, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%w: max-age: %v", ErrInvalidAuthHeader, err)
+			}
+			maxAge = time.Duration(seconds) * time.Second
+		}
+
+		challenges = append(challenges, PrivateTokenChallenge{
+			Challenge:      challengeEnc,
+			TokenChallenge: tokenChallenge,
+			TokenKey:       tokenKey,
+			TokenKeyID:     tokenKeyID[:],
+			MaxAge:         maxAge,
+		})
+	}
+	if len(challenges) == 0 {
+		return nil, ErrNoChallenge
+	}
+	return challenges, nil
+}
+
+// ParseAuthorizationToken parses the token presented in an Authorization header
+// value, as produced by tokens.Token.AuthorizationHeaderValue. The scheme and
+// parameter names are matched case-insensitively, and the token may be
+// base64url-encoded with or without padding. It fails with ErrNoToken if the
+// header has no PrivateToken credentials, and with ErrUnexpectedTokenType if
+// the token is not a rate-limited token.
+func ParseAuthorizationToken(header string) (tokens.Token, error) {
+	credentials, err := parseAuthChallenges(header)
+	if err != nil {
+		return tokens.Token{}, err
+	}
+
+	for _, credential := range credentials {
+		if !strings.EqualFold(credential.scheme, privateTokenScheme) {
+			continue
+		}
+		var tokenParam string
+		found := false
+		for _, param := range credential.params {
+			if param.name != "token" {
+				continue
+			}
+			if found {
+				return tokens.Token{}, fmt.Errorf("%w: duplicate parameter token", ErrInvalidAuthHeader)
+			}
+			tokenParam, found = param.value, true
+		}
+		if !found {
+			return tokens.Token{}, fmt.Errorf("%w: missing token", ErrInvalidAuthHeader)
+		}
+
+		tokenEnc, err := decodeDirectoryValue(tokenParam)
+		if err != nil {
+			return tokens.Token{}, fmt.Errorf("%w: invalid token encoding", ErrInvalidAuthHeader)
+		}
+		token, err := UnmarshalToken(tokenEnc)
+		if err != nil {
+			return tokens.Token{}, fmt.Errorf("%w: %v", ErrInvalidAuthHeader, err)
+		}
+		if token.TokenType != RateLimitedTokenType {
+			return tokens.Token{}, fmt.Errorf("%w: 0x%04x", ErrUnexpectedTokenType, token.TokenType)
+		}
+		return token, nil
+	}
+	return tokens.Token{}, ErrNoToken
+}
@@ -0,0 +1,171 @@
+package type3
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/pat-go/ecdsa"
+	"github.com/cloudflare/pat-go/tokens"
+	"github.com/cloudflare/pat-go/util"
+)
+
+func TestParseWWWAuthenticate(t *testing.T) {
+	testOrigin := "origin.example"
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	issuer.AddOrigin(testOrigin)
+	tokenKeyEnc, err := util.MarshalTokenKeyPSSOID(issuer.TokenKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := tokens.TokenChallenge{
+		TokenType:       RateLimitedTokenType,
+		IssuerName:      "issuer.example",
+		RedemptionNonce: bytes.Repeat([]byte{0x01}, 32),
+		OriginInfo:      []string{testOrigin},
+	}
+	challengeEnc := challenge.Marshal()
+	otherChallengeEnc := tokens.TokenChallenge{
+		TokenType:  0x0002,
+		IssuerName: "issuer.example",
+	}.Marshal()
+
+	padded := base64.URLEncoding.EncodeToString
+	raw := base64.RawURLEncoding.EncodeToString
+	header := `Basic realm="example", ` +
+		`PrivateToken challenge=` + raw(otherChallengeEnc) + `, token-key=` + raw(tokenKeyEnc) + `, ` +
+		`PrivateToken challenge="` + padded(challengeEnc) + `", token-key="` + padded(tokenKeyEnc) + `", max-age="10", ` +
+		`privatetoken Challenge=` + raw(challengeEnc) + `,Token-Key=` + padded(tokenKeyEnc) + `,unknown="a \"quoted\" value"`
+
+	challenges, err := ParseWWWAuthenticate(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(challenges) != 2 {
+		t.Fatalf("expected 2 rate-limited challenges, got %d", len(challenges))
+	}
+	for j, c := range challenges {
+		if !bytes.Equal(c.Challenge, challengeEnc) {
+			t.Errorf("challenge %d: encoded challenge mismatch", j)
+		}
+		if !c.TokenChallenge.Equals(challenge) {
+			t.Errorf("challenge %d: decoded challenge mismatch", j)
+		}
+		if !c.TokenKey.Equal(issuer.TokenKey()) {
+			t.Errorf("challenge %d: token key mismatch", j)
+		}
+		if !bytes.Equal(c.TokenKeyID, issuer.TokenKeyID()) {
+			t.Errorf("challenge %d: token key ID mismatch", j)
+		}
+	}
+	if challenges[0].MaxAge != 10*time.Second {
+		t.Errorf("expected max-age of 10s, got %v", challenges[0].MaxAge)
+	}
+	if challenges[1].MaxAge != 0 {
+		t.Errorf("expected no max-age, got %v", challenges[1].MaxAge)
+	}
+
+	// The parsed challenge is all a client needs to request a token
+	client, _ := createTestTokenRequest(t, issuer, testOrigin)
+	blindKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := challenges[0]
+	if _, err := client.CreateTokenRequest(c.Challenge, c.TokenChallenge.RedemptionNonce, blindKey.D.Bytes(), c.TokenKeyID, c.TokenKey, testOrigin, issuer.NameKey()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseWWWAuthenticateErrors(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	tokenKeyEnc, err := util.MarshalTokenKeyPSSOID(issuer.TokenKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenKey := base64.RawURLEncoding.EncodeToString(tokenKeyEnc)
+	challenge := base64.RawURLEncoding.EncodeToString(tokens.TokenChallenge{
+		TokenType:  RateLimitedTokenType,
+		IssuerName: "issuer.example",
+	}.Marshal())
+
+	cases := []struct {
+		name   string
+		header string
+		err    error
+	}{
+		{"empty", "", ErrNoChallenge},
+		{"other scheme", `Basic realm="example"`, ErrNoChallenge},
+		{"parameter before scheme", `challenge=` + challenge, ErrInvalidAuthHeader},
+		{"unterminated quote", `PrivateToken challenge="` + challenge, ErrInvalidAuthHeader},
+		{"missing challenge", `PrivateToken token-key=` + tokenKey, ErrInvalidAuthHeader},
+		{"missing token key", `PrivateToken challenge=` + challenge, ErrInvalidAuthHeader},
+		{"invalid base64", `PrivateToken challenge=` + challenge + `, token-key=!!!`, ErrInvalidAuthHeader},
+		{"invalid token key", `PrivateToken challenge=` + challenge + `, token-key=` + challenge, ErrInvalidAuthHeader},
+		{"invalid max-age", `PrivateToken challenge=` + challenge + `, token-key=` + tokenKey + `, max-age=-1`, ErrInvalidAuthHeader},
+		{"duplicate parameter", `PrivateToken challenge=` + challenge + `, token-key=` + tokenKey + `, Token-Key=` + tokenKey, ErrInvalidAuthHeader},
+	}
+	for _, c := range cases {
+		if _, err := ParseWWWAuthenticate(c.header); !errors.Is(err, c.err) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestParseAuthorizationToken(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := requestState.FinalizeToken(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenEnc := token.Marshal()
+	headers := []string{
+		token.AuthorizationHeaderValue(),
+		"  privatetoken   TOKEN = " + base64.URLEncoding.EncodeToString(tokenEnc) + "  ",
+		`PrivateToken token="` + base64.RawURLEncoding.EncodeToString(tokenEnc) + `"`,
+	}
+	for _, header := range headers {
+		parsed, err := ParseAuthorizationToken(header)
+		if err != nil {
+			t.Fatalf("%q: %v", header, err)
+		}
+		if !bytes.Equal(parsed.Marshal(), tokenEnc) {
+			t.Fatalf("%q: token mismatch", header)
+		}
+		if err := VerifyToken(parsed, issuer.TokenKey()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	otherToken := token
+	otherToken.TokenType = 0x0002
+	cases := []struct {
+		header string
+		err    error
+	}{
+		{"", ErrNoToken},
+		{"Bearer abc", ErrNoToken},
+		{"PrivateToken", ErrInvalidAuthHeader},
+		{"PrivateToken token=!!!", ErrInvalidAuthHeader},
+		{"PrivateToken token=" + base64.RawURLEncoding.EncodeToString(tokenEnc[:100]), ErrInvalidAuthHeader},
+		{otherToken.AuthorizationHeaderValue(), ErrUnexpectedTokenType},
+	}
+	for _, c := range cases {
+		if _, err := ParseAuthorizationToken(c.header); !errors.Is(err, c.err) {
+			t.Errorf("%q: expected %v, got %v", c.header, c.err, err)
+		}
+	}
+}
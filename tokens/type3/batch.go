@@ -0,0 +1,116 @@
+package type3
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"runtime"
+)
+
+var (
+	ErrDuplicateInBatch = errors.New("duplicate request key and origin in batch")
+)
+
+// SetRejectBatchDuplicates makes EvaluateBatch reject every request after the
+// first in a batch that carries the same request key for the same origin.
+// Such requests yield the same blinded request key, so they are likely a
+// client trying to get more than its share of tokens counted once by the
+// attester. This is a per-batch heuristic only: duplicates spread across
+// batches, or across Evaluate calls, are not detected.
+func (i *RateLimitedIssuer) SetRejectBatchDuplicates(reject bool) {
+	i.rejectBatchDuplicates = reject
+}
+
+// EvaluateBatch evaluates each request as Evaluate does, returning the
+// encrypted token response, blinded request key, and error for reqs[i] at index
+// i. A failing request does not affect the others. Requests are independent, so
+// they are evaluated on up to runtime.NumCPU() goroutines; HPKE decryption and
+// blind RSA signing dominate the cost, so a batch completes up to that many
+// times faster than evaluating its requests one by one.
+func (i *RateLimitedIssuer) EvaluateBatch(reqs []*RateLimitedTokenRequest) ([][]byte, [][]byte, []error) {
+	responses := make([][]byte, len(reqs))
+	blindedRequestKeys := make([][]byte, len(reqs))
+	errs := make([]error, len(reqs))
+	i.evaluateBatch(reqs, func(j int, response, blindedRequestKey []byte, err error) {
+		responses[j], blindedRequestKeys[j], errs[j] = response, blindedRequestKey, err
+	})
+	return responses, blindedRequestKeys, errs
+}
+
+// batchResult is the outcome of evaluating one request of a batch. done is
+// closed once the other fields are set.
+type batchResult struct {
+	response          []byte
+	blindedRequestKey []byte
+	originName        string
+	tokenKeyID        []byte
+	err               error
+	done              chan struct{}
+}
+
+// evaluateBatch evaluates reqs concurrently and passes each result to emit, in
+// request order, as soon as it and all earlier ones are available. Duplicate
+// detection and audit logging happen in request order too, so their outcome
+// does not depend on scheduling.
+func (i *RateLimitedIssuer) evaluateBatch(reqs []*RateLimitedTokenRequest, emit func(j int, response, blindedRequestKey []byte, err error)) {
+	// Marshal caches the encoding in the request, so encode up front rather
+	// than racing on requests that appear more than once in the batch
+	encodedRequests := make([][]byte, len(reqs))
+	results := make([]batchResult, len(reqs))
+	for j, req := range reqs {
+		if req != nil {
+			encodedRequests[j] = req.Marshal()
+		}
+		results[j].done = make(chan struct{})
+	}
+
+	workers := runtime.NumCPU()
+	if workers > len(reqs) {
+		workers = len(reqs)
+	}
+	indices := make(chan int)
+	for w := 0; w < workers; w++ {
+		go func() {
+			for j := range indices {
+				result := &results[j]
+				if reqs[j] == nil {
+					result.err = ErrMalformedRequest
+				} else {
+					result.response, result.blindedRequestKey, result.originName, result.tokenKeyID, result.err = i.evaluate(context.Background(), rand.Reader, encodedRequests[j])
+				}
+				close(result.done)
+			}
+		}()
+	}
+	go func() {
+		for j := range reqs {
+			indices <- j
+		}
+		close(indices)
+	}()
+
+	seen := make(map[string]struct{})
+	for j, req := range reqs {
+		result := &results[j]
+		<-result.done
+		if req == nil {
+			emit(j, nil, nil, result.err)
+			continue
+		}
+
+		response, blindedRequestKey, err := result.response, result.blindedRequestKey, result.err
+		if err == nil && i.rejectBatchDuplicates {
+			// The blinded request key is determined by the request key and
+			// the origin's index key
+			if _, ok := seen[string(blindedRequestKey)]; ok {
+				response, blindedRequestKey, err = nil, nil, ErrDuplicateInBatch
+			} else {
+				seen[string(blindedRequestKey)] = struct{}{}
+			}
+		}
+		if logErr := i.audit(result.originName, result.tokenKeyID, err); logErr != nil {
+			response, blindedRequestKey, err = nil, nil, logErr
+		}
+		emit(j, response, blindedRequestKey, err)
+	}
+}
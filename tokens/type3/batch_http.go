@@ -0,0 +1,279 @@
+package type3
+
+import (
+	"crypto/elliptic"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Batches are sent as a sequence of frames so that the issuer can stream each
+// response as soon as it is signed. The request body is
+//
+//	uint32 length || TokenRequest
+//
+// repeated for at most MaxBatchRequests requests. The response body is
+//
+//	uint8 frame_type || uint32 length || body
+//
+// repeated once per request, in request order, followed by a single summary
+// frame. A BatchFrameResponse body is the encrypted token response followed by
+// the blinded request key, as returned by HTTPHandler. A BatchFrameError body
+// is the error message for that request. The BatchFrameSummary body is
+//
+//	uint32 succeeded || uint32 failed
+//
+// and a stream that ends before it was cut short by the issuer or the network.
+const (
+	TokenRequestBatchMediaType  = "application/private-token-request-batch"
+	TokenResponseBatchMediaType = "application/private-token-response-batch"
+
+	MaxBatchRequests = 256
+
+	BatchFrameResponse uint8 = 0x00
+	BatchFrameError    uint8 = 0x01
+	BatchFrameSummary  uint8 = 0x02
+
+	batchSummarySize = 8
+)
+
+var (
+	ErrMalformedBatch     = errors.New("malformed batch")
+	ErrBatchFrameTooLarge = errors.New("batch frame too large")
+)
+
+// MarshalBatchRequest encodes reqs as a batch request body.
+func MarshalBatchRequest(reqs []*RateLimitedTokenRequest) ([]byte, error) {
+	if len(reqs) > MaxBatchRequests {
+		return nil, fmt.Errorf("%w: %d requests exceeds limit of %d", ErrMalformedBatch, len(reqs), MaxBatchRequests)
+	}
+
+	var out []byte
+	for _, req := range reqs {
+		encodedRequest := req.Marshal()
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(encodedRequest)))
+		out = append(out, length[:]...)
+		out = append(out, encodedRequest...)
+	}
+	return out, nil
+}
+
+// readBatchRequest decodes a batch request body of requests with request keys
+// on curve, rejecting requests larger than maxRequestSize.
+func readBatchRequest(curve elliptic.Curve, body []byte, maxRequestSize int) ([]*RateLimitedTokenRequest, error) {
+	var reqs []*RateLimitedTokenRequest
+	for len(body) > 0 {
+		if len(reqs) == MaxBatchRequests {
+			return nil, fmt.Errorf("%w: more than %d requests", ErrMalformedBatch, MaxBatchRequests)
+		}
+		if len(body) < 4 {
+			return nil, ErrMalformedBatch
+		}
+		length := binary.BigEndian.Uint32(body)
+		body = body[4:]
+		if uint64(length) > uint64(maxRequestSize) {
+			return nil, ErrBatchFrameTooLarge
+		}
+		if uint64(length) > uint64(len(body)) {
+			return nil, ErrMalformedBatch
+		}
+
+		req := new(RateLimitedTokenRequest)
+		if !req.UnmarshalForCurve(curve, body[:length]) {
+			return nil, fmt.Errorf("%w: request %d: %v", ErrMalformedBatch, len(reqs), ErrMalformedRequest)
+		}
+		reqs = append(reqs, req)
+		body = body[length:]
+	}
+	return reqs, nil
+}
+
+func writeBatchFrame(w io.Writer, frameType uint8, body []byte) error {
+	var header [5]byte
+	header[0] = frameType
+	binary.BigEndian.PutUint32(header[1:], uint32(len(body)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// BatchHTTPHandler returns an http.Handler serving batched token requests. It
+// evaluates the requests as EvaluateBatch does and streams each result as a
+// frame as soon as it is available, so that clients can finalize early tokens
+// while later ones are still being signed. Once streaming has started the
+// status is 200, and failures of individual requests are reported in their
+// frames with the fixed status text HTTPHandler would send.
+func (i *RateLimitedIssuer) BatchHTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Content-Type") != TokenRequestBatchMediaType {
+			http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+			return
+		}
+		if !i.canServe() {
+			http.Error(w, "issuer not ready", http.StatusServiceUnavailable)
+			return
+		}
+
+		maxBodySize := int64(MaxBatchRequests) * int64(4+i.MaxRequestSize())
+		if r.ContentLength > maxBodySize {
+			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			if isRequestTooLarge(err) {
+				http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, "failed reading request", http.StatusBadRequest)
+			}
+			return
+		}
+		reqs, err := readBatchRequest(i.curve, body, i.MaxRequestSize())
+		if err != nil {
+			i.logf("type3: batch request failed: %v", err)
+			if errors.Is(err, ErrBatchFrameTooLarge) {
+				http.Error(w, "batch frame too large", http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, "malformed batch", http.StatusBadRequest)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", TokenResponseBatchMediaType)
+		w.WriteHeader(http.StatusOK)
+		flusher, _ := w.(http.Flusher)
+
+		var succeeded, failed uint32
+		var writeErr error
+		i.evaluateBatch(reqs, func(j int, response, blindedRequestKey []byte, err error) {
+			if writeErr != nil {
+				return
+			}
+			if err != nil {
+				failed++
+				i.logf("type3: batch request %d failed: %v", j, err)
+				_, text := evaluationErrorStatus(err)
+				writeErr = writeBatchFrame(w, BatchFrameError, []byte(text))
+			} else {
+				succeeded++
+				writeErr = writeBatchFrame(w, BatchFrameResponse, append(response, blindedRequestKey...))
+			}
+			if writeErr == nil && flusher != nil {
+				flusher.Flush()
+			}
+		})
+		if writeErr != nil {
+			// The client is gone and will see a stream without a summary
+			return
+		}
+
+		var summary [batchSummarySize]byte
+		binary.BigEndian.PutUint32(summary[:4], succeeded)
+		binary.BigEndian.PutUint32(summary[4:], failed)
+		writeBatchFrame(w, BatchFrameSummary, summary[:])
+	})
+}
+
+// BatchFrame is a frame read from a batch response stream. Index is the
+// position of the corresponding request in the batch, and is -1 for the
+// summary frame.
+type BatchFrame struct {
+	Type  uint8
+	Index int
+	Body  []byte
+}
+
+// Err returns the error reported by a BatchFrameError frame, and nil for other
+// frames.
+func (f BatchFrame) Err() error {
+	if f.Type != BatchFrameError {
+		return nil
+	}
+	return fmt.Errorf("request %d: %s", f.Index, f.Body)
+}
+
+// Summary returns the number of succeeded and failed requests reported by a
+// BatchFrameSummary frame.
+func (f BatchFrame) Summary() (succeeded, failed int, err error) {
+	if f.Type != BatchFrameSummary || len(f.Body) != batchSummarySize {
+		return 0, 0, ErrMalformedBatch
+	}
+	return int(binary.BigEndian.Uint32(f.Body[:4])), int(binary.BigEndian.Uint32(f.Body[4:])), nil
+}
+
+// BatchResponseReader reads frames from a batch response stream.
+type BatchResponseReader struct {
+	r            io.Reader
+	maxFrameSize int
+	index        int
+	done         bool
+}
+
+// NewBatchResponseReader returns a reader for the batch response stream r.
+// Frames with a body larger than maxFrameSize are rejected with
+// ErrBatchFrameTooLarge before their body is read, so a misbehaving issuer
+// cannot make the client allocate arbitrary amounts of memory.
+func NewBatchResponseReader(r io.Reader, maxFrameSize int) *BatchResponseReader {
+	return &BatchResponseReader{
+		r:            r,
+		maxFrameSize: maxFrameSize,
+	}
+}
+
+// Next returns the next frame in the stream. It returns io.EOF after the
+// summary frame, and ErrMalformedBatch if the stream ends before it.
+func (b *BatchResponseReader) Next() (BatchFrame, error) {
+	if b.done {
+		return BatchFrame{}, io.EOF
+	}
+
+	var header [5]byte
+	if _, err := io.ReadFull(b.r, header[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return BatchFrame{}, fmt.Errorf("%w: stream ended after %d frames without a summary", ErrMalformedBatch, b.index)
+		}
+		return BatchFrame{}, err
+	}
+	frameType := header[0]
+	length := binary.BigEndian.Uint32(header[1:])
+	if uint64(length) > uint64(b.maxFrameSize) {
+		return BatchFrame{}, ErrBatchFrameTooLarge
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(b.r, body); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return BatchFrame{}, fmt.Errorf("%w: truncated frame %d", ErrMalformedBatch, b.index)
+		}
+		return BatchFrame{}, err
+	}
+
+	switch frameType {
+	case BatchFrameResponse, BatchFrameError:
+		frame := BatchFrame{Type: frameType, Index: b.index, Body: body}
+		b.index++
+		return frame, nil
+	case BatchFrameSummary:
+		b.done = true
+		frame := BatchFrame{Type: frameType, Index: -1, Body: body}
+		succeeded, failed, err := frame.Summary()
+		if err != nil {
+			return BatchFrame{}, err
+		}
+		if succeeded+failed != b.index {
+			return BatchFrame{}, fmt.Errorf("%w: summary counts %d requests, read %d", ErrMalformedBatch, succeeded+failed, b.index)
+		}
+		return frame, nil
+	default:
+		return BatchFrame{}, fmt.Errorf("%w: unknown frame type %d", ErrMalformedBatch, frameType)
+	}
+}
@@ -0,0 +1,309 @@
+package type3
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cloudflare/pat-go/ecdsa"
+)
+
+func TestEvaluateBatchDuplicates(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	otherOrigin := "other.example"
+	issuer.AddOrigin(testOrigin)
+	issuer.AddOrigin(otherOrigin)
+	issuer.SetRejectBatchDuplicates(true)
+
+	client, _ := createTestTokenRequest(t, issuer, testOrigin)
+	blindKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createRequest := func(origin string) RateLimitedTokenRequestState {
+		challenge := make([]byte, 32)
+		rand.Reader.Read(challenge)
+		nonce := make([]byte, 32)
+		rand.Reader.Read(nonce)
+		requestState, err := client.CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), origin, issuer.NameKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return requestState
+	}
+
+	// The same blind gives the same request key for every request
+	states := []RateLimitedTokenRequestState{
+		createRequest(testOrigin),
+		createRequest(otherOrigin),
+		createRequest(testOrigin),
+	}
+	_, unrelated := createTestTokenRequest(t, issuer, testOrigin)
+	states = append(states, unrelated)
+
+	reqs := make([]*RateLimitedTokenRequest, len(states))
+	for j := range states {
+		reqs[j] = states[j].Request()
+	}
+	responses, blindedRequestKeys, errs := issuer.EvaluateBatch(reqs)
+	for _, j := range []int{0, 1, 3} {
+		if errs[j] != nil {
+			t.Fatalf("request %d: %v", j, errs[j])
+		}
+		if _, err := states[j].FinalizeToken(responses[j]); err != nil {
+			t.Fatalf("request %d: %v", j, err)
+		}
+	}
+	if !errors.Is(errs[2], ErrDuplicateInBatch) {
+		t.Fatalf("expected ErrDuplicateInBatch, got %v", errs[2])
+	}
+	if responses[2] != nil || blindedRequestKeys[2] != nil {
+		t.Fatal("response returned for duplicate request")
+	}
+
+	// Duplicates are only rejected within a batch
+	responses, _, errs = issuer.EvaluateBatch(reqs[2:3])
+	if errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+	if _, err := states[2].FinalizeToken(responses[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	issuer.SetRejectBatchDuplicates(false)
+	if _, _, errs := issuer.EvaluateBatch([]*RateLimitedTokenRequest{reqs[0], reqs[0], nil}); errs[0] != nil || errs[1] != nil || !errors.Is(errs[2], ErrMalformedRequest) {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+}
+
+func TestBatchHTTPHandlerStreaming(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	// The middle request fails, and the requests around it still succeed
+	_, first := createTestTokenRequest(t, issuer, testOrigin)
+	_, unknown := createTestTokenRequest(t, issuer, "other.example")
+	_, last := createTestTokenRequest(t, issuer, testOrigin)
+	states := []RateLimitedTokenRequestState{first, unknown, last}
+	reqs := []*RateLimitedTokenRequest{first.Request(), unknown.Request(), last.Request()}
+	body, err := MarshalBatchRequest(reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/token-request-batch", bytes.NewReader(body))
+	req.Header.Set("Content-Type", TokenRequestBatchMediaType)
+	rec := httptest.NewRecorder()
+	issuer.BatchHTTPHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !rec.Flushed {
+		t.Fatal("responses were not flushed")
+	}
+	stream := rec.Body.Bytes()
+
+	blindedRequestKeyLen := 49
+	reader := NewBatchResponseReader(bytes.NewReader(stream), 4096)
+	for j := range states {
+		frame, err := reader.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Index != j {
+			t.Fatalf("expected frame %d, got %d", j, frame.Index)
+		}
+		if j == 1 {
+			if frame.Type != BatchFrameError || frame.Err() == nil {
+				t.Fatalf("expected error frame, got type %d", frame.Type)
+			}
+			continue
+		}
+		if frame.Type != BatchFrameResponse {
+			t.Fatalf("expected response frame, got type %d: %v", frame.Type, frame.Err())
+		}
+		if _, err := states[j].FinalizeToken(frame.Body[:len(frame.Body)-blindedRequestKeyLen]); err != nil {
+			t.Fatalf("request %d: %v", j, err)
+		}
+	}
+	frame, err := reader.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	succeeded, failed, err := frame.Summary()
+	if err != nil || succeeded != 2 || failed != 1 {
+		t.Fatalf("unexpected summary %d/%d: %v", succeeded, failed, err)
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+
+	// A stream cut short is reported instead of ending silently
+	reader = NewBatchResponseReader(bytes.NewReader(stream[:len(stream)-5-batchSummarySize]), 4096)
+	for j := range states {
+		if _, err := reader.Next(); err != nil {
+			t.Fatalf("frame %d: %v", j, err)
+		}
+	}
+	if _, err := reader.Next(); !errors.Is(err, ErrMalformedBatch) {
+		t.Fatalf("expected ErrMalformedBatch, got %v", err)
+	}
+
+	// Frame sizes are bounded before the body is read
+	reader = NewBatchResponseReader(bytes.NewReader(stream), 16)
+	if _, err := reader.Next(); !errors.Is(err, ErrBatchFrameTooLarge) {
+		t.Fatalf("expected ErrBatchFrameTooLarge, got %v", err)
+	}
+}
+
+func TestBatchHTTPHandlerMalformedBatch(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	issuer.AddOrigin("origin.example")
+
+	for _, body := range [][]byte{
+		{0x00, 0x00},
+		{0x00, 0x00, 0x00, 0x10, 0x00, 0x03},
+		{0x00, 0x00, 0x00, 0x02, 0x00, 0x03},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/token-request-batch", bytes.NewReader(body))
+		req.Header.Set("Content-Type", TokenRequestBatchMediaType)
+		rec := httptest.NewRecorder()
+		issuer.BatchHTTPHandler().ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %x, got %d", body, rec.Code)
+		}
+	}
+}
+
+func TestBatchHTTPHandlerNoOrigins(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	body, err := MarshalBatchRequest([]*RateLimitedTokenRequest{requestState.Request()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/token-request-batch", bytes.NewReader(body))
+		req.Header.Set("Content-Type", TokenRequestBatchMediaType)
+		rec := httptest.NewRecorder()
+		issuer.BatchHTTPHandler().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := post(); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if err := issuer.RemoveOrigin(testOrigin); err != nil {
+		t.Fatal(err)
+	}
+	if code := post(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 after removing the last origin, got %d", code)
+	}
+}
+
+func BenchmarkEvaluateBatch(b *testing.B) {
+	issuer := createTestIssuer(b, loadPrivateKeyForBenchmark(b))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	curve := elliptic.P384()
+	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		b.Fatal(err)
+	}
+	reqs := make([]*RateLimitedTokenRequest, 100)
+	for j := range reqs {
+		blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			b.Fatal(err)
+		}
+		challenge := make([]byte, 32)
+		rand.Reader.Read(challenge)
+		nonce := make([]byte, 32)
+		rand.Reader.Read(nonce)
+		requestState, err := client.CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+		if err != nil {
+			b.Fatal(err)
+		}
+		reqs[j] = requestState.Request()
+	}
+
+	b.Run("Serial", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, req := range reqs {
+				if _, _, err := issuer.Evaluate(req.Marshal()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("Batch", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			_, _, errs := issuer.EvaluateBatch(reqs)
+			for _, err := range errs {
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func TestEvaluateBatchDuringNameKeyRotation(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	states := make([]RateLimitedTokenRequestState, 16)
+	reqs := make([]*RateLimitedTokenRequest, len(states))
+	for j := range states {
+		_, states[j] = createTestTokenRequest(t, issuer, testOrigin)
+		reqs[j] = states[j].Request()
+	}
+
+	// Rotating and retiring name keys while requests are evaluated must not
+	// race; previous name keys stay valid, so every request still succeeds
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for id := uint8(1); id <= 8; id++ {
+			if _, err := issuer.RotateNameKey(id); err != nil {
+				t.Error(err)
+				return
+			}
+			if id > 1 {
+				if err := issuer.RetireNameKey(id - 1); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+	for round := 0; round < 4; round++ {
+		responses, _, errs := issuer.EvaluateBatch(reqs)
+		for j := range reqs {
+			if errs[j] != nil {
+				t.Fatalf("request %d: %v", j, errs[j])
+			}
+			if _, err := states[j].FinalizeToken(responses[j]); err != nil {
+				t.Fatalf("request %d: %v", j, err)
+			}
+		}
+	}
+	<-done
+}
@@ -0,0 +1,95 @@
+package type3
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cloudflare/pat-go/ecdsa"
+)
+
+const benchmarkOrigin = "benchmark.invalid"
+
+var (
+	ErrInvalidBenchmarkDuration = errors.New("benchmark duration must be positive")
+)
+
+// Benchmark estimates the issuer's throughput, in evaluations per second, by
+// evaluating a synthetic token request for a throwaway origin for about d. It
+// uses the issuer's token and name keys, so the estimate reflects the key
+// size, but runs against a private copy of the issuer: the throwaway origin is
+// never registered with i, and nothing is recorded in its audit log, blinded
+// message tracker, or phase timer. Evaluations run sequentially, so the result
+// is the capacity of a single core. It fails with ErrNilTokenKey if the issuer
+// has no token key.
+func (i *RateLimitedIssuer) Benchmark(d time.Duration) (opsPerSec float64, err error) {
+	if d <= 0 {
+		return 0, ErrInvalidBenchmarkDuration
+	}
+	tokenKey := i.currentTokenKey()
+	if tokenKey == nil {
+		return 0, ErrNilTokenKey
+	}
+
+	originIndexKey, err := ecdsa.GenerateKey(i.curve, rand.Reader)
+	if err != nil {
+		return 0, err
+	}
+	nameKey := i.currentNameKey()
+	bench := &RateLimitedIssuer{
+		curve:           i.curve,
+		nameKey:         nameKey,
+		nameKeys:        map[string]PrivateEncapKey{string(nameKeyConfigID(nameKey.Public())): nameKey},
+		retiredNameKeys: make(map[string]struct{}),
+		tokenKey:        tokenKey,
+		tokenKeys:       make(map[string]*rsa.PrivateKey),
+		originIndexKeys: map[string]*ecdsa.PrivateKey{
+			benchmarkOrigin: originIndexKey,
+		},
+		variant:               i.variant,
+		saltLength:            i.saltLength,
+		deterministicNonceKey: i.deterministicNonceKey,
+	}
+	bench.registerTokenKey(tokenKey)
+
+	secretKey, err := ecdsa.GenerateKey(i.curve, rand.Reader)
+	if err != nil {
+		return 0, err
+	}
+	blindKey, err := ecdsa.GenerateKey(i.curve, rand.Reader)
+	if err != nil {
+		return 0, err
+	}
+	challenge := make([]byte, 32)
+	rand.Reader.Read(challenge)
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+
+	client, err := NewRateLimitedClientFromSecretWithCurve(i.curve, secretKey.D.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	requestState, err := client.CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), bench.TokenKeyID(), bench.TokenKey(), benchmarkOrigin, bench.NameKey())
+	if err != nil {
+		return 0, fmt.Errorf("failed to create benchmark request: %w", err)
+	}
+	encodedRequest := requestState.Request().Marshal()
+
+	// The bench issuer keeps no state across evaluations, so the same request
+	// can be evaluated repeatedly
+	ops := 0
+	start := time.Now()
+	elapsed := time.Duration(0)
+	for elapsed < d {
+		if _, _, _, _, err := bench.evaluate(context.Background(), rand.Reader, encodedRequest); err != nil {
+			return 0, fmt.Errorf("benchmark evaluation failed: %w", err)
+		}
+		ops++
+		elapsed = time.Since(start)
+	}
+
+	return float64(ops) / elapsed.Seconds(), nil
+}
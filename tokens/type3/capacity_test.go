@@ -0,0 +1,51 @@
+package type3
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBenchmark(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	var buf bytes.Buffer
+	issuer.SetAuditLog(NewAuditLog(&buf))
+	tracker := NewMemoryBlindedMessageTracker(time.Hour)
+	issuer.SetBlindedMessageTracker(tracker)
+	phases := 0
+	issuer.SetPhaseTimer(func(EvaluatePhase, time.Duration) {
+		phases++
+	})
+
+	opsPerSec, err := issuer.Benchmark(50 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opsPerSec <= 0 {
+		t.Fatalf("unexpected throughput %f", opsPerSec)
+	}
+
+	if buf.Len() != 0 || phases != 0 {
+		t.Fatal("benchmark evaluations were recorded")
+	}
+	if issuer.OriginIndexKey(benchmarkOrigin) != nil {
+		t.Fatal("benchmark origin left registered")
+	}
+
+	// The real issuer is unaffected
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	if _, _, err := issuer.Evaluate(requestState.Request().Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() == 0 {
+		t.Fatal("evaluation after benchmark not recorded")
+	}
+
+	if _, err := issuer.Benchmark(0); !errors.Is(err, ErrInvalidBenchmarkDuration) {
+		t.Fatalf("expected ErrInvalidBenchmarkDuration, got %v", err)
+	}
+}
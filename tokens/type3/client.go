@@ -1,37 +1,356 @@
 package type3
 
 import (
+	"context"
 	"crypto"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"runtime"
+	"sync"
+	"time"
 
 	hpke "github.com/cisco/go-hpke"
 	"github.com/cloudflare/circl/blindsign"
-	"github.com/cloudflare/circl/blindsign/blindrsa"
 	"github.com/cloudflare/pat-go/ecdsa"
 	"github.com/cloudflare/pat-go/tokens"
+	"github.com/cloudflare/pat-go/util"
 	"golang.org/x/crypto/cryptobyte"
 )
 
 type RateLimitedClient struct {
-	curve     elliptic.Curve
-	secretKey *ecdsa.PrivateKey
+	curve       elliptic.Curve
+	secretKey   *ecdsa.PrivateKey
+	variant     BlindRSAVariant
+	saltLength  int
+	contextHash crypto.Hash
+
+	checkBlindSignature bool
+	originBoundContext  bool
+	redemptionContext   []byte
+	normalizeOrigin     OriginNormalizer
+	padOrigin           OriginPadder
+	clock               Clock
+	maxChallengeSkew    time.Duration
 }
 
-func NewRateLimitedClientFromSecret(secret []byte) RateLimitedClient {
-	curve := elliptic.P384()
+var (
+	ErrNoSecretKey              = errors.New("client has no secret key")
+	ErrConflictingContexts      = errors.New("origin-bound and redemption-bound contexts cannot be combined")
+	ErrRedemptionContextTooLong = errors.New("redemption context too long")
+	ErrInvalidClientKey         = errors.New("invalid client key")
+	ErrNilTokenKey              = errors.New("missing token key")
+	ErrZeroNameKey              = errors.New("missing name key")
+	ErrChallengeClockSkew       = errors.New("challenge expiry too far ahead of local clock")
+	ErrIndexMismatch            = errors.New("index does not match expected index")
+)
+
+// NewRateLimitedClientFromSecret returns a client for the big-endian client
+// secret scalar secret, which must be in [1, N-1] for the client's curve,
+// P-384. Secrets may come from untrusted storage or input, so invalid ones are
+// reported with ErrInvalidClientKey.
+func NewRateLimitedClientFromSecret(secret []byte) (RateLimitedClient, error) {
+	return NewRateLimitedClientFromSecretWithCurve(elliptic.P384(), secret)
+}
+
+// NewRateLimitedClientFromSecretWithCurve is NewRateLimitedClientFromSecret for
+// a client key on curve, which must be a curve supported by
+// RateLimitedParamsForCurve. Request keys and blinds are on the same curve, so
+// the issuer must be configured for it too (see
+// RateLimitedIssuer.SetRequestKeyCurve).
+func NewRateLimitedClientFromSecretWithCurve(curve elliptic.Curve, secret []byte) (RateLimitedClient, error) {
+	if err := checkRequestKeyCurve(curve); err != nil {
+		return RateLimitedClient{}, err
+	}
+	d := new(big.Int).SetBytes(secret)
+	if d.Sign() <= 0 || d.Cmp(curve.Params().N) >= 0 {
+		return RateLimitedClient{}, fmt.Errorf("%w: secret scalar out of range", ErrInvalidClientKey)
+	}
 	secretKey, err := ecdsa.CreateKey(curve, secret)
 	if err != nil {
-		panic(err)
+		return RateLimitedClient{}, err
+	}
+
+	return RateLimitedClient{
+		curve:       curve,
+		secretKey:   secretKey,
+		variant:     BlindRSAVariantPSS,
+		saltLength:  RateLimitedParams().SaltLength,
+		contextHash: RateLimitedParams().ContextHash,
+	}, nil
+}
+
+// NewRateLimitedClientFromKey returns a client for an existing client secret
+// key, e.g., one loaded from a keystore. The key must be on the client's curve,
+// P-384, and its public key must match its secret scalar. The client keeps a
+// copy of the key.
+func NewRateLimitedClientFromKey(key *ecdsa.PrivateKey) (RateLimitedClient, error) {
+	curve := elliptic.P384()
+	if key == nil || key.Curve == nil || key.D == nil {
+		return RateLimitedClient{}, fmt.Errorf("%w: missing key", ErrInvalidClientKey)
+	}
+	if key.Curve.Params().Name != curve.Params().Name {
+		return RateLimitedClient{}, fmt.Errorf("%w: curve %s, expected %s", ErrInvalidClientKey, key.Curve.Params().Name, curve.Params().Name)
+	}
+	if key.D.Sign() <= 0 || key.D.Cmp(curve.Params().N) >= 0 {
+		return RateLimitedClient{}, fmt.Errorf("%w: secret scalar out of range", ErrInvalidClientKey)
+	}
+
+	secretKey, err := ecdsa.CreateKey(curve, key.D.Bytes())
+	if err != nil {
+		return RateLimitedClient{}, err
+	}
+	if key.X == nil || key.Y == nil || key.X.Cmp(secretKey.X) != 0 || key.Y.Cmp(secretKey.Y) != 0 {
+		return RateLimitedClient{}, fmt.Errorf("%w: public key does not match secret scalar", ErrInvalidClientKey)
+	}
+
+	return RateLimitedClient{
+		curve:       curve,
+		secretKey:   secretKey,
+		variant:     BlindRSAVariantPSS,
+		saltLength:  RateLimitedParams().SaltLength,
+		contextHash: RateLimitedParams().ContextHash,
+	}, nil
+}
+
+// NewRateLimitedClientFromPublicKey returns a client for the compressed client
+// public key publicKeyEnc, whose secret key is held elsewhere. Such a client can
+// only create token requests via PrepareTokenRequest.
+func NewRateLimitedClientFromPublicKey(publicKeyEnc []byte) (RateLimitedClient, error) {
+	return NewRateLimitedClientFromPublicKeyWithCurve(elliptic.P384(), publicKeyEnc)
+}
+
+// NewRateLimitedClientFromPublicKeyWithCurve is NewRateLimitedClientFromPublicKey
+// for a client key on curve, which must be a curve supported by
+// RateLimitedParamsForCurve.
+func NewRateLimitedClientFromPublicKeyWithCurve(curve elliptic.Curve, publicKeyEnc []byte) (RateLimitedClient, error) {
+	if err := checkRequestKeyCurve(curve); err != nil {
+		return RateLimitedClient{}, err
+	}
+	publicKey, err := unmarshalPublicKey(curve, publicKeyEnc)
+	if err != nil {
+		return RateLimitedClient{}, err
 	}
 
 	return RateLimitedClient{
-		curve:     elliptic.P384(),
-		secretKey: secretKey,
+		curve:       curve,
+		secretKey:   &ecdsa.PrivateKey{PublicKey: *publicKey},
+		variant:     BlindRSAVariantPSS,
+		saltLength:  RateLimitedParams().SaltLength,
+		contextHash: RateLimitedParams().ContextHash,
+	}, nil
+}
+
+// WithSaltLength returns a copy of the client that blinds and verifies tokens
+// using a PSS salt of saltLength bytes. It must match the salt length the
+// issuer expects (see RateLimitedIssuer.SaltLength).
+func (c RateLimitedClient) WithSaltLength(saltLength int) RateLimitedClient {
+	c.saltLength = saltLength
+	return c
+}
+
+// WithBlindRSAVariant returns a copy of the client that blinds and verifies
+// tokens using the given blind RSA variant. It must match the variant the
+// issuer's signer is used with (see RateLimitedIssuer.BlindRSAVariant),
+// otherwise FinalizeToken fails with ErrBlindRSAVariantMismatch.
+func (c RateLimitedClient) WithBlindRSAVariant(variant BlindRSAVariant) RateLimitedClient {
+	c.variant = variant
+	return c
+}
+
+// WithContextHash returns a copy of the client that derives token contexts
+// from challenges with hash instead of SHA-256, for token type variants that
+// use a different context hash. The hash must produce 32-byte digests, and
+// origins must verify tokens with the same hash (see
+// ProtocolParams.TokenMatchesChallenge). Origin-bound contexts always use
+// SHA-256.
+func (c RateLimitedClient) WithContextHash(hash crypto.Hash) RateLimitedClient {
+	c.contextHash = hash
+	return c
+}
+
+// WithBlindSignatureCheck returns a copy of the client whose request states
+// check, before unblinding, that the blind signature in a response signs the
+// blinded message that was sent. FinalizeToken already rejects such responses
+// when unblinding, but only this check attributes the failure to the response
+// (ErrBlindUnblindMismatch) rather than the client's own state, e.g., to catch
+// a buggy or malicious attester. It costs one extra RSA public key operation
+// per token, roughly doubling the verification work in FinalizeToken.
+func (c RateLimitedClient) WithBlindSignatureCheck(enabled bool) RateLimitedClient {
+	c.checkBlindSignature = enabled
+	return c
+}
+
+// WithOriginBoundContext returns a copy of the client that binds tokens to the
+// origin they are requested for: the token context is OriginBoundContext of the
+// challenge and origin name instead of the SHA-256 digest of the challenge, so
+// an origin can check with TokenMatchesOrigin that a token was minted for it.
+//
+// This changes the token format and must only be used with origins that
+// expect origin-bound contexts. The issuer learns nothing new, as it already
+// decrypts the origin name and never sees the context. The origin, however,
+// learns that the client requested the token specifically for it, rather than
+// holding a token that could have been redeemed at any origin sharing the
+// challenge.
+func (c RateLimitedClient) WithOriginBoundContext(enabled bool) RateLimitedClient {
+	c.originBoundContext = enabled
+	return c
+}
+
+// WithRedemptionContext returns a copy of the client that binds tokens to a
+// redemption context: the token context is RedemptionBoundContext of the
+// challenge and redemptionContext instead of the digest of the challenge, so
+// an origin can check with TokenMatchesRedemptionContext that a token was
+// requested for, e.g., a particular session. A nil or empty redemptionContext
+// restores the default context. The redemption context is hashed into the
+// blinded token input, so the issuer never learns it. It cannot be combined
+// with origin-bound contexts, and is at most 65535 bytes.
+func (c RateLimitedClient) WithRedemptionContext(redemptionContext []byte) RateLimitedClient {
+	c.redemptionContext = append([]byte(nil), redemptionContext...)
+	return c
+}
+
+// WithOriginNormalizer returns a copy of the client that normalizes origin
+// names with normalize before encrypting them, and before deriving
+// origin-bound contexts. It must agree with the issuer's normalizer (see
+// RateLimitedIssuer.SetOriginNormalizer), otherwise the issuer looks the
+// origin up under a different name and rejects the request.
+func (c RateLimitedClient) WithOriginNormalizer(normalize OriginNormalizer) RateLimitedClient {
+	c.normalizeOrigin = normalize
+	return c
+}
+
+// OriginPadder pads an origin name before it is encrypted in the origin token
+// request.
+type OriginPadder func(originName string) []byte
+
+// WithOriginPadder returns a copy of the client that pads origin names with pad
+// instead of the standard zero padding, which rounds the name up to a multiple
+// of 32 bytes. A nil padder restores the standard padding.
+//
+// Only the standard padding is interoperable. Issuers strip trailing zero
+// bytes and reject requests with ErrMalformedPadding if the wrong number was
+// stripped; any other padding remains part of the origin name, which then
+// typically fails with ErrUnknownOrigin. This exists so that conformance tests
+// and test vectors can exercise the issuer's handling of non-standard padding.
+func (c RateLimitedClient) WithOriginPadder(pad OriginPadder) RateLimitedClient {
+	c.padOrigin = pad
+	return c
+}
+
+// Clock returns the current time.
+type Clock func() time.Time
+
+// WithClock returns a copy of the client that reads the current time from
+// clock instead of time.Now when checking challenge expiry, e.g., to use a
+// time source synchronized with the origin's, or a fixed one in tests.
+func (c RateLimitedClient) WithClock(clock Clock) RateLimitedClient {
+	c.clock = clock
+	return c
+}
+
+// WithMaxChallengeSkew returns a copy of the client that refuses challenges
+// whose expiry (see tokens.NewExpiringRedemptionNonce) lies more than maxSkew
+// after the current time, failing with ErrChallengeClockSkew. Challenges only
+// carry their expiry, so maxSkew should be the origin's challenge lifetime
+// plus the tolerated clock difference: a challenge expiring later was either
+// minted by an origin whose clock runs ahead of the client's, or replayed from
+// a time when the client's clock was set further back. A clock running behind
+// the origin's is already caught as an expired challenge. The check is only as
+// good as the client's clock, so set one with WithClock where time.Now is not
+// trusted. Zero disables the check, as do challenges without an expiry.
+func (c RateLimitedClient) WithMaxChallengeSkew(maxSkew time.Duration) RateLimitedClient {
+	c.maxChallengeSkew = maxSkew
+	return c
+}
+
+func (c RateLimitedClient) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock()
+}
+
+// checkChallengeTime checks the expiry of challenges that are TokenChallenge
+// encodings against the client's clock. Other challenges carry no expiry.
+func (c RateLimitedClient) checkChallengeTime(challenge []byte) error {
+	tokenChallenge, err := tokens.UnmarshalTokenChallenge(challenge)
+	if err != nil {
+		return nil
+	}
+	now := c.now()
+	if err := tokenChallenge.CheckFreshness(now); err != nil {
+		return err
+	}
+	if expiry, ok := tokenChallenge.Expiry(); ok && c.maxChallengeSkew > 0 {
+		if ahead := expiry.Sub(now); ahead > c.maxChallengeSkew {
+			return fmt.Errorf("%w: expires in %v, at most %v allowed", ErrChallengeClockSkew, ahead, c.maxChallengeSkew)
+		}
+	}
+	return nil
+}
+
+// PredictIndex computes the anonymous issuer origin ID (index) that the attester
+// will derive via FinalizeIndex for requests from this client to the origin
+// whose public index key is originIndexPublicKeyEnc (see
+// RateLimitedIssuer.OriginIndexPublicKey). The client must know this public
+// index key; it is not part of the standard issuer configuration. The index does
+// not depend on the per-request blind, which is only checked for validity.
+func (c RateLimitedClient) PredictIndex(blindEnc, originIndexPublicKeyEnc []byte) ([]byte, error) {
+	return c.PredictEpochIndex(blindEnc, originIndexPublicKeyEnc, 0)
+}
+
+// AnonymousOriginID is PredictIndex for an origin index public key given as a
+// key rather than in its compressed encoding. It computes the index, also
+// known as the anonymous issuer origin ID, that the attester derives for this
+// client and origin, e.g., so that clients can tell when they are throttled.
+// It requires the origin's public index key, which is not part of the
+// standard issuer configuration and must be distributed separately.
+func (c RateLimitedClient) AnonymousOriginID(blindKeyEnc []byte, originIndexPublicKey *ecdsa.PublicKey) ([]byte, error) {
+	if originIndexPublicKey == nil || originIndexPublicKey.X == nil || originIndexPublicKey.Y == nil {
+		return nil, fmt.Errorf("missing origin index public key")
+	}
+	if originIndexPublicKey.Curve != c.curve {
+		return nil, fmt.Errorf("%w: origin index key is not on the client curve", ErrUnsupportedCurve)
+	}
+	originIndexPublicKeyEnc := elliptic.MarshalCompressed(c.curve, originIndexPublicKey.X, originIndexPublicKey.Y)
+	return c.PredictIndex(blindKeyEnc, originIndexPublicKeyEnc)
+}
+
+// PredictEpochIndex is PredictIndex for an attester in the given index epoch
+// (see RateLimitedAttester.RotateIndexEpoch).
+func (c RateLimitedClient) PredictEpochIndex(blindEnc, originIndexPublicKeyEnc []byte, epoch uint64) ([]byte, error) {
+	if c.secretKey.D == nil {
+		return nil, ErrNoSecretKey
+	}
+	blindKey, err := ecdsa.CreateKey(c.curve, blindEnc)
+	if err != nil {
+		return nil, err
+	}
+	if blindKey.D.Sign() == 0 || blindKey.D.Cmp(c.curve.Params().N) >= 0 {
+		return nil, fmt.Errorf("invalid blind")
+	}
+
+	originIndexPublicKey, err := unmarshalPublicKey(c.curve, originIndexPublicKeyEnc)
+	if err != nil {
+		return nil, err
 	}
+
+	scalarLen := (c.curve.Params().Params().BitSize + 7) / 8
+	secretKeyEnc := make([]byte, scalarLen)
+	c.secretKey.D.FillBytes(secretKeyEnc)
+	x, y := c.curve.ScalarMult(originIndexPublicKey.X, originIndexPublicKey.Y, secretKeyEnc)
+	indexKeyEnc := elliptic.MarshalCompressed(c.curve, x, y)
+
+	clientKeyEnc := elliptic.MarshalCompressed(c.curve, c.secretKey.PublicKey.X, c.secretKey.PublicKey.Y)
+	return computeEpochIndex(clientKeyEnc, indexKeyEnc, epoch)
 }
 
 func padOriginName(originName string) []byte {
@@ -55,15 +374,51 @@ func unpadOriginName(paddedOriginName []byte) string {
 	return string(paddedOriginName[0 : lastNonZero+1])
 }
 
-// https://ietf-wg-privacypass.github.io/draft-ietf-privacypass-rate-limit-tokens/draft-ietf-privacypass-rate-limit-tokens.html#name-encrypting-origin-token-req
-func encryptOriginTokenRequest(nameKey EncapKey, tokenKeyID uint8, blindedMessage []byte, requestKey []byte, originName string) ([]byte, []byte, []byte, error) {
-	issuerKeyEnc := nameKey.Marshal()
-	issuerKeyID := sha256.Sum256(issuerKeyEnc)
+var (
+	ErrOriginNameTooLong = errors.New("origin name too long")
+	ErrMalformedPadding  = errors.New("malformed origin name padding")
+)
 
-	enc, context, err := hpke.SetupBaseS(nameKey.suite, rand.Reader, nameKey.publicKey, []byte("TokenRequest"))
-	if err != nil {
-		return nil, nil, nil, err
+// validatePadding checks that paddedOrigin is padded as padOriginName does:
+// the origin name followed by the zero bytes that round its length up to a
+// multiple of 32, or 32 zero bytes for the empty name.
+func validatePadding(paddedOrigin []byte) error {
+	originNameLen := len(unpadOriginName(paddedOrigin))
+	if len(paddedOrigin) != paddedOriginNameLen(originNameLen) {
+		return fmt.Errorf("%w: %d bytes for a %d byte origin name", ErrMalformedPadding, len(paddedOrigin), originNameLen)
 	}
+	return nil
+}
+
+// Size of the authentication tag of every HPKE AEAD that supports encryption
+const hpkeAEADTagSize = 16
+
+func paddedOriginNameLen(originNameLen int) int {
+	return originNameLen + 31 - ((originNameLen - 1) % 32)
+}
+
+// checkOriginNameLength verifies that the padded origin name, and the
+// encrypted token request carrying it, fit in their 16-bit length prefixes.
+func checkOriginNameLength(suite hpke.CipherSuite, blindedMessageLen int, originName string) error {
+	return checkPaddedOriginNameLength(suite, blindedMessageLen, originName, paddedOriginNameLen(len(originName)))
+}
+
+// checkPaddedOriginNameLength is checkOriginNameLength for an origin name
+// padded to paddedLen bytes.
+func checkPaddedOriginNameLength(suite hpke.CipherSuite, blindedMessageLen int, originName string, paddedLen int) error {
+	innerLen := 1 + blindedMessageLen + 2 + paddedLen
+	encryptedLen := suite.KEM.PublicKeySize() + innerLen + hpkeAEADTagSize
+	if paddedLen > 0xFFFF || encryptedLen > 0xFFFF {
+		return fmt.Errorf("%w: %d bytes", ErrOriginNameTooLong, len(originName))
+	}
+	return nil
+}
+
+// https://ietf-wg-privacypass.github.io/draft-ietf-privacypass-rate-limit-tokens/draft-ietf-privacypass-rate-limit-tokens.html#name-encrypting-origin-token-req
+// originTokenRequestAAD returns the additional data the origin token request
+// is encrypted with, binding it to the name key and request key.
+func originTokenRequestAAD(nameKey EncapKey, requestKey []byte) []byte {
+	issuerKeyID := sha256.Sum256(nameKey.Marshal())
 
 	b := cryptobyte.NewBuilder(nil)
 	b.AddUint8(nameKey.id)
@@ -73,15 +428,36 @@ func encryptOriginTokenRequest(nameKey EncapKey, tokenKeyID uint8, blindedMessag
 	b.AddUint16(RateLimitedTokenType)
 	b.AddBytes(requestKey)
 	b.AddBytes(issuerKeyID[:])
+	return b.BytesOrPanic()
+}
+
+// encryptOriginTokenRequest pads the origin name with pad, or with the
+// standard zero padding if pad is nil, and encrypts the origin token request.
+func encryptOriginTokenRequest(rng io.Reader, nameKey EncapKey, tokenKeyID uint8, blindedMessage []byte, requestKey []byte, originName string, pad OriginPadder) ([]byte, []byte, []byte, error) {
+	if pad == nil {
+		pad = padOriginName
+	}
+	paddedOrigin := pad(originName)
+	if err := checkPaddedOriginNameLength(nameKey.suite, len(blindedMessage), originName, len(paddedOrigin)); err != nil {
+		return nil, nil, nil, err
+	}
+
+	issuerKeyEnc := nameKey.Marshal()
+	issuerKeyID := sha256.Sum256(issuerKeyEnc)
+
+	enc, context, err := hpke.SetupBaseS(nameKey.suite, rng, nameKey.publicKey, []byte("TokenRequest"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
 	tokenRequest := InnerTokenRequest{
 		blindedMsg:   blindedMessage,
 		tokenKeyId:   tokenKeyID,
-		paddedOrigin: padOriginName(originName),
+		paddedOrigin: paddedOrigin,
 	}
 	input := tokenRequest.Marshal()
 
-	aad := b.BytesOrPanic()
+	aad := originTokenRequestAAD(nameKey, requestKey)
 
 	ct := context.Seal(aad, input)
 	encryptedTokenRequest := append(enc, ct...)
@@ -100,6 +476,18 @@ type RateLimitedTokenRequestState struct {
 	nameKey           EncapKey
 	verificationKey   *rsa.PublicKey
 	verifier          blindsign.VerifierState
+	variant           BlindRSAVariant
+	saltLength        int
+
+	blindedMessage      []byte
+	checkBlindSignature bool
+
+	blind []byte
+
+	// Inputs for re-encrypting the request (see ReEncryptForNameKey)
+	client     RateLimitedClient
+	tokenKeyID []byte
+	originName string
 }
 
 func (s RateLimitedTokenRequestState) Request() *RateLimitedTokenRequest {
@@ -114,13 +502,41 @@ func (s RateLimitedTokenRequestState) ClientKey() []byte {
 	return s.clientKey
 }
 
+// Blind returns the blind the request was created with, which the attester
+// needs along with ClientKey to verify the request and compute its index (see
+// RateLimitedAttester.FinalizeIndex). The blind must only be shared with the
+// attester.
+func (s RateLimitedTokenRequestState) Blind() []byte {
+	return append([]byte{}, s.blind...)
+}
+
+var (
+	ErrInvalidResponse      = errors.New("invalid token response")
+	ErrBlindUnblindMismatch = errors.New("blind signature does not match the blinded message")
+)
+
+// FinalizeToken decrypts the issuer's response and unblinds the signature.
+//
+// The response encryption key is derived from the HPKE exporter secret of the
+// context set up with the issuer's name key, so only the holder of the name
+// private key (which recovers the same secret when decrypting the request) can
+// produce a response that passes the AEAD Open step. Responses forged without
+// that secret are rejected with ErrInvalidResponse before any unblinding.
+//
+// If the client was configured WithBlindSignatureCheck, a blind signature that
+// does not sign the blinded message is rejected with ErrBlindUnblindMismatch
+// before unblinding.
+//
 // https://ietf-wg-privacypass.github.io/draft-ietf-privacypass-rate-limit-tokens/draft-ietf-privacypass-rate-limit-tokens.html#name-attester-to-client-response
 func (s RateLimitedTokenRequestState) FinalizeToken(encryptedtokenResponse []byte) (tokens.Token, error) {
 	// response_nonce = random(max(Nn, Nk)), taken from the encapsualted response
 	responseNonceLen := max(s.nameKey.suite.AEAD.KeySize(), s.nameKey.suite.AEAD.NonceSize())
+	if len(encryptedtokenResponse) < responseNonceLen {
+		return tokens.Token{}, ErrInvalidResponse
+	}
 
 	// salt = concat(enc, response_nonce)
-	salt := append(s.encapEnc, encryptedtokenResponse[:responseNonceLen]...)
+	salt := responseSalt(s.encapEnc, encryptedtokenResponse[:responseNonceLen])
 
 	// prk = Extract(salt, secret)
 	prk := s.nameKey.suite.KDF.Extract(salt, s.encapSecret)
@@ -139,7 +555,13 @@ func (s RateLimitedTokenRequestState) FinalizeToken(encryptedtokenResponse []byt
 	// reponse, error = Open(aead_key, aead_nonce, "", ct)
 	blindSignature, err := cipher.Open(nil, nonce, encryptedtokenResponse[responseNonceLen:], nil)
 	if err != nil {
-		return tokens.Token{}, err
+		return tokens.Token{}, ErrInvalidResponse
+	}
+
+	if s.checkBlindSignature {
+		if err := checkBlindSignature(s.verificationKey, s.blindedMessage, blindSignature); err != nil {
+			return tokens.Token{}, err
+		}
 	}
 
 	signature, err := s.verifier.Finalize(blindSignature)
@@ -147,74 +569,229 @@ func (s RateLimitedTokenRequestState) FinalizeToken(encryptedtokenResponse []byt
 		return tokens.Token{}, err
 	}
 
-	tokenData := append(s.tokenInput, signature...)
+	// Copy the token input, which request states may share
+	tokenData := make([]byte, 0, len(s.tokenInput)+len(signature))
+	tokenData = append(append(tokenData, s.tokenInput...), signature...)
 	token, err := UnmarshalToken(tokenData)
 	if err != nil {
 		return tokens.Token{}, err
 	}
 
 	// Sanity check: verify the token signature
-	hash := sha512.New384()
-	_, err = hash.Write(token.AuthenticatorInput())
+	// The unblinded signature was already checked against the encoded message,
+	// so a failure here means the message was encoded for a different variant.
+	err = verifyToken(s.verificationKey, s.variant, s.saltLength, token)
 	if err != nil {
-		return tokens.Token{}, err
+		return tokens.Token{}, fmt.Errorf("%w: %v", ErrBlindRSAVariantMismatch, err)
 	}
-	digest := hash.Sum(nil)
 
-	err = rsa.VerifyPSS(s.verificationKey, crypto.SHA384, digest, token.Authenticator, &rsa.PSSOptions{
-		Hash:       crypto.SHA384,
-		SaltLength: crypto.SHA384.Size(),
-	})
-	if err != nil {
+	return token, nil
+}
+
+// FinalizeTokenContext behaves like FinalizeToken, but fails with ctx.Err() if
+// ctx is already done.
+func (s RateLimitedTokenRequestState) FinalizeTokenContext(ctx context.Context, encryptedtokenResponse []byte) (tokens.Token, error) {
+	if err := ctx.Err(); err != nil {
 		return tokens.Token{}, err
 	}
+	return s.FinalizeToken(encryptedtokenResponse)
+}
 
-	return token, nil
+var (
+	ErrResponseCountMismatch = errors.New("number of responses does not match number of request states")
+)
+
+// FailureBundle holds the non-secret inputs of a failed FinalizeToken call, for
+// sharing with an interop partner. It contains no HPKE secret, blind, or
+// private key: the response can only be decrypted again by the issuer, which
+// recovers the response secret from Request with its name key.
+type FailureBundle struct {
+	TokenInput []byte // Token input that was blinded
+	EncapEnc   []byte // HPKE encapsulated key of the request
+	Request    []byte // Encoded token request
+	Response   []byte // Encrypted token response
+	TokenKeyID []byte // ID of the token key the token was verified against
+	Variant    BlindRSAVariant
+	SaltLength int
 }
 
-// https://ietf-wg-privacypass.github.io/draft-ietf-privacypass-rate-limit-tokens/draft-ietf-privacypass-rate-limit-tokens.html#name-client-to-attester-request
-func (c RateLimitedClient) CreateTokenRequest(challenge, nonce, blindKeyEnc []byte, tokenKeyID []byte, tokenKey *rsa.PublicKey, originName string, nameKey EncapKey) (RateLimitedTokenRequestState, error) {
+// FinalizeTokenWithBundle is FinalizeToken, but returns a FailureBundle with the
+// inputs needed to reproduce a failure alongside the error. The bundle is nil
+// on success.
+func (s RateLimitedTokenRequestState) FinalizeTokenWithBundle(encryptedtokenResponse []byte) (tokens.Token, *FailureBundle, error) {
+	request := s.request.Marshal()
+	encapEnc := append([]byte{}, s.encapEnc...)
+
+	token, err := s.FinalizeToken(encryptedtokenResponse)
+	if err == nil {
+		return token, nil, nil
+	}
+
+	var tokenKeyID []byte
+	if tokenKeyEnc, keyErr := util.MarshalTokenKeyPSSOID(s.verificationKey); keyErr == nil {
+		keyID := sha256.Sum256(tokenKeyEnc)
+		tokenKeyID = keyID[:]
+	}
+
+	return tokens.Token{}, &FailureBundle{
+		TokenInput: append([]byte{}, s.tokenInput...),
+		EncapEnc:   encapEnc,
+		Request:    request,
+		Response:   append([]byte{}, encryptedtokenResponse...),
+		TokenKeyID: tokenKeyID,
+		Variant:    s.variant,
+		SaltLength: s.saltLength,
+	}, err
+}
+
+// FinalizeTokens finalizes each request state with the response at the same
+// index, using up to workers goroutines (runtime.NumCPU() if workers is not
+// positive). Finalization is dominated by RSA operations, so a burst of
+// responses finalizes up to workers times faster than sequentially. Each state
+// is finalized exactly once, and tokens[i] and errs[i] hold the result for
+// states[i].
+func FinalizeTokens(states []RateLimitedTokenRequestState, responses [][]byte, workers int) ([]tokens.Token, []error) {
+	finalizedTokens := make([]tokens.Token, len(states))
+	errs := make([]error, len(states))
+	if len(responses) != len(states) {
+		for i := range errs {
+			errs[i] = ErrResponseCountMismatch
+		}
+		return finalizedTokens, errs
+	}
+
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(states) {
+		workers = len(states)
+	}
+
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				finalizedTokens[i], errs[i] = states[i].FinalizeToken(responses[i])
+			}
+		}()
+	}
+	for i := range states {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	return finalizedTokens, errs
+}
+
+// blindedTokenRequest holds the parts of a token request that do not depend on
+// the origin: the request key, the token input, and its blinded message.
+type blindedTokenRequest struct {
+	blindKeyEnc    []byte
+	blindKey       *ecdsa.PrivateKey
+	clientKeyEnc   []byte
+	requestKeyEnc  []byte
+	tokenInput     []byte
+	blindedMessage []byte
+	verifierState  blindsign.VerifierState
+	variant        BlindRSAVariant
+	saltLength     int
+}
+
+func (c RateLimitedClient) blindTokenRequest(rng io.Reader, challenge, nonce, blindKeyEnc []byte, tokenKeyID []byte, tokenKey *rsa.PublicKey, originName string) (blindedTokenRequest, error) {
+	if err := c.checkChallengeTime(challenge); err != nil {
+		return blindedTokenRequest{}, err
+	}
+
 	blindKey, err := ecdsa.CreateKey(c.curve, blindKeyEnc)
 	if err != nil {
-		return RateLimitedTokenRequestState{}, err
+		return blindedTokenRequest{}, err
 	}
 
 	clientKeyEnc := elliptic.MarshalCompressed(c.curve, c.secretKey.PublicKey.X, c.secretKey.PublicKey.Y)
 
-	b := cryptobyte.NewBuilder(nil)
-	b.AddUint16(RateLimitedTokenType)
-	b.AddBytes([]byte("ClientBlind"))
-	ctx := b.BytesOrPanic()
-	blindedPublicKey, err := ecdsa.BlindPublicKeyWithContext(c.curve, &c.secretKey.PublicKey, blindKey, ctx)
+	blindedPublicKey, err := ecdsa.BlindPublicKeyWithContext(c.curve, &c.secretKey.PublicKey, blindKey, blindContext(labelClientBlind))
 	if err != nil {
-		return RateLimitedTokenRequestState{}, err
+		return blindedTokenRequest{}, err
 	}
 	blindedPublicKeyEnc := elliptic.MarshalCompressed(c.curve, blindedPublicKey.X, blindedPublicKey.Y)
 
-	verifier := blindrsa.NewRSAVerifier(tokenKey, crypto.SHA384)
-
-	context := sha256.Sum256(challenge)
+	context, err := contextDigest(c.contextHash, challenge)
+	if err != nil {
+		return blindedTokenRequest{}, err
+	}
+	if c.originBoundContext && len(c.redemptionContext) > 0 {
+		return blindedTokenRequest{}, ErrConflictingContexts
+	}
+	if c.originBoundContext {
+		context = OriginBoundContext(challenge, originName)
+	}
+	if len(c.redemptionContext) > 0 {
+		if len(c.redemptionContext) > 0xffff {
+			return blindedTokenRequest{}, ErrRedemptionContextTooLong
+		}
+		context = RedemptionBoundContext(challenge, c.redemptionContext)
+	}
 	token := tokens.Token{
 		TokenType:     RateLimitedTokenType,
 		Nonce:         nonce,
-		Context:       context[:],
+		Context:       context,
 		KeyID:         tokenKeyID,
 		Authenticator: nil, // No signature computed yet
 	}
 	tokenInput := token.AuthenticatorInput()
-	blindedMessage, verifierState, err := verifier.Blind(rand.Reader, tokenInput)
+	blindedMessage, verifierState, err := blindTokenInput(rng, tokenKey, c.variant, c.saltLength, tokenInput)
 	if err != nil {
-		return RateLimitedTokenRequestState{}, err
+		return blindedTokenRequest{}, err
+	}
+
+	return blindedTokenRequest{
+		blindKeyEnc:    append([]byte{}, blindKeyEnc...),
+		blindKey:       blindKey,
+		clientKeyEnc:   clientKeyEnc,
+		requestKeyEnc:  blindedPublicKeyEnc,
+		tokenInput:     tokenInput,
+		blindedMessage: blindedMessage,
+		verifierState:  verifierState,
+		variant:        c.variant,
+		saltLength:     c.saltLength,
+	}, nil
+}
+
+// checkRequestKeys rejects truncated token key IDs and missing issuer keys up
+// front, which would otherwise cause panics deep inside blinding or encryption.
+func checkRequestKeys(tokenKeyID []byte, tokenKey *rsa.PublicKey, nameKey EncapKey) error {
+	if _, err := WireKeyID(tokenKeyID); err != nil {
+		return err
+	}
+	if tokenKey == nil || tokenKey.N == nil || tokenKey.N.Sign() == 0 {
+		return ErrNilTokenKey
+	}
+	if nameKey.publicKey == nil || nameKey.suite.KEM == nil || nameKey.suite.KDF == nil || nameKey.suite.AEAD == nil {
+		return ErrZeroNameKey
 	}
+	return nil
+}
 
-	nameKeyID, encryptedTokenRequest, secret, err := encryptOriginTokenRequest(nameKey, tokenKeyID[0], blindedMessage, blindedPublicKeyEnc, originName)
+// prepareTokenRequest encrypts the origin token request and returns the request
+// state without a request signature, along with the digest to be signed by the
+// blinded request key.
+func (c RateLimitedClient) prepareTokenRequest(rng io.Reader, blinded blindedTokenRequest, tokenKeyID []byte, tokenKey *rsa.PublicKey, originName string, nameKey EncapKey) (RateLimitedTokenRequestState, []byte, error) {
+	wireKeyID, err := WireKeyID(tokenKeyID)
 	if err != nil {
-		return RateLimitedTokenRequestState{}, err
+		return RateLimitedTokenRequestState{}, nil, err
+	}
+	nameKeyID, encryptedTokenRequest, secret, err := encryptOriginTokenRequest(rng, nameKey, wireKeyID, blinded.blindedMessage, blinded.requestKeyEnc, originName, c.padOrigin)
+	if err != nil {
+		return RateLimitedTokenRequestState{}, nil, err
 	}
 
-	b = cryptobyte.NewBuilder(nil)
+	b := cryptobyte.NewBuilder(nil)
 	b.AddUint16(RateLimitedTokenType)
-	b.AddBytes(blindedPublicKeyEnc)
+	b.AddBytes(blinded.requestKeyEnc)
 	b.AddBytes(nameKeyID)
 	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 		b.AddBytes(encryptedTokenRequest)
@@ -225,34 +802,340 @@ func (c RateLimitedClient) CreateTokenRequest(challenge, nonce, blindKeyEnc []by
 	hash.Write(message)
 	digest := hash.Sum(nil)
 
-	r, s, err := ecdsa.BlindKeySignWithContext(rand.Reader, c.secretKey, blindKey, digest, ctx)
-	if err != nil {
-		return RateLimitedTokenRequestState{}, err
-	}
-	scalarLen := (c.curve.Params().Params().BitSize + 7) / 8
-	rEnc := make([]byte, scalarLen)
-	sEnc := make([]byte, scalarLen)
-	r.FillBytes(rEnc)
-	s.FillBytes(sEnc)
-	signature := append(rEnc, sEnc...)
-
 	request := &RateLimitedTokenRequest{
-		RequestKey:            blindedPublicKeyEnc,
+		RequestKey:            blinded.requestKeyEnc,
 		NameKeyID:             nameKeyID,
 		EncryptedTokenRequest: encryptedTokenRequest,
-		Signature:             signature,
 	}
 
 	requestState := RateLimitedTokenRequestState{
-		tokenInput:      tokenInput,
-		clientKey:       clientKeyEnc,
+		tokenInput:      blinded.tokenInput,
+		clientKey:       blinded.clientKeyEnc,
 		request:         request,
 		encapSecret:     secret,
-		encapEnc:        encryptedTokenRequest[0:nameKey.suite.KEM.PublicKeySize()],
+		encapEnc:        append([]byte{}, encryptedTokenRequest[0:nameKey.suite.KEM.PublicKeySize()]...),
 		nameKey:         nameKey,
-		verifier:        verifierState,
+		verifier:        blinded.verifierState,
 		verificationKey: tokenKey,
+		variant:         blinded.variant,
+		saltLength:      blinded.saltLength,
+
+		blindedMessage:      blinded.blindedMessage,
+		checkBlindSignature: c.checkBlindSignature,
+
+		blind: blinded.blindKeyEnc,
+
+		client:     c,
+		tokenKeyID: tokenKeyID,
+		originName: originName,
+	}
+
+	return requestState, digest, nil
+}
+
+// repeatingReader yields its bytes over and over, so that what a reader reads
+// does not depend on how much was read before.
+type repeatingReader []byte
+
+func (r repeatingReader) Read(p []byte) (int, error) {
+	for n := 0; n < len(p); {
+		n += copy(p[n:], r)
+	}
+	return len(p), nil
+}
+
+func encodeRequestSignature(curve elliptic.Curve, r, s *big.Int) []byte {
+	scalarLen := (curve.Params().Params().BitSize + 7) / 8
+	rEnc := make([]byte, scalarLen)
+	sEnc := make([]byte, scalarLen)
+	r.FillBytes(rEnc)
+	s.FillBytes(sEnc)
+	return append(rEnc, sEnc...)
+}
+
+func (c RateLimitedClient) encryptTokenRequest(rng io.Reader, blinded blindedTokenRequest, tokenKeyID []byte, tokenKey *rsa.PublicKey, originName string, nameKey EncapKey) (RateLimitedTokenRequestState, error) {
+	if c.secretKey.D == nil {
+		return RateLimitedTokenRequestState{}, ErrNoSecretKey
+	}
+
+	requestState, digest, err := c.prepareTokenRequest(rng, blinded, tokenKeyID, tokenKey, originName, nameKey)
+	if err != nil {
+		return RateLimitedTokenRequestState{}, err
+	}
+
+	// The ECDSA signer may or may not consume a byte before reading its entropy
+	// (see ecdsa.MaybeReadByte), so it gets entropy read here, repeated, to
+	// keep signatures reproducible from a seeded rng
+	entropy := make([]byte, 32)
+	if _, err := io.ReadFull(rng, entropy); err != nil {
+		return RateLimitedTokenRequestState{}, err
+	}
+	r, s, err := ecdsa.BlindKeySignWithContext(repeatingReader(entropy), c.secretKey, blinded.blindKey, digest, blindContext(labelClientBlind))
+	if err != nil {
+		return RateLimitedTokenRequestState{}, err
+	}
+	requestState.request.Signature = encodeRequestSignature(c.curve, r, s)
+
+	return requestState, nil
+}
+
+// VerifyIndex checks that the blinded request key the issuer returned for this
+// request maps the client to expectedIndex, e.g., the index PredictIndex
+// computed from the origin's public index key. It unblinds the key with
+// blindEnc, the blind used for the request, and derives the index from the
+// client's own public key as the attester's FinalizeIndex does in index epoch
+// 0, comparing in constant time. A mismatch fails with ErrIndexMismatch and
+// means the issuer did not use the origin's index key, so the attester would
+// count the request against a different index than the client expects.
+func (s RateLimitedTokenRequestState) VerifyIndex(blindEnc, blindedRequestKeyEnc, expectedIndex []byte) error {
+	indexKeyEnc, err := unblindIndexKey(s.client.curve, blindEnc, blindedRequestKeyEnc)
+	if err != nil {
+		return err
+	}
+	index, err := computeEpochIndex(s.clientKey, indexKeyEnc, 0)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrIndexKDF, err)
+	}
+	if subtle.ConstantTimeCompare(index, expectedIndex) != 1 {
+		return ErrIndexMismatch
+	}
+	return nil
+}
+
+// ReEncryptForNameKey encrypts the request again to newNameKey and signs it,
+// e.g., when the issuer rotated its name key while the request was in flight.
+// The blinded message, and thus the resulting token, is unchanged, so the
+// blind RSA step is not redone. The state is updated in place to finalize
+// responses to the new request; responses to the old request can no longer be
+// finalized. Requests from PrepareTokenRequest cannot be re-signed here and
+// fail with ErrNoSecretKey.
+func (s *RateLimitedTokenRequestState) ReEncryptForNameKey(newNameKey EncapKey) (*RateLimitedTokenRequest, error) {
+	c := s.client
+	if c.secretKey == nil || c.secretKey.D == nil {
+		return nil, ErrNoSecretKey
+	}
+	if err := checkRequestKeys(s.tokenKeyID, s.verificationKey, newNameKey); err != nil {
+		return nil, err
+	}
+
+	blindKey, err := ecdsa.CreateKey(c.curve, s.blind)
+	if err != nil {
+		return nil, err
+	}
+	blinded := blindedTokenRequest{
+		blindKeyEnc:    s.blind,
+		blindKey:       blindKey,
+		clientKeyEnc:   s.clientKey,
+		requestKeyEnc:  s.request.RequestKey,
+		tokenInput:     s.tokenInput,
+		blindedMessage: s.blindedMessage,
+		verifierState:  s.verifier,
+		variant:        s.variant,
+		saltLength:     s.saltLength,
+	}
+
+	requestState, err := c.encryptTokenRequest(rand.Reader, blinded, s.tokenKeyID, s.verificationKey, s.originName, newNameKey)
+	if err != nil {
+		return nil, err
+	}
+	*s = requestState
+	return s.request, nil
+}
+
+// PreparedTokenRequest is a token request awaiting its request signature, for
+// clients whose secret key is held by an external signer such as an HSM. See
+// PrepareTokenRequest.
+type PreparedTokenRequest struct {
+	curve       elliptic.Curve
+	state       RateLimitedTokenRequestState
+	blindScalar *big.Int
+	digest      []byte
+}
+
+// PrepareTokenRequest is the first half of CreateTokenRequest for clients
+// whose secret key is held by an external signer: it builds the request without
+// signing it. Only the client public key is needed (see
+// NewRateLimitedClientFromPublicKey). Pass Digest to the signer and the
+// resulting signature to AttachSignature.
+//
+// The request must be signed with the blinded request key sk*b, where b is
+// derived from the blind and the ClientBlind context, rather than with the
+// client secret key sk itself. The blind is secret, stays with the client, and
+// never reaches the signer. Instead, Digest returns the request digest
+// multiplied by b^-1 mod n, so that a plain ECDSA signature (r, s') by sk over
+// it yields the signature (r, b*s') by sk*b over the real digest, which
+// AttachSignature computes. The signer must therefore sign the digest as is
+// (e.g., CKM_ECDSA in PKCS #11) without hashing it again.
+func (c RateLimitedClient) PrepareTokenRequest(challenge, nonce, blindKeyEnc []byte, tokenKeyID []byte, tokenKey *rsa.PublicKey, originName string, nameKey EncapKey) (PreparedTokenRequest, error) {
+	if err := checkRequestKeys(tokenKeyID, tokenKey, nameKey); err != nil {
+		return PreparedTokenRequest{}, err
+	}
+	originName, err := applyOriginNormalizer(c.normalizeOrigin, originName)
+	if err != nil {
+		return PreparedTokenRequest{}, err
+	}
+
+	blinded, err := c.blindTokenRequest(rand.Reader, challenge, nonce, blindKeyEnc, tokenKeyID, tokenKey, originName)
+	if err != nil {
+		return PreparedTokenRequest{}, err
+	}
+
+	requestState, digest, err := c.prepareTokenRequest(rand.Reader, blinded, tokenKeyID, tokenKey, originName, nameKey)
+	if err != nil {
+		return PreparedTokenRequest{}, err
+	}
+
+	blindScalar, err := ecdsa.BlindScalarWithContext(c.curve, blinded.blindKey, blindContext(labelClientBlind))
+	if err != nil {
+		return PreparedTokenRequest{}, err
+	}
+
+	return PreparedTokenRequest{
+		curve:       c.curve,
+		state:       requestState,
+		blindScalar: blindScalar,
+		digest:      digest,
+	}, nil
+}
+
+// Digest returns the value to be signed by the client secret key, encoded as a
+// big-endian scalar. See PrepareTokenRequest.
+func (p PreparedTokenRequest) Digest() []byte {
+	n := p.curve.Params().N
+	e := digestToInt(p.digest, n)
+	e.Mul(e, new(big.Int).ModInverse(p.blindScalar, n))
+	e.Mod(e, n)
+
+	scalarLen := (p.curve.Params().BitSize + 7) / 8
+	return e.FillBytes(make([]byte, scalarLen))
+}
+
+// digestToInt converts digest to an integer as ECDSA does: digests longer than
+// the order n are truncated to its bit length before use, so the scaled digest
+// is the one a verifier computes (e.g., a SHA-384 digest on P-256).
+func digestToInt(digest []byte, n *big.Int) *big.Int {
+	orderBits := n.BitLen()
+	orderBytes := (orderBits + 7) / 8
+	if len(digest) > orderBytes {
+		digest = digest[:orderBytes]
+	}
+
+	e := new(big.Int).SetBytes(digest)
+	if excess := len(digest)*8 - orderBits; excess > 0 {
+		e.Rsh(e, uint(excess))
+	}
+	return e
+}
+
+// AttachSignature completes the request with signature, the r || s encoding of
+// the signer's ECDSA signature over Digest, and returns the request state. It
+// fails with ErrInvalidRequestSignature if the resulting request signature does
+// not verify under the request key.
+func (p PreparedTokenRequest) AttachSignature(signature []byte) (RateLimitedTokenRequestState, error) {
+	scalarLen := (p.curve.Params().BitSize + 7) / 8
+	if len(signature) != 2*scalarLen {
+		return RateLimitedTokenRequestState{}, ErrInvalidRequestSignature
 	}
+	r := new(big.Int).SetBytes(signature[:scalarLen])
+	s := new(big.Int).SetBytes(signature[scalarLen:])
+	s.Mul(s, p.blindScalar)
+	s.Mod(s, p.curve.Params().N)
 
+	request := *p.state.request
+	request.Signature = encodeRequestSignature(p.curve, r, s)
+	if err := VerifyRequestSignature(&request, request.RequestKey); err != nil {
+		return RateLimitedTokenRequestState{}, err
+	}
+
+	requestState := p.state
+	requestState.request = &request
 	return requestState, nil
 }
+
+// CreateTokenRequest fails with tokens.ErrChallengeExpired if challenge is an
+// encoded TokenChallenge that has expired (see tokens.NewExpiringRedemptionNonce),
+// and with ErrNilTokenKey or ErrZeroNameKey if either issuer key is missing.
+// tokenKeyID is the full key ID of tokenKey (see FullKeyID), which the token
+// carries; the request only carries its wire key ID.
+//
+// https://ietf-wg-privacypass.github.io/draft-ietf-privacypass-rate-limit-tokens/draft-ietf-privacypass-rate-limit-tokens.html#name-client-to-attester-request
+func (c RateLimitedClient) CreateTokenRequest(challenge, nonce, blindKeyEnc []byte, tokenKeyID []byte, tokenKey *rsa.PublicKey, originName string, nameKey EncapKey) (RateLimitedTokenRequestState, error) {
+	return c.CreateTokenRequestContext(context.Background(), challenge, nonce, blindKeyEnc, tokenKeyID, tokenKey, originName, nameKey)
+}
+
+// CreateTokenRequestContext behaves like CreateTokenRequest, but gives up with
+// ctx.Err() if ctx is done before the token input is blinded or before the
+// request is encrypted.
+func (c RateLimitedClient) CreateTokenRequestContext(ctx context.Context, challenge, nonce, blindKeyEnc []byte, tokenKeyID []byte, tokenKey *rsa.PublicKey, originName string, nameKey EncapKey) (RateLimitedTokenRequestState, error) {
+	return c.createTokenRequest(ctx, rand.Reader, challenge, nonce, blindKeyEnc, tokenKeyID, tokenKey, originName, nameKey)
+}
+
+// CreateTokenRequestWithRandom behaves like CreateTokenRequest, but draws all
+// randomness from rng instead of crypto/rand: the blind RSA salt and blind, the
+// HPKE encapsulation, and the request signature entropy. With a seeded rng the
+// request is byte-identical across runs, which is meant for generating test
+// vectors only; production requests must use an unpredictable rng.
+func (c RateLimitedClient) CreateTokenRequestWithRandom(rng io.Reader, challenge, nonce, blindKeyEnc []byte, tokenKeyID []byte, tokenKey *rsa.PublicKey, originName string, nameKey EncapKey) (RateLimitedTokenRequestState, error) {
+	return c.createTokenRequest(context.Background(), rng, challenge, nonce, blindKeyEnc, tokenKeyID, tokenKey, originName, nameKey)
+}
+
+func (c RateLimitedClient) createTokenRequest(ctx context.Context, rng io.Reader, challenge, nonce, blindKeyEnc []byte, tokenKeyID []byte, tokenKey *rsa.PublicKey, originName string, nameKey EncapKey) (RateLimitedTokenRequestState, error) {
+	if err := checkRequestKeys(tokenKeyID, tokenKey, nameKey); err != nil {
+		return RateLimitedTokenRequestState{}, err
+	}
+	originName, err := applyOriginNormalizer(c.normalizeOrigin, originName)
+	if err != nil {
+		return RateLimitedTokenRequestState{}, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return RateLimitedTokenRequestState{}, err
+	}
+	blinded, err := c.blindTokenRequest(rng, challenge, nonce, blindKeyEnc, tokenKeyID, tokenKey, originName)
+	if err != nil {
+		return RateLimitedTokenRequestState{}, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return RateLimitedTokenRequestState{}, err
+	}
+	return c.encryptTokenRequest(rng, blinded, tokenKeyID, tokenKey, originName, nameKey)
+}
+
+// CreateTokenRequestsForOrigins builds one token request per origin for the
+// same challenge, e.g., to stress test an issuer with many origins. It is a
+// convenience loop over CreateTokenRequest that draws a fresh nonce and blind
+// for each origin, and does no work that a caller looping itself would not.
+// The blind of each request is available from its state (see Blind).
+//
+// Requests for different origins do not share a blinded message. Sharing one
+// would make the requests linkable to each other, and the issuer rejects a
+// blinded message seen for more than one origin with ErrCrossOriginReuse (see
+// BlindedMessageTracker), so an earlier bulk design that blinded once for all
+// origins was dropped.
+func (c RateLimitedClient) CreateTokenRequestsForOrigins(challenge, tokenKeyID []byte, tokenKey *rsa.PublicKey, origins []string, nameKey EncapKey) ([]RateLimitedTokenRequestState, error) {
+	if err := checkRequestKeys(tokenKeyID, tokenKey, nameKey); err != nil {
+		return nil, err
+	}
+
+	scalarLen := (c.curve.Params().BitSize + 7) / 8
+	requestStates := make([]RateLimitedTokenRequestState, len(origins))
+	for i, originName := range origins {
+		nonce := make([]byte, 32)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		blindKey, err := ecdsa.GenerateKey(c.curve, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		blindKeyEnc := blindKey.D.FillBytes(make([]byte, scalarLen))
+
+		requestStates[i], err = c.createTokenRequest(context.Background(), rand.Reader, challenge, nonce, blindKeyEnc, tokenKeyID, tokenKey, originName, nameKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return requestStates, nil
+}
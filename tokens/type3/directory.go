@@ -0,0 +1,225 @@
+package type3
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/cloudflare/pat-go/util"
+)
+
+var (
+	ErrInvalidDirectory = errors.New("invalid issuer directory")
+)
+
+// IssuerDirectory is the JSON issuer directory, extended with the issuer's
+// name key. Keys are base64url-encoded: token keys as SPKI with the RSASSA-PSS
+// OID, and the name key as an EncapKey.
+//
+// https://tfpauly.github.io/privacy-proxy/draft-privacypass-rate-limit-tokens.html#name-configuration
+type IssuerDirectory struct {
+	IssuerRequestURI string              `json:"issuer-request-uri,omitempty"`
+	TokenKeys        []DirectoryTokenKey `json:"token-keys"`
+	IssuerEncapKey   string              `json:"issuer-encap-key"`
+}
+
+type DirectoryTokenKey struct {
+	TokenType uint16 `json:"token-type"`
+	TokenKey  string `json:"token-key"`
+}
+
+// Directory returns the issuer directory for the current token and name keys.
+func (i *RateLimitedIssuer) Directory(requestURI string) ([]byte, error) {
+	tokenKey := i.TokenKey()
+	if tokenKey == nil {
+		return nil, ErrNilTokenKey
+	}
+	tokenKeyEnc, err := util.MarshalTokenKeyPSSOID(tokenKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(IssuerDirectory{
+		IssuerRequestURI: requestURI,
+		TokenKeys: []DirectoryTokenKey{{
+			TokenType: RateLimitedTokenType,
+			TokenKey:  base64.RawURLEncoding.EncodeToString(tokenKeyEnc),
+		}},
+		IssuerEncapKey: base64.RawURLEncoding.EncodeToString(i.NameKey().Marshal()),
+	})
+}
+
+// ClientConfig bundles the issuer parameters a client needs to create token
+// requests, so that the token key, its ID, and the name key always come from
+// the same issuer directory.
+type ClientConfig struct {
+	TokenKey   *rsa.PublicKey
+	TokenKeyID []byte
+	NameKey    EncapKey
+	Curve      elliptic.Curve
+}
+
+func decodeDirectoryValue(value string) ([]byte, error) {
+	if data, err := base64.RawURLEncoding.DecodeString(value); err == nil {
+		return data, nil
+	}
+	return base64.URLEncoding.DecodeString(value)
+}
+
+// NewClientConfig parses an issuer directory and returns the configuration for
+// the first rate-limited token key it lists.
+func NewClientConfig(directoryJSON []byte) (ClientConfig, error) {
+	var directory IssuerDirectory
+	if err := json.Unmarshal(directoryJSON, &directory); err != nil {
+		return ClientConfig{}, fmt.Errorf("%w: %v", ErrInvalidDirectory, err)
+	}
+
+	var tokenKeyEnc []byte
+	for _, tokenKey := range directory.TokenKeys {
+		if tokenKey.TokenType != RateLimitedTokenType {
+			continue
+		}
+		data, err := decodeDirectoryValue(tokenKey.TokenKey)
+		if err != nil {
+			return ClientConfig{}, fmt.Errorf("%w: token key: %v", ErrInvalidDirectory, err)
+		}
+		tokenKeyEnc = data
+		break
+	}
+	if tokenKeyEnc == nil {
+		return ClientConfig{}, fmt.Errorf("%w: no token key for token type %d", ErrInvalidDirectory, RateLimitedTokenType)
+	}
+	tokenKey, err := util.UnmarshalTokenKey(tokenKeyEnc)
+	if err != nil {
+		return ClientConfig{}, fmt.Errorf("%w: token key: %v", ErrInvalidDirectory, err)
+	}
+	tokenKeyID := sha256.Sum256(tokenKeyEnc)
+
+	nameKeyEnc, err := decodeDirectoryValue(directory.IssuerEncapKey)
+	if err != nil {
+		return ClientConfig{}, fmt.Errorf("%w: name key: %v", ErrInvalidDirectory, err)
+	}
+	nameKey, err := UnmarshalEncapKey(nameKeyEnc)
+	if err != nil {
+		return ClientConfig{}, fmt.Errorf("%w: name key: %v", ErrInvalidDirectory, err)
+	}
+
+	return ClientConfig{
+		TokenKey:   tokenKey,
+		TokenKeyID: tokenKeyID[:],
+		NameKey:    nameKey,
+		Curve:      elliptic.P384(),
+	}, nil
+}
+
+// DirectoryDiff describes the key changes between two issuer directories.
+// Token keys are identified by their token key ID and name keys by the SHA-256
+// digest of their encoding.
+type DirectoryDiff struct {
+	AddedTokenKeys   [][]byte // IDs of token keys only in the new directory
+	RemovedTokenKeys [][]byte // IDs of token keys only in the old directory
+	AddedNameKey     []byte   // ID of the new name key, if it changed
+	RemovedNameKey   []byte   // ID of the old name key, if it changed
+}
+
+// TokenKeyRotated reports whether a token key was replaced by another.
+func (d DirectoryDiff) TokenKeyRotated() bool {
+	return len(d.AddedTokenKeys) > 0 && len(d.RemovedTokenKeys) > 0
+}
+
+// NameKeyRotated reports whether the name key was replaced by another.
+func (d DirectoryDiff) NameKeyRotated() bool {
+	return d.AddedNameKey != nil && d.RemovedNameKey != nil
+}
+
+// Changed reports whether any key changed, in which case a ClientConfig built
+// from the old directory should be rebuilt.
+func (d DirectoryDiff) Changed() bool {
+	return len(d.AddedTokenKeys) > 0 || len(d.RemovedTokenKeys) > 0 || d.AddedNameKey != nil || d.RemovedNameKey != nil
+}
+
+type directoryKeys struct {
+	tokenKeyIDs [][]byte
+	nameKeyID   []byte
+}
+
+func parseDirectoryKeys(directoryJSON []byte) (directoryKeys, error) {
+	var directory IssuerDirectory
+	if err := json.Unmarshal(directoryJSON, &directory); err != nil {
+		return directoryKeys{}, fmt.Errorf("%w: %v", ErrInvalidDirectory, err)
+	}
+
+	var keys directoryKeys
+	for _, tokenKey := range directory.TokenKeys {
+		tokenKeyEnc, err := decodeDirectoryValue(tokenKey.TokenKey)
+		if err != nil {
+			return directoryKeys{}, fmt.Errorf("%w: token key: %v", ErrInvalidDirectory, err)
+		}
+		tokenKeyID := sha256.Sum256(tokenKeyEnc)
+		keys.tokenKeyIDs = append(keys.tokenKeyIDs, tokenKeyID[:])
+	}
+	if directory.IssuerEncapKey != "" {
+		nameKeyEnc, err := decodeDirectoryValue(directory.IssuerEncapKey)
+		if err != nil {
+			return directoryKeys{}, fmt.Errorf("%w: name key: %v", ErrInvalidDirectory, err)
+		}
+		nameKeyID := sha256.Sum256(nameKeyEnc)
+		keys.nameKeyID = nameKeyID[:]
+	}
+
+	return keys, nil
+}
+
+func containsKeyID(keyIDs [][]byte, keyID []byte) bool {
+	for _, k := range keyIDs {
+		if bytes.Equal(k, keyID) {
+			return true
+		}
+	}
+	return false
+}
+
+// DiffDirectories reports the token and name keys added or removed between the
+// old and new issuer directories.
+func DiffDirectories(old, new []byte) (DirectoryDiff, error) {
+	oldKeys, err := parseDirectoryKeys(old)
+	if err != nil {
+		return DirectoryDiff{}, err
+	}
+	newKeys, err := parseDirectoryKeys(new)
+	if err != nil {
+		return DirectoryDiff{}, err
+	}
+
+	var diff DirectoryDiff
+	for _, keyID := range newKeys.tokenKeyIDs {
+		if !containsKeyID(oldKeys.tokenKeyIDs, keyID) {
+			diff.AddedTokenKeys = append(diff.AddedTokenKeys, keyID)
+		}
+	}
+	for _, keyID := range oldKeys.tokenKeyIDs {
+		if !containsKeyID(newKeys.tokenKeyIDs, keyID) {
+			diff.RemovedTokenKeys = append(diff.RemovedTokenKeys, keyID)
+		}
+	}
+	if !bytes.Equal(oldKeys.nameKeyID, newKeys.nameKeyID) {
+		diff.AddedNameKey = newKeys.nameKeyID
+		diff.RemovedNameKey = oldKeys.nameKeyID
+	}
+
+	return diff, nil
+}
+
+// CreateTokenRequestWithConfig is CreateTokenRequest with the issuer
+// parameters taken from cfg.
+func (c RateLimitedClient) CreateTokenRequestWithConfig(cfg ClientConfig, challenge, nonce, blindKeyEnc []byte, origin string) (RateLimitedTokenRequestState, error) {
+	if cfg.Curve != nil && cfg.Curve != c.curve {
+		return RateLimitedTokenRequestState{}, fmt.Errorf("client curve %s does not match config curve %s", c.curve.Params().Name, cfg.Curve.Params().Name)
+	}
+	return c.CreateTokenRequest(challenge, nonce, blindKeyEnc, cfg.TokenKeyID, cfg.TokenKey, origin, cfg.NameKey)
+}
@@ -0,0 +1,168 @@
+package type3
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/cloudflare/pat-go/ecdsa"
+)
+
+func TestClientConfigFromDirectory(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	directory, err := issuer.Directory("https://issuer.example/token-request")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := NewClientConfig(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cfg.TokenKeyID, issuer.TokenKeyID()) {
+		t.Fatal("token key ID mismatch")
+	}
+
+	curve := elliptic.P384()
+	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge := make([]byte, 32)
+	rand.Reader.Read(challenge)
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+
+	requestState, err := client.CreateTokenRequestWithConfig(cfg, challenge, nonce, blindKey.D.Bytes(), testOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := requestState.FinalizeToken(response); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientConfigInvalidDirectory(t *testing.T) {
+	directories := []string{
+		`not json`,
+		`{"token-keys": [], "issuer-encap-key": ""}`,
+		`{"token-keys": [{"token-type": 2, "token-key": "AAAA"}], "issuer-encap-key": ""}`,
+		`{"token-keys": [{"token-type": 3, "token-key": "!!"}], "issuer-encap-key": ""}`,
+		`{"token-keys": [{"token-type": 3, "token-key": "AAAA"}], "issuer-encap-key": ""}`,
+	}
+	for _, directory := range directories {
+		if _, err := NewClientConfig([]byte(directory)); !errors.Is(err, ErrInvalidDirectory) {
+			t.Fatalf("expected ErrInvalidDirectory for %s, got %v", directory, err)
+		}
+	}
+}
+
+func TestDiffDirectoriesNameKeyRotation(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	oldDirectory, err := issuer.Directory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := DiffDirectories(oldDirectory, oldDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Changed() {
+		t.Fatal("identical directories reported as changed")
+	}
+
+	if _, err := issuer.RotateNameKey(0x01); err != nil {
+		t.Fatal(err)
+	}
+	newDirectory, err := issuer.Directory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err = DiffDirectories(oldDirectory, newDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.Changed() || !diff.NameKeyRotated() || diff.TokenKeyRotated() {
+		t.Fatalf("unexpected diff %+v", diff)
+	}
+	if len(diff.AddedTokenKeys) != 0 || len(diff.RemovedTokenKeys) != 0 {
+		t.Fatal("token keys reported as changed")
+	}
+	nameKeyID := sha256.Sum256(issuer.NameKey().Marshal())
+	if !bytes.Equal(diff.AddedNameKey, nameKeyID[:]) {
+		t.Fatal("added name key mismatch")
+	}
+}
+
+func TestDiffDirectoriesTokenKeyRotation(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	oldDirectory, err := issuer.Directory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newTokenKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newIssuer := createTestIssuer(t, newTokenKey)
+	newDirectoryJSON, err := newIssuer.Directory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep the old name key so that only the token key changes
+	var oldParsed, newParsed IssuerDirectory
+	if err := json.Unmarshal(oldDirectory, &oldParsed); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(newDirectoryJSON, &newParsed); err != nil {
+		t.Fatal(err)
+	}
+	newParsed.IssuerEncapKey = oldParsed.IssuerEncapKey
+	newDirectory, err := json.Marshal(newParsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := DiffDirectories(oldDirectory, newDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.TokenKeyRotated() || diff.NameKeyRotated() {
+		t.Fatalf("unexpected diff %+v", diff)
+	}
+	if len(diff.AddedTokenKeys) != 1 || !bytes.Equal(diff.AddedTokenKeys[0], newIssuer.TokenKeyID()) {
+		t.Fatal("added token key mismatch")
+	}
+	if len(diff.RemovedTokenKeys) != 1 || !bytes.Equal(diff.RemovedTokenKeys[0], issuer.TokenKeyID()) {
+		t.Fatal("removed token key mismatch")
+	}
+
+	if _, err := DiffDirectories(oldDirectory, []byte("not json")); !errors.Is(err, ErrInvalidDirectory) {
+		t.Fatalf("expected ErrInvalidDirectory, got %v", err)
+	}
+}
@@ -2,6 +2,8 @@ package type3
 
 import (
 	"bytes"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 
 	hpke "github.com/cisco/go-hpke"
@@ -14,6 +16,28 @@ var (
 	fixedAEAD = hpke.AEAD_AESGCM128
 )
 
+var (
+	ErrMissingSuite    = errors.New("name key has no HPKE suite")
+	ErrUnsupportedKEM  = errors.New("unsupported HPKE KEM")
+	ErrUnsupportedKDF  = errors.New("unsupported HPKE KDF")
+	ErrUnsupportedAEAD = errors.New("unsupported HPKE AEAD")
+)
+
+// assembleSuite assembles the HPKE suite for the given algorithm IDs,
+// reporting which component, if any, the linked HPKE implementation lacks.
+func assembleSuite(kemID hpke.KEMID, kdfID hpke.KDFID, aeadID hpke.AEADID) (hpke.CipherSuite, error) {
+	if _, err := hpke.AssembleCipherSuite(kemID, fixedKDF, fixedAEAD); err != nil {
+		return hpke.CipherSuite{}, fmt.Errorf("%w: 0x%04x", ErrUnsupportedKEM, uint16(kemID))
+	}
+	if _, err := hpke.AssembleCipherSuite(fixedKEM, kdfID, fixedAEAD); err != nil {
+		return hpke.CipherSuite{}, fmt.Errorf("%w: 0x%04x", ErrUnsupportedKDF, uint16(kdfID))
+	}
+	if _, err := hpke.AssembleCipherSuite(fixedKEM, fixedKDF, aeadID); err != nil {
+		return hpke.CipherSuite{}, fmt.Errorf("%w: 0x%04x", ErrUnsupportedAEAD, uint16(aeadID))
+	}
+	return hpke.AssembleCipherSuite(kemID, kdfID, aeadID)
+}
+
 // https://tfpauly.github.io/privacy-proxy/draft-privacypass-rate-limit-tokens.html#name-configuration
 type PrivateEncapKey struct {
 	id         uint8
@@ -60,6 +84,60 @@ func (k PrivateEncapKey) Public() EncapKey {
 	}
 }
 
+// RequiredSuite returns the HPKE suite needed to encrypt to the name key, or an
+// error naming the first component the linked HPKE implementation does not
+// support, so clients can fail before attempting encryption.
+func (k EncapKey) RequiredSuite() (hpke.CipherSuite, error) {
+	if k.suite.KEM == nil || k.suite.KDF == nil || k.suite.AEAD == nil {
+		return hpke.CipherSuite{}, ErrMissingSuite
+	}
+	return assembleSuite(k.suite.KEM.ID(), k.suite.KDF.ID(), k.suite.AEAD.ID())
+}
+
+// Compatible reports whether k and other have the same HPKE KEM, KDF, and AEAD
+// IDs and the same serialized public key, ignoring their id bytes. Compatible
+// keys need the same suite support from the client and encrypt to the same
+// issuer private key, so a client need not re-check a newly fetched name key
+// that is compatible with its cached one.
+//
+// The id byte is still part of the encoded name key, and thus of the name key
+// ID and the additional data that requests bind to. Requests built for one of
+// two compatible keys with different ids must be rebuilt for the other (see
+// RateLimitedIssuer.SetNameKeyID). Compare the encodings from Marshal to check
+// that requests are interchangeable.
+func (k EncapKey) Compatible(other EncapKey) bool {
+	if k.suite.KEM == nil || k.suite.KDF == nil || k.suite.AEAD == nil ||
+		other.suite.KEM == nil || other.suite.KDF == nil || other.suite.AEAD == nil {
+		return false
+	}
+	if k.suite.KEM.ID() != other.suite.KEM.ID() ||
+		k.suite.KDF.ID() != other.suite.KDF.ID() ||
+		k.suite.AEAD.ID() != other.suite.AEAD.ID() {
+		return false
+	}
+	return bytes.Equal(k.suite.KEM.SerializePublicKey(k.publicKey), other.suite.KEM.SerializePublicKey(other.publicKey))
+}
+
+// Equal reports whether k and other are the same name key: the same id, the
+// same HPKE KEM, KDF, and AEAD IDs, and the same serialized public key, which
+// is compared in constant time. Unlike Compatible, it tells keys that differ
+// only in their id apart.
+func (k EncapKey) Equal(other EncapKey) bool {
+	if k.suite.KEM == nil || k.suite.KDF == nil || k.suite.AEAD == nil ||
+		other.suite.KEM == nil || other.suite.KDF == nil || other.suite.AEAD == nil {
+		return false
+	}
+	if k.id != other.id ||
+		k.suite.KEM.ID() != other.suite.KEM.ID() ||
+		k.suite.KDF.ID() != other.suite.KDF.ID() ||
+		k.suite.AEAD.ID() != other.suite.AEAD.ID() {
+		return false
+	}
+	publicKeyEnc := k.suite.KEM.SerializePublicKey(k.publicKey)
+	otherPublicKeyEnc := other.suite.KEM.SerializePublicKey(other.publicKey)
+	return subtle.ConstantTimeCompare(publicKeyEnc, otherPublicKeyEnc) == 1
+}
+
 func (k PrivateEncapKey) IsEqual(o PrivateEncapKey) bool {
 	if k.id != o.id {
 		return false
@@ -97,6 +175,9 @@ func (k EncapKey) Marshal() []byte {
 	return b.BytesOrPanic()
 }
 
+// UnmarshalEncapKey decodes a name key encoded with Marshal. The encoding is
+// self-describing, so the HPKE suite is reassembled from the encoded KEM, KDF,
+// and AEAD IDs, e.g., for clients that fetch the name key out of band.
 func UnmarshalEncapKey(data []byte) (EncapKey, error) {
 	s := cryptobyte.String(data)
 
@@ -108,9 +189,9 @@ func UnmarshalEncapKey(data []byte) (EncapKey, error) {
 	}
 
 	kem := hpke.KEMID(kemID)
-	suite, err := hpke.AssembleCipherSuite(kem, fixedKDF, fixedAEAD)
+	suite, err := assembleSuite(kem, fixedKDF, fixedAEAD)
 	if err != nil {
-		return EncapKey{}, fmt.Errorf("Invalid EncapKey")
+		return EncapKey{}, fmt.Errorf("Invalid EncapKey: %w", err)
 	}
 
 	publicKeyBytes := make([]byte, suite.KEM.PublicKeySize())
@@ -125,9 +206,9 @@ func UnmarshalEncapKey(data []byte) (EncapKey, error) {
 		return EncapKey{}, fmt.Errorf("Invalid EncapKey")
 	}
 
-	suite, err = hpke.AssembleCipherSuite(kem, hpke.KDFID(kdfID), hpke.AEADID(aeadID))
+	suite, err = assembleSuite(kem, hpke.KDFID(kdfID), hpke.AEADID(aeadID))
 	if err != nil {
-		return EncapKey{}, fmt.Errorf("Invalid EncapKey")
+		return EncapKey{}, fmt.Errorf("Invalid EncapKey: %w", err)
 	}
 
 	publicKey, err := suite.KEM.DeserializePublicKey(publicKeyBytes)
@@ -0,0 +1,194 @@
+package type3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/pat-go/tokens"
+)
+
+const (
+	TokenRequestMediaType  = "application/private-token-request"
+	TokenResponseMediaType = "application/private-token-response"
+
+	// maxTokenResponseSize bounds the issuer responses FetchToken reads. Actual
+	// responses are under 700 bytes for the largest supported token key.
+	maxTokenResponseSize = 4096
+)
+
+var (
+	ErrIssuerResponse = errors.New("unexpected issuer response")
+)
+
+// MaxRequestSize returns the size of the largest token request the issuer can
+// accept. The encrypted origin token request is bounded by its 16-bit length
+// prefix, and clients refuse origin names that would overflow it (see
+// ErrOriginNameTooLong), so this holds for any supported token key size. It
+// includes room for an idempotency key extension.
+func (i *RateLimitedIssuer) MaxRequestSize() int {
+	params := rateLimitedParams(i.curve)
+	maxExtensionsSize := 2 + 2 + 2 + MaxIdempotencyKeySize
+	return 2 + params.RequestKeySize + params.NameKeyIDSize + 2 + 0xffff + params.SignatureSize + maxExtensionsSize
+}
+
+// isRequestTooLarge reports whether err was returned by an http.MaxBytesReader
+// that hit its limit. http.MaxBytesError is not available in Go 1.18, so this
+// matches its message.
+func isRequestTooLarge(err error) bool {
+	return strings.Contains(err.Error(), "request body too large")
+}
+
+// retryAfterSeconds formats d as a Retry-After delay, rounded up to whole
+// seconds so that clients never retry early.
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
+
+// SetErrorLog sets the logger HTTPHandler and BatchHTTPHandler report failed
+// requests to. Clients only receive a fixed description of the failure, so
+// the details are logged instead. Nothing is logged by default, or if logger
+// is nil. Errors from evaluating a request do not include the client-chosen
+// origin name.
+func (i *RateLimitedIssuer) SetErrorLog(logger *log.Logger) {
+	i.errorLog = logger
+}
+
+func (i *RateLimitedIssuer) logf(format string, args ...interface{}) {
+	if i.errorLog != nil {
+		i.errorLog.Printf(format, args...)
+	}
+}
+
+// evaluationErrorStatus maps an evaluation error to the HTTP status and the
+// fixed status text reported to the client. Error messages may carry details
+// of the issuer's configuration, so they are never sent to clients.
+func evaluationErrorStatus(err error) (int, string) {
+	var policyErr *PolicyError
+	switch {
+	case errors.As(err, &policyErr) && policyErr.RetryAfter > 0:
+		return http.StatusServiceUnavailable, "origin temporarily unavailable"
+	case errors.As(err, &policyErr):
+		return http.StatusForbidden, "origin not allowed"
+	case errors.Is(err, ErrUnknownOrigin):
+		return http.StatusUnprocessableEntity, "unknown origin"
+	case errors.Is(err, ErrNameKeyRetired):
+		return http.StatusGone, "name key retired"
+	default:
+		return http.StatusBadRequest, "invalid token request"
+	}
+}
+
+// HTTPHandler returns an http.Handler serving the issuer's token request
+// endpoint. The response body is the encrypted token response followed by the
+// blinded request key, which the attester splits off before forwarding the
+// encrypted response to the client. Requests rejected by the origin policy fail
+// with 503 and a Retry-After header if the policy asked for a delay, and with
+// 403 otherwise. Requests encrypted to a retired name key fail with 410, telling
+// clients to fetch the current name key. Requests fail with 503 until the
+// issuer is ready (see Ready), and while it has no origins to serve (see
+// IsConfigured). Requests are evaluated with EvaluateContext, so retries that
+// carry an idempotency key are answered from the issuer's IdempotencyCache,
+// and requests whose client goes away before signing are not signed. Failures
+// are reported to the client with a fixed status text and logged in detail
+// (see SetErrorLog).
+func (i *RateLimitedIssuer) HTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Content-Type") != TokenRequestMediaType {
+			http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+			return
+		}
+		if !i.canServe() {
+			http.Error(w, "issuer not ready", http.StatusServiceUnavailable)
+			return
+		}
+
+		maxRequestSize := int64(i.MaxRequestSize())
+		if r.ContentLength > maxRequestSize {
+			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+		if err != nil {
+			if isRequestTooLarge(err) {
+				http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, "failed reading request", http.StatusBadRequest)
+			}
+			return
+		}
+
+		encryptedTokenResponse, blindedRequestKey, err := i.EvaluateContext(r.Context(), body)
+		if err != nil {
+			i.logf("type3: token request failed: %v", err)
+			status, text := evaluationErrorStatus(err)
+			var policyErr *PolicyError
+			if errors.As(err, &policyErr) && policyErr.RetryAfter > 0 {
+				w.Header().Set("Retry-After", retryAfterSeconds(policyErr.RetryAfter))
+			}
+			http.Error(w, text, status)
+			return
+		}
+
+		w.Header().Set("Content-Type", TokenResponseMediaType)
+		w.WriteHeader(http.StatusOK)
+		w.Write(append(encryptedTokenResponse, blindedRequestKey...))
+	})
+}
+
+// FetchToken sends the token request to the issuer endpoint at issuerURL, as
+// served by HTTPHandler, and finalizes the token from its response. The
+// response body is the encrypted token response followed by the blinded
+// request key; the latter is split off and discarded. The request is bound to
+// ctx, so cancelling ctx aborts it. Responses other than 200 with the token
+// response media type fail with ErrIssuerResponse. If client is nil,
+// http.DefaultClient is used.
+func (s RateLimitedTokenRequestState) FetchToken(ctx context.Context, client *http.Client, issuerURL string) (tokens.Token, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, issuerURL, bytes.NewReader(s.request.Marshal()))
+	if err != nil {
+		return tokens.Token{}, err
+	}
+	req.Header.Set("Content-Type", TokenRequestMediaType)
+	req.Header.Set("Accept", TokenResponseMediaType)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return tokens.Token{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenResponseSize+1))
+	if err != nil {
+		return tokens.Token{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return tokens.Token{}, fmt.Errorf("%w: status %d: %s", ErrIssuerResponse, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != TokenResponseMediaType {
+		return tokens.Token{}, fmt.Errorf("%w: content type %q", ErrIssuerResponse, contentType)
+	}
+	if len(body) > maxTokenResponseSize {
+		return tokens.Token{}, fmt.Errorf("%w: response too large", ErrIssuerResponse)
+	}
+
+	blindedRequestKeyLen := rateLimitedParams(s.client.curve).RequestKeySize
+	if len(body) < blindedRequestKeyLen {
+		return tokens.Token{}, fmt.Errorf("%w: response too short", ErrIssuerResponse)
+	}
+	return s.FinalizeTokenContext(ctx, body[:len(body)-blindedRequestKeyLen])
+}
@@ -0,0 +1,360 @@
+package type3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postTokenRequest(t *testing.T, handler http.Handler, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/token-request", bytes.NewReader(body))
+	req.Header.Set("Content-Type", TokenRequestMediaType)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHTTPHandler(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	rec := postTokenRequest(t, issuer.HTTPHandler(), requestState.Request().Marshal())
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Content-Type") != TokenResponseMediaType {
+		t.Fatalf("unexpected content type %s", rec.Header().Get("Content-Type"))
+	}
+
+	body := rec.Body.Bytes()
+	blindedRequestKeyLen := 49
+	_, err := requestState.FinalizeToken(body[:len(body)-blindedRequestKeyLen])
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPHandlerMalformedRequest(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	issuer.AddOrigin("origin.example")
+
+	rec := postTokenRequest(t, issuer.HTTPHandler(), []byte{0x00, 0x03, 0x01})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestHTTPHandlerUnknownOrigin(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	issuer.AddOrigin("origin.example")
+
+	var errorLog bytes.Buffer
+	issuer.SetErrorLog(log.New(&errorLog, "", 0))
+
+	_, requestState := createTestTokenRequest(t, issuer, "other.example")
+	rec := postTokenRequest(t, issuer.HTTPHandler(), requestState.Request().Marshal())
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", rec.Code)
+	}
+
+	// The client only sees the fixed status text, and the details are logged
+	if body := strings.TrimSpace(rec.Body.String()); body != "unknown origin" {
+		t.Fatalf("unexpected response body %q", body)
+	}
+	if !strings.Contains(errorLog.String(), ErrUnknownOrigin.Error()) {
+		t.Fatalf("expected the error to be logged, got %q", errorLog.String())
+	}
+	if strings.Contains(errorLog.String(), "other.example") {
+		t.Fatalf("client-chosen origin name logged: %q", errorLog.String())
+	}
+}
+
+func TestHTTPHandlerNameKeyRetired(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	if _, err := issuer.RotateNameKey(0x01); err != nil {
+		t.Fatal(err)
+	}
+	if err := issuer.RetireNameKey(0x00); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := postTokenRequest(t, issuer.HTTPHandler(), requestState.Request().Marshal())
+	if rec.Code != http.StatusGone {
+		t.Fatalf("expected 410, got %d", rec.Code)
+	}
+	if body := strings.TrimSpace(rec.Body.String()); body != "name key retired" {
+		t.Fatalf("unexpected response body %q", body)
+	}
+}
+
+func TestHTTPHandlerNotConfigured(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	if issuer.IsConfigured() {
+		t.Fatal("issuer without origins reported as configured")
+	}
+
+	_, requestState := createTestTokenRequest(t, issuer, "origin.example")
+	rec := postTokenRequest(t, issuer.HTTPHandler(), requestState.Request().Marshal())
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+
+	issuer.AddOrigin("origin.example")
+	if !issuer.IsConfigured() {
+		t.Fatal("issuer with origins reported as unconfigured")
+	}
+	rec = postTokenRequest(t, issuer.HTTPHandler(), requestState.Request().Marshal())
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	// Removing the last origin makes the issuer unavailable again, even though
+	// it was ready before
+	if err := issuer.RemoveOrigin("origin.example"); err != nil {
+		t.Fatal(err)
+	}
+	rec = postTokenRequest(t, issuer.HTTPHandler(), requestState.Request().Marshal())
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 after removing the last origin, got %d", rec.Code)
+	}
+}
+
+func TestHTTPHandlerRequestTooLarge(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	issuer.AddOrigin("origin.example")
+	handler := issuer.HTTPHandler()
+
+	rec := postTokenRequest(t, handler, make([]byte, issuer.MaxRequestSize()+1))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", rec.Code)
+	}
+
+	// Without a Content-Length, the limit is enforced while reading
+	req := httptest.NewRequest(http.MethodPost, "/token-request", io.MultiReader(bytes.NewReader(make([]byte, issuer.MaxRequestSize())), bytes.NewReader([]byte{0x00})))
+	req.Header.Set("Content-Type", TokenRequestMediaType)
+	req.ContentLength = -1
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", rec.Code)
+	}
+
+	// A body at the limit is read and rejected as malformed instead
+	rec = postTokenRequest(t, handler, make([]byte, issuer.MaxRequestSize()))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestMaxRequestSizeFitsLongestOrigin(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	// The longest origin name whose encrypted request fits the length prefix
+	longestOrigin := strings.Repeat("a", 65216)
+	blindedLen := (issuer.TokenKey().N.BitLen() + 7) / 8
+	if err := checkOriginNameLength(issuer.NameKey().suite, blindedLen, longestOrigin); err != nil {
+		t.Fatal(err)
+	}
+	issuer.AddOrigin(longestOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, longestOrigin)
+	requestState.Request().SetIdempotencyKey(make([]byte, MaxIdempotencyKeySize))
+	encodedRequest := requestState.Request().Marshal()
+	if len(encodedRequest) > issuer.MaxRequestSize() {
+		t.Fatalf("request of %d bytes exceeds MaxRequestSize %d", len(encodedRequest), issuer.MaxRequestSize())
+	}
+	rec := postTokenRequest(t, issuer.HTTPHandler(), encodedRequest)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHTTPHandlerPolicyRetryAfter(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+	handler := issuer.HTTPHandler()
+
+	errMaintenance := errors.New("origin under maintenance")
+	issuer.SetOriginPolicy(func(originName string) (time.Duration, error) {
+		if originName != testOrigin {
+			t.Fatalf("policy called for unexpected origin %s", originName)
+		}
+		return 1500 * time.Millisecond, errMaintenance
+	})
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	if _, _, err := issuer.Evaluate(requestState.Request().Marshal()); !errors.Is(err, ErrPolicyRejected) || !errors.Is(err, errMaintenance) {
+		t.Fatalf("expected policy rejection, got %v", err)
+	}
+
+	rec := postTokenRequest(t, handler, requestState.Request().Marshal())
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	if retryAfter := rec.Header().Get("Retry-After"); retryAfter != "2" {
+		t.Fatalf("expected Retry-After 2, got %q", retryAfter)
+	}
+
+	// Without a delay, the rejection is final
+	issuer.SetOriginPolicy(func(string) (time.Duration, error) {
+		return 0, errMaintenance
+	})
+	rec = postTokenRequest(t, handler, requestState.Request().Marshal())
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "" {
+		t.Fatal("unexpected Retry-After header")
+	}
+
+	issuer.SetOriginPolicy(nil)
+	rec = postTokenRequest(t, handler, requestState.Request().Marshal())
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHTTPHandlerReady(t *testing.T) {
+	tokenKey := loadPrivateKey(t)
+	issuer := createTestIssuer(t, nil)
+	handler := issuer.HTTPHandler()
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	// Requests are built against a configured issuer sharing the name key
+	configured := createTestIssuer(t, tokenKey)
+	configured.nameKey = issuer.nameKey
+	_, requestState := createTestTokenRequest(t, configured, testOrigin)
+
+	select {
+	case <-issuer.Ready():
+		t.Fatal("issuer without a token key reported as ready")
+	default:
+	}
+	rec := postTokenRequest(t, handler, requestState.Request().Marshal())
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+
+	if err := issuer.SetTokenKey(tokenKey); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-issuer.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("issuer not ready after loading the token key")
+	}
+	rec = postTokenRequest(t, handler, requestState.Request().Marshal())
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestIssuerWithoutTokenKey(t *testing.T) {
+	issuer := createTestIssuer(t, nil)
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+	issuer.SetAuditLog(NewAuditLog(io.Discard))
+
+	if issuer.TokenKey() != nil || issuer.TokenKeyID() != nil {
+		t.Fatal("expected no token key")
+	}
+	if _, err := issuer.Directory("/token-request"); !errors.Is(err, ErrNilTokenKey) {
+		t.Fatalf("expected ErrNilTokenKey, got %v", err)
+	}
+	if _, err := issuer.Benchmark(time.Millisecond); !errors.Is(err, ErrNilTokenKey) {
+		t.Fatalf("expected ErrNilTokenKey, got %v", err)
+	}
+
+	// Requests are rejected rather than panicking, whether malformed or not
+	configured := createTestIssuer(t, loadPrivateKey(t))
+	configured.nameKey = issuer.nameKey
+	_, requestState := createTestTokenRequest(t, configured, testOrigin)
+	for _, request := range [][]byte{{0x00, 0x03, 0x01}, requestState.Request().Marshal()} {
+		if _, _, err := issuer.Evaluate(request); err == nil {
+			t.Fatal("expected evaluation without a token key to fail")
+		}
+	}
+}
+
+func TestFetchToken(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	server := httptest.NewServer(issuer.HTTPHandler())
+	defer server.Close()
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	token, err := requestState.FetchToken(context.Background(), server.Client(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyToken(token, issuer.TokenKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Errors from the issuer are surfaced with their status
+	_, requestState = createTestTokenRequest(t, issuer, "other.example")
+	_, err = requestState.FetchToken(context.Background(), server.Client(), server.URL)
+	if !errors.Is(err, ErrIssuerResponse) || !strings.Contains(err.Error(), "422") {
+		t.Fatalf("expected ErrIssuerResponse with status 422, got %v", err)
+	}
+}
+
+func TestFetchTokenCancelled(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer server.Close()
+	defer close(unblock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	if _, err := requestState.FetchToken(ctx, server.Client(), server.URL); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestHTTPHandlerIdempotencyKey(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+	issuer.SetIdempotencyCache(NewIdempotencyCache(time.Minute))
+	handler := issuer.HTTPHandler()
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	requestState.Request().SetIdempotencyKey([]byte("retry-key"))
+	encodedRequest := requestState.Request().Marshal()
+
+	rec := postTokenRequest(t, handler, encodedRequest)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	retried := postTokenRequest(t, handler, encodedRequest)
+	if retried.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", retried.Code, retried.Body.String())
+	}
+	if !bytes.Equal(rec.Body.Bytes(), retried.Body.Bytes()) {
+		t.Fatal("retried request produced a different response")
+	}
+}
@@ -0,0 +1,152 @@
+package type3
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// idempotencyEntry holds the outcome of one evaluation. The entry is reserved
+// before evaluation starts; done is closed once response, blindedRequestKey,
+// and err are set.
+type idempotencyEntry struct {
+	done              chan struct{}
+	response          []byte
+	blindedRequestKey []byte
+	err               error
+	expiry            time.Time
+}
+
+type idempotencyQueueItem struct {
+	id    string
+	entry *idempotencyEntry
+}
+
+// DefaultIdempotencyCacheSize is the number of entries an IdempotencyCache
+// created with NewIdempotencyCache holds.
+const DefaultIdempotencyCacheSize = 65536
+
+// IdempotencyCache remembers issuer responses keyed by the idempotency key a
+// client carries in its token request (see SetIdempotencyKey) together with
+// the request bytes, so that a client retrying a request (e.g., after a
+// timeout) receives the original response instead of consuming another
+// issuance. Concurrent retries wait for the first evaluation rather than
+// evaluating again. Entries expire after a fixed TTL. The cache holds a bounded
+// number of entries and evicts the oldest one first when it is full, after
+// which a retry of the evicted request is evaluated again.
+type IdempotencyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*idempotencyEntry
+	queue   []idempotencyQueueItem // insertion, and thus expiry, order
+	now     func() time.Time
+}
+
+func NewIdempotencyCache(ttl time.Duration) *IdempotencyCache {
+	return NewIdempotencyCacheWithSize(ttl, DefaultIdempotencyCacheSize)
+}
+
+// NewIdempotencyCacheWithSize returns an IdempotencyCache that holds at most
+// size entries. A size below 1 is treated as 1.
+func NewIdempotencyCacheWithSize(ttl time.Duration, size int) *IdempotencyCache {
+	if size < 1 {
+		size = 1
+	}
+	return &IdempotencyCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*idempotencyEntry),
+		now:     time.Now,
+	}
+}
+
+// idempotencyID combines an idempotency key with a digest of the request, so a
+// key reused for a different request refers to a different entry.
+func idempotencyID(key []byte, encodedRequest []byte) string {
+	requestDigest := sha256.Sum256(encodedRequest)
+	return string(requestDigest[:]) + string(key)
+}
+
+// reserve returns the entry for key and encodedRequest. If there is no live
+// entry, it inserts a pending one and reports true, and the caller must
+// complete it with finish.
+func (c *IdempotencyCache) reserve(key []byte, encodedRequest []byte) (string, *idempotencyEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	c.evictExpiredLocked(now)
+
+	id := idempotencyID(key, encodedRequest)
+	if entry, ok := c.entries[id]; ok {
+		return id, entry, false
+	}
+
+	c.evictOldestLocked()
+	entry := &idempotencyEntry{
+		done:   make(chan struct{}),
+		expiry: now.Add(c.ttl),
+	}
+	c.entries[id] = entry
+	c.queue = append(c.queue, idempotencyQueueItem{id: id, entry: entry})
+	return id, entry, true
+}
+
+// finish records the outcome of a reserved entry and wakes any waiters. Failed
+// evaluations are not cached, so a later retry evaluates again.
+func (c *IdempotencyCache) finish(id string, entry *idempotencyEntry, response, blindedRequestKey []byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.response = response
+	entry.blindedRequestKey = blindedRequestKey
+	entry.err = err
+	if err != nil && c.entries[id] == entry {
+		delete(c.entries, id)
+	}
+	close(entry.done)
+}
+
+// evictExpiredLocked drops expired entries. Every entry has the same TTL, so
+// the queue is in expiry order and only its expired prefix is visited.
+func (c *IdempotencyCache) evictExpiredLocked(now time.Time) {
+	n := 0
+	for ; n < len(c.queue); n++ {
+		item := c.queue[n]
+		if now.Before(item.entry.expiry) {
+			break
+		}
+		if c.entries[item.id] == item.entry {
+			delete(c.entries, item.id)
+		}
+		c.queue[n] = idempotencyQueueItem{}
+	}
+	c.queue = c.queue[n:]
+}
+
+// evictOldestLocked drops the oldest entries until there is room for another
+// one. Every entry has an item in the queue, so bounding the queue bounds the
+// entries, including items left behind by failed evaluations.
+func (c *IdempotencyCache) evictOldestLocked() {
+	n := 0
+	for ; len(c.queue)-n >= c.size; n++ {
+		item := c.queue[n]
+		if c.entries[item.id] == item.entry {
+			delete(c.entries, item.id)
+		}
+		c.queue[n] = idempotencyQueueItem{}
+	}
+	c.queue = c.queue[n:]
+}
+
+// wait blocks until entry is complete or ctx is done.
+func (e *idempotencyEntry) wait(ctx context.Context) ([]byte, []byte, error) {
+	select {
+	case <-e.done:
+		return e.response, e.blindedRequestKey, e.err
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
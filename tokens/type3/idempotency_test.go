@@ -0,0 +1,176 @@
+package type3
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEvaluateIdempotencyKey(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+	issuer.SetIdempotencyCache(NewIdempotencyCache(time.Minute))
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	request := requestState.Request()
+	request.SetIdempotencyKey([]byte("retry-key"))
+	encodedRequest := request.Marshal()
+
+	response, blindedRequestKey, err := issuer.Evaluate(encodedRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retriedResponse, retriedBlindedRequestKey, err := issuer.Evaluate(encodedRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, retriedResponse) || !bytes.Equal(blindedRequestKey, retriedBlindedRequestKey) {
+		t.Fatal("retried request produced a different response")
+	}
+
+	// Without the key, every evaluation uses a fresh response nonce
+	request.SetIdempotencyKey(nil)
+	freshResponse, _, err := issuer.Evaluate(request.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(response, freshResponse) {
+		t.Fatal("expected a fresh response without an idempotency key")
+	}
+
+	_, err = requestState.FinalizeToken(retriedResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEvaluateIdempotencyKeyDifferentRequest(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+	issuer.SetIdempotencyCache(NewIdempotencyCache(time.Minute))
+
+	_, requestStateA := createTestTokenRequest(t, issuer, testOrigin)
+	_, requestStateB := createTestTokenRequest(t, issuer, testOrigin)
+	idempotencyKey := []byte("retry-key")
+	requestStateA.Request().SetIdempotencyKey(idempotencyKey)
+	requestStateB.Request().SetIdempotencyKey(idempotencyKey)
+
+	_, _, err := issuer.Evaluate(requestStateA.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same key with a different request is a new request, not a retry
+	response, _, err := issuer.Evaluate(requestStateB.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = requestStateB.FinalizeToken(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEvaluateIdempotencyKeyConcurrentRetries(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+	issuer.SetIdempotencyCache(NewIdempotencyCache(time.Minute))
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	requestState.Request().SetIdempotencyKey([]byte("retry-key"))
+	encodedRequest := requestState.Request().Marshal()
+
+	const retries = 8
+	responses := make([][]byte, retries)
+	errs := make([]error, retries)
+	var wg sync.WaitGroup
+	for n := 0; n < retries; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			responses[n], _, errs[n] = issuer.Evaluate(encodedRequest)
+		}(n)
+	}
+	wg.Wait()
+
+	// Each evaluation uses a fresh response nonce, so identical responses
+	// mean the request was evaluated once
+	for n := 0; n < retries; n++ {
+		if errs[n] != nil {
+			t.Fatal(errs[n])
+		}
+		if !bytes.Equal(responses[0], responses[n]) {
+			t.Fatal("concurrent retries produced different responses")
+		}
+	}
+}
+
+func TestIdempotencyCacheExpiry(t *testing.T) {
+	cache := NewIdempotencyCache(time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	id, entry, reserved := cache.reserve([]byte("key"), []byte("request"))
+	if !reserved {
+		t.Fatal("expected a new entry")
+	}
+	cache.finish(id, entry, []byte("response"), []byte("blinded"), nil)
+	_, cached, reserved := cache.reserve([]byte("key"), []byte("request"))
+	if reserved || !bytes.Equal(cached.response, []byte("response")) {
+		t.Fatal("expected cached response")
+	}
+
+	now = now.Add(time.Minute)
+	_, _, reserved = cache.reserve([]byte("key"), []byte("request"))
+	if !reserved {
+		t.Fatal("expected cached response to expire")
+	}
+	if len(cache.entries) != 1 || len(cache.queue) != 1 {
+		t.Fatal("expected the expired entry to be evicted")
+	}
+}
+
+func TestIdempotencyCacheDropsFailures(t *testing.T) {
+	cache := NewIdempotencyCache(time.Minute)
+
+	id, entry, _ := cache.reserve([]byte("key"), []byte("request"))
+	cache.finish(id, entry, nil, nil, ErrUnknownTokenKey)
+	if _, _, reserved := cache.reserve([]byte("key"), []byte("request")); !reserved {
+		t.Fatal("expected a failed evaluation not to be cached")
+	}
+}
+
+func TestIdempotencyCacheMaxEntries(t *testing.T) {
+	cache := NewIdempotencyCacheWithSize(time.Minute, 2)
+
+	for _, key := range []string{"a", "b", "c"} {
+		id, entry, reserved := cache.reserve([]byte(key), []byte("request"))
+		if !reserved {
+			t.Fatalf("expected a new entry for %s", key)
+		}
+		cache.finish(id, entry, []byte("response"), []byte("blinded"), nil)
+	}
+	if len(cache.entries) != 2 || len(cache.queue) != 2 {
+		t.Fatalf("expected 2 entries, got %d entries and %d queued", len(cache.entries), len(cache.queue))
+	}
+
+	// The oldest entry was evicted, the newer ones are still cached
+	if _, _, reserved := cache.reserve([]byte("c"), []byte("request")); reserved {
+		t.Fatal("expected the newest entry to be cached")
+	}
+	if _, _, reserved := cache.reserve([]byte("a"), []byte("request")); !reserved {
+		t.Fatal("expected the oldest entry to be evicted")
+	}
+
+	// Items left behind by failed evaluations count towards the bound too
+	for n := 0; n < 8; n++ {
+		id, entry, _ := cache.reserve([]byte{byte(n)}, []byte("request"))
+		cache.finish(id, entry, nil, nil, ErrUnknownTokenKey)
+	}
+	if len(cache.queue) > 2 {
+		t.Fatalf("expected at most 2 queued items, got %d", len(cache.queue))
+	}
+}
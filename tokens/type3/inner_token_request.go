@@ -25,19 +25,30 @@ func (r *InnerTokenRequest) Marshal() []byte {
 	return r.raw
 }
 
+// Unmarshal decodes an origin token request encoded by Marshal, whose blinded
+// message must be BlindedMessageSize bytes. Truncated inputs and trailing data
+// are rejected.
 func (r *InnerTokenRequest) Unmarshal(data []byte) bool {
+	return r.unmarshal(data, BlindedMessageSize)
+}
+
+// unmarshal is Unmarshal for a blinded message of blindedMsgSize bytes, the
+// length of the token key modulus.
+func (r *InnerTokenRequest) unmarshal(data []byte, blindedMsgSize int) bool {
 	s := cryptobyte.String(data)
 
-	if !s.ReadUint8(&r.tokenKeyId) || !s.ReadBytes(&r.blindedMsg, 256) {
+	if !s.ReadUint8(&r.tokenKeyId) || !s.ReadBytes(&r.blindedMsg, blindedMsgSize) {
 		return false
 	}
 
 	var paddedOriginName cryptobyte.String
-	if !s.ReadUint16LengthPrefixed(&paddedOriginName) {
+	if !s.ReadUint16LengthPrefixed(&paddedOriginName) || !s.Empty() {
 		return false
 	}
 	r.paddedOrigin = make([]byte, len(paddedOriginName))
 	copy(r.paddedOrigin, paddedOriginName)
 
+	// Drop any encoding cached by Marshal before the request was overwritten
+	r.raw = nil
 	return true
 }
@@ -1,96 +1,700 @@
 package type3
 
 import (
+	"context"
 	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/sha512"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	hpke "github.com/cisco/go-hpke"
 	"github.com/cloudflare/circl/blindsign/blindrsa"
 	"github.com/cloudflare/pat-go/ecdsa"
-	"github.com/cloudflare/pat-go/util"
 	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/curve25519"
+)
+
+var (
+	ErrMalformedRequest     = errors.New("malformed request")
+	ErrUnknownOrigin        = errors.New("unknown origin")
+	ErrUnknownNameKey       = errors.New("unknown name key")
+	ErrNameKeyRetired       = errors.New("name key retired")
+	ErrNameKeyIDInUse       = errors.New("name key id already in use")
+	ErrRetireCurrentNameKey = errors.New("cannot retire the current name key")
+	ErrKeySizeMismatch      = errors.New("blinded message length does not match token key size")
+	ErrPolicyRejected       = errors.New("issuance rejected by origin policy")
+	ErrOriginNotAllowed     = errors.New("origin name not allowed")
+	ErrInvalidOriginName    = errors.New("invalid origin name")
+	ErrBadBlindedMessage    = errors.New("blinded message out of range")
+	ErrInvalidEnc           = errors.New("invalid encapsulated key")
+
+	ErrMalformedOriginTokenRequest = errors.New("malformed origin token request")
+	ErrOriginsRegistered           = errors.New("origins already registered")
 )
 
 type RateLimitedIssuer struct {
 	curve           elliptic.Curve
 	nameKey         PrivateEncapKey
-	tokenKey        *rsa.PrivateKey
+	nameKeys        map[string]PrivateEncapKey // map from name key config ID to name key
+	retiredNameKeys map[string]struct{}        // config IDs of retired name keys
+	nameKeyMu       sync.RWMutex               // guards nameKey, nameKeys, and retiredNameKeys
+	tokenKey        *rsa.PrivateKey            // current token key, advertised to clients
+	tokenKeys       map[string]*rsa.PrivateKey // map from full token key ID to token key
+	tokenKeyMu      sync.RWMutex               // guards tokenKey and tokenKeys
 	originIndexKeys map[string]*ecdsa.PrivateKey
+	originKeyMu     sync.RWMutex
+	originKeys      OriginKeyProvider
+	originPattern   *regexp.Regexp
+	normalizeOrigin OriginNormalizer
+	variant         BlindRSAVariant
+	saltLength      int
+
+	idempotencyCache *IdempotencyCache
+	auditLog         *AuditLog
+	blindedMessages  BlindedMessageTracker
+	originPolicy     OriginPolicy
+	phaseTimer       PhaseTimer
+	errorLog         *log.Logger
+
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	rejectBatchDuplicates bool
+
+	deterministicNonceKey []byte
 }
 
-func NewRateLimitedIssuer(key *rsa.PrivateKey) *RateLimitedIssuer {
-	suite, err := hpke.AssembleCipherSuite(hpke.DHKEM_X25519, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM128)
-	if err != nil {
-		return nil
-	}
+// nameKeyRandReader is the source of name key material, replaced in tests.
+var nameKeyRandReader io.Reader = rand.Reader
 
+func generatePrivateEncapKey(id uint8, suite hpke.CipherSuite) (PrivateEncapKey, error) {
 	ikm := make([]byte, suite.KEM.PrivateKeySize())
-	rand.Reader.Read(ikm)
+	if _, err := io.ReadFull(nameKeyRandReader, ikm); err != nil {
+		return PrivateEncapKey{}, fmt.Errorf("failed to generate name key: %w", err)
+	}
 	privateKey, publicKey, err := suite.KEM.DeriveKeyPair(ikm)
 	if err != nil {
-		return nil
+		return PrivateEncapKey{}, fmt.Errorf("failed to derive name key: %w", err)
 	}
 
-	nameKey := PrivateEncapKey{
-		id:         0x00,
+	return PrivateEncapKey{
+		id:         id,
 		suite:      suite,
 		publicKey:  publicKey,
 		privateKey: privateKey,
+	}, nil
+}
+
+func nameKeyConfigID(nameKey EncapKey) []byte {
+	configID := sha256.Sum256(nameKey.Marshal())
+	return configID[:]
+}
+
+// NewRateLimitedIssuer returns an issuer for the token key with a fresh name
+// key for the default HPKE suite, DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, and
+// AES-128-GCM. The key may be nil if it is set later with SetTokenKey.
+func NewRateLimitedIssuer(key *rsa.PrivateKey) (*RateLimitedIssuer, error) {
+	suite, err := hpke.AssembleCipherSuite(fixedKEM, fixedKDF, fixedAEAD)
+	if err != nil {
+		return nil, err
+	}
+	return NewRateLimitedIssuerWithSuite(key, suite)
+}
+
+// NewRateLimitedIssuerWithSuite is NewRateLimitedIssuer with a name key for the
+// given HPKE suite, e.g., to use a NIST curve KEM or ChaCha20-Poly1305 where
+// policy requires it. The suite IDs are part of the name key encoding, so
+// clients encrypt to the same suite without further configuration. Name keys
+// created by RotateNameKey use the same suite.
+func NewRateLimitedIssuerWithSuite(key *rsa.PrivateKey, suite hpke.CipherSuite) (*RateLimitedIssuer, error) {
+	if suite.KEM == nil || suite.KDF == nil || suite.AEAD == nil {
+		return nil, fmt.Errorf("incomplete HPKE suite")
+	}
+	suite, err := assembleSuite(suite.KEM.ID(), suite.KDF.ID(), suite.AEAD.ID())
+	if err != nil {
+		return nil, err
+	}
+
+	nameKey, err := generatePrivateEncapKey(0x00, suite)
+	if err != nil {
+		return nil, err
 	}
 
-	return &RateLimitedIssuer{
-		curve:           elliptic.P384(),
-		nameKey:         nameKey,
+	issuer := &RateLimitedIssuer{
+		curve:   elliptic.P384(),
+		nameKey: nameKey,
+		nameKeys: map[string]PrivateEncapKey{
+			string(nameKeyConfigID(nameKey.Public())): nameKey,
+		},
+		retiredNameKeys: make(map[string]struct{}),
 		tokenKey:        key,
+		tokenKeys:       make(map[string]*rsa.PrivateKey),
 		originIndexKeys: make(map[string]*ecdsa.PrivateKey),
+		variant:         BlindRSAVariantPSS,
+		saltLength:      RateLimitedParams().SaltLength,
+		ready:           make(chan struct{}),
+	}
+	issuer.registerTokenKey(key)
+	return issuer, nil
+}
+
+// SetSaltLength sets the PSS salt length, in bytes, that clients must use for
+// token authenticators. Blind signing does not reveal the salt to the issuer,
+// so this is the expectation the issuer advertises to clients and validates
+// against its token key in ValidateConfig, not a per-request check.
+func (i *RateLimitedIssuer) SetSaltLength(saltLength int) {
+	i.saltLength = saltLength
+}
+
+func (i *RateLimitedIssuer) SaltLength() int {
+	return i.saltLength
+}
+
+// SetBlindRSAVariant sets the blind RSA variant that clients must use for token
+// authenticators. Like the salt length, it is advertised rather than enforced:
+// the blind signing operation is the same for every variant.
+func (i *RateLimitedIssuer) SetBlindRSAVariant(variant BlindRSAVariant) {
+	i.variant = variant
+}
+
+func (i *RateLimitedIssuer) BlindRSAVariant() BlindRSAVariant {
+	return i.variant
+}
+
+// SetRequestKeyCurve sets the curve of client request keys and origin index
+// keys, P-384 by default, to another curve supported by
+// RateLimitedParamsForCurve. Index keys are generated on this curve, so it must
+// be set before any origin is added; it fails with ErrOriginsRegistered after.
+// Clients must use the same curve (see
+// NewRateLimitedClientFromSecretWithCurve), as it determines the request
+// encoding.
+func (i *RateLimitedIssuer) SetRequestKeyCurve(curve elliptic.Curve) error {
+	if err := checkRequestKeyCurve(curve); err != nil {
+		return err
 	}
+
+	i.originKeyMu.Lock()
+	defer i.originKeyMu.Unlock()
+	if len(i.originIndexKeys) > 0 || i.originKeys != nil {
+		return ErrOriginsRegistered
+	}
+	i.curve = curve
+	return nil
+}
+
+// RequestKeyCurve returns the curve of client request keys.
+func (i *RateLimitedIssuer) RequestKeyCurve() elliptic.Curve {
+	return i.curve
 }
 
 func (i *RateLimitedIssuer) NameKey() EncapKey {
+	i.nameKeyMu.RLock()
+	defer i.nameKeyMu.RUnlock()
 	return i.nameKey.Public()
 }
 
+// currentNameKey returns the current private name key.
+func (i *RateLimitedIssuer) currentNameKey() PrivateEncapKey {
+	i.nameKeyMu.RLock()
+	defer i.nameKeyMu.RUnlock()
+	return i.nameKey
+}
+
+// nameKeyIDInUseLocked reports whether a name key uses id. It must be called
+// with nameKeyMu held.
+func (i *RateLimitedIssuer) nameKeyIDInUseLocked(id uint8) bool {
+	for _, nameKey := range i.nameKeys {
+		if nameKey.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// SetNameKeyID changes the id of the current name key. The id is part of the
+// name key configuration, so this also changes the name key ID that clients
+// commit to in their requests. It fails if another name key already uses id.
+func (i *RateLimitedIssuer) SetNameKeyID(id uint8) error {
+	i.nameKeyMu.Lock()
+	defer i.nameKeyMu.Unlock()
+	if id == i.nameKey.id {
+		return nil
+	}
+	if i.nameKeyIDInUseLocked(id) {
+		return ErrNameKeyIDInUse
+	}
+
+	delete(i.nameKeys, string(nameKeyConfigID(i.nameKey.Public())))
+	i.nameKey.id = id
+	i.nameKeys[string(nameKeyConfigID(i.nameKey.Public()))] = i.nameKey
+
+	return nil
+}
+
+// RotateNameKey generates a new name key with the given id, using the same
+// HPKE suite as the current name key, and makes it the current name key.
+// Previous name keys remain valid for decrypting requests. Name keys can be
+// rotated and retired while the issuer serves requests.
+func (i *RateLimitedIssuer) RotateNameKey(id uint8) (EncapKey, error) {
+	i.nameKeyMu.Lock()
+	defer i.nameKeyMu.Unlock()
+	if i.nameKeyIDInUseLocked(id) {
+		return EncapKey{}, ErrNameKeyIDInUse
+	}
+
+	nameKey, err := generatePrivateEncapKey(id, i.nameKey.suite)
+	if err != nil {
+		return EncapKey{}, err
+	}
+
+	i.nameKey = nameKey
+	i.nameKeys[string(nameKeyConfigID(nameKey.Public()))] = nameKey
+
+	return nameKey.Public(), nil
+}
+
+// RetireNameKey discards the previous name key with the given id. Requests
+// encrypted to it are then rejected with ErrNameKeyRetired, telling clients to
+// refresh the issuer configuration. The current name key cannot be retired;
+// rotate it first.
+func (i *RateLimitedIssuer) RetireNameKey(id uint8) error {
+	i.nameKeyMu.Lock()
+	defer i.nameKeyMu.Unlock()
+	if id == i.nameKey.id {
+		return ErrRetireCurrentNameKey
+	}
+	for configID, nameKey := range i.nameKeys {
+		if nameKey.id == id {
+			delete(i.nameKeys, configID)
+			i.retiredNameKeys[configID] = struct{}{}
+			return nil
+		}
+	}
+	return ErrUnknownNameKey
+}
+
+// SetIdempotencyCache configures the cache that EvaluateContext, and thus
+// Evaluate and HTTPHandler, answer retried requests carrying an idempotency key
+// from. Batches are not looked up in the cache.
+func (i *RateLimitedIssuer) SetIdempotencyCache(cache *IdempotencyCache) {
+	i.idempotencyCache = cache
+}
+
+// SetAuditLog configures the log that Evaluate appends an entry to for every
+// request it accepts or rejects. A response is withheld if its entry cannot be
+// written.
+func (i *RateLimitedIssuer) SetAuditLog(log *AuditLog) {
+	i.auditLog = log
+}
+
+// SetBlindedMessageTracker configures the tracker Evaluate uses to reject a
+// blinded message that was already submitted for a different origin.
+func (i *RateLimitedIssuer) SetBlindedMessageTracker(tracker BlindedMessageTracker) {
+	i.blindedMessages = tracker
+}
+
+// OriginPolicy decides whether the issuer may currently issue tokens for a
+// registered origin. A non-nil error rejects the request; a positive retryAfter
+// tells the client how long to wait before trying again, e.g., during
+// maintenance.
+type OriginPolicy func(originName string) (retryAfter time.Duration, err error)
+
+// PolicyError is returned by Evaluate when the origin policy rejects a request.
+// It matches ErrPolicyRejected and the error returned by the policy.
+type PolicyError struct {
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrPolicyRejected, e.Err)
+}
+
+func (e *PolicyError) Unwrap() error {
+	return e.Err
+}
+
+func (e *PolicyError) Is(target error) bool {
+	return target == ErrPolicyRejected
+}
+
+// SetOriginPolicy configures the policy Evaluate consults for every request to
+// a registered origin before signing it. A nil policy allows all requests.
+func (i *RateLimitedIssuer) SetOriginPolicy(policy OriginPolicy) {
+	i.originPolicy = policy
+}
+
+// SetDeterministicResponseNonceKey makes Evaluate derive the response nonce
+// as HMAC-SHA384(key, request) instead of sampling it, so the same request
+// always produces byte-identical responses. This makes the nonce predictable
+// to anyone who knows the key, and repeats it for repeated requests, so it
+// must only be used to generate test vectors, never in production. A nil key
+// restores random nonces.
+func (i *RateLimitedIssuer) SetDeterministicResponseNonceKey(key []byte) {
+	i.deterministicNonceKey = key
+}
+
+func (i *RateLimitedIssuer) responseNonce(rng io.Reader, encodedRequest []byte, responseNonceLen int) ([]byte, error) {
+	if i.deterministicNonceKey == nil {
+		responseNonce := make([]byte, responseNonceLen)
+		if _, err := io.ReadFull(rng, responseNonce); err != nil {
+			return nil, err
+		}
+		return responseNonce, nil
+	}
+
+	mac := hmac.New(sha512.New384, i.deterministicNonceKey)
+	mac.Write(encodedRequest)
+	digest := mac.Sum(nil)
+	if responseNonceLen > len(digest) {
+		return nil, fmt.Errorf("response nonce length %d exceeds deterministic nonce size", responseNonceLen)
+	}
+	return digest[:responseNonceLen], nil
+}
+
+// OriginKeyProvider resolves origin index keys on demand, e.g., from a database,
+// for origins that were not registered with AddOrigin.
+//
+// Index keys determine the anonymous issuer origin ID of every client, so a
+// provider must return the same key for a given origin on every issuer replica
+// and for the lifetime of the origin. Keys returned by the provider are cached
+// by the issuer and never refreshed.
+//
+// The cache is unbounded: every origin the provider resolves stays in memory,
+// and is listed by ListOrigins and exported by ExportOriginKeys, until it is
+// dropped with RemoveOrigin. Request origins are chosen by clients, so a
+// provider should only resolve origins the issuer actually serves, and report
+// false for any other name.
+type OriginKeyProvider interface {
+	IndexKey(origin string) (*ecdsa.PrivateKey, bool)
+}
+
+// SetOriginKeyProvider configures the provider consulted for unregistered origins.
+func (i *RateLimitedIssuer) SetOriginKeyProvider(provider OriginKeyProvider) {
+	i.originKeyMu.Lock()
+	defer i.originKeyMu.Unlock()
+	i.originKeys = provider
+	i.markReadyLocked()
+}
+
+// SetOriginPattern restricts the origin names that AddOrigin and
+// AddOriginWithIndexKey accept to those matching pattern, e.g., to the
+// operator's own domains. Go regular expressions match substrings, so pattern
+// should be anchored with ^ and $. A nil pattern allows all names. Origins that
+// were already registered are not affected.
+func (i *RateLimitedIssuer) SetOriginPattern(pattern *regexp.Regexp) {
+	i.originKeyMu.Lock()
+	defer i.originKeyMu.Unlock()
+	i.originPattern = pattern
+}
+
+// OriginNormalizer maps an origin name to the form under which it is
+// registered and looked up, e.g., lowercasing it or stripping a port. It must
+// be idempotent, and it fails if the name cannot be normalized.
+type OriginNormalizer func(origin string) (string, error)
+
+// SetOriginNormalizer configures the normalizer applied to origin names passed
+// to AddOrigin and the other origin methods, and to the origin names decrypted
+// by Evaluate and ResolveOrigin. A nil normalizer uses names as is. Origins that
+// were already registered are not renormalized.
+//
+// Clients must normalize origin names the same way (see
+// RateLimitedClient.WithOriginNormalizer), otherwise lookups of their origins
+// fail with ErrUnknownOrigin. Since normalizers are idempotent, normalizing the
+// decrypted names again is a no-op for names the client already normalized.
+func (i *RateLimitedIssuer) SetOriginNormalizer(normalize OriginNormalizer) {
+	i.originKeyMu.Lock()
+	defer i.originKeyMu.Unlock()
+	i.normalizeOrigin = normalize
+}
+
+// normalizeOriginName applies the configured OriginNormalizer, if any.
+func (i *RateLimitedIssuer) normalizeOriginName(origin string) (string, error) {
+	i.originKeyMu.RLock()
+	normalize := i.normalizeOrigin
+	i.originKeyMu.RUnlock()
+	return applyOriginNormalizer(normalize, origin)
+}
+
+// requestOriginName recovers the normalized origin name from the padded origin
+// name of a token request. The name is chosen by the client, so errors do not
+// include it, keeping it out of anything that logs them.
+func (i *RateLimitedIssuer) requestOriginName(paddedOrigin []byte) (string, error) {
+	originName, err := i.normalizeOriginName(unpadOriginName(paddedOrigin))
+	if err != nil {
+		return "", ErrInvalidOriginName
+	}
+	return originName, nil
+}
+
+func applyOriginNormalizer(normalize OriginNormalizer, origin string) (string, error) {
+	if normalize == nil {
+		return origin, nil
+	}
+	normalized, err := normalize(origin)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %v", ErrInvalidOriginName, origin, err)
+	}
+	return normalized, nil
+}
+
 func (i *RateLimitedIssuer) AddOrigin(origin string) error {
 	privateKey, err := ecdsa.GenerateKey(i.curve, rand.Reader)
 	if err != nil {
 		return err
 	}
 
-	i.originIndexKeys[origin] = privateKey
+	return i.AddOriginWithIndexKey(origin, privateKey)
+}
 
-	return nil
+// AddOriginWithKey registers origin with the index key for the big-endian
+// scalar, which must be exactly the scalar size of the request key curve and
+// in [1, N-1]. Issuer replicas behind a load balancer must share each origin's
+// index key, or clients get a different index from each replica; seeding them
+// with the same scalar does that. Invalid scalars fail with ErrInvalidIndexKey.
+func (i *RateLimitedIssuer) AddOriginWithKey(origin string, scalar []byte) error {
+	privateKey, err := i.parseOriginIndexKey(scalar)
+	if err != nil {
+		return err
+	}
+
+	return i.AddOriginWithIndexKey(origin, privateKey)
 }
 
 func (i *RateLimitedIssuer) AddOriginWithIndexKey(origin string, privateKey *ecdsa.PrivateKey) error {
+	origin, err := i.normalizeOriginName(origin)
+	if err != nil {
+		return err
+	}
+
+	i.originKeyMu.Lock()
+	defer i.originKeyMu.Unlock()
+	if i.originPattern != nil && !i.originPattern.MatchString(origin) {
+		return fmt.Errorf("%w: %s", ErrOriginNotAllowed, origin)
+	}
+	if privateKey != nil && privateKey.Curve != nil && privateKey.Curve.Params().Name != i.curve.Params().Name {
+		return fmt.Errorf("%w: index key on %s, expected %s", ErrUnsupportedCurve, privateKey.Curve.Params().Name, i.curve.Params().Name)
+	}
 	i.originIndexKeys[origin] = privateKey
+	i.markReadyLocked()
 	return nil
 }
 
-func (i *RateLimitedIssuer) OriginIndexKey(origin string) *ecdsa.PrivateKey {
+// IsConfigured reports whether at least one origin is registered with the
+// issuer, or an OriginKeyProvider is configured to resolve origins on demand.
+func (i *RateLimitedIssuer) IsConfigured() bool {
+	i.originKeyMu.RLock()
+	defer i.originKeyMu.RUnlock()
+	return i.isConfiguredLocked()
+}
+
+func (i *RateLimitedIssuer) isConfiguredLocked() bool {
+	return len(i.originIndexKeys) > 0 || i.originKeys != nil
+}
+
+// lookupOriginIndexKey returns the index key for origin, consulting and caching
+// the result of the OriginKeyProvider, if any, when origin is not registered.
+func (i *RateLimitedIssuer) lookupOriginIndexKey(origin string) (*ecdsa.PrivateKey, bool) {
+	i.originKeyMu.RLock()
 	key, ok := i.originIndexKeys[origin]
+	provider := i.originKeys
+	i.originKeyMu.RUnlock()
+	if ok || provider == nil {
+		return key, ok
+	}
+
+	key, ok = provider.IndexKey(origin)
+	if !ok {
+		return nil, false
+	}
+
+	i.originKeyMu.Lock()
+	defer i.originKeyMu.Unlock()
+	if cachedKey, ok := i.originIndexKeys[origin]; ok {
+		return cachedKey, true
+	}
+	i.originIndexKeys[origin] = key
+
+	return key, true
+}
+
+func (i *RateLimitedIssuer) OriginIndexKey(origin string) *ecdsa.PrivateKey {
+	origin, err := i.normalizeOriginName(origin)
+	if err != nil {
+		return nil
+	}
+	key, ok := i.lookupOriginIndexKey(origin)
 	if !ok {
 		return nil
 	}
 	return key
 }
 
+// RemoveOrigin deregisters origin and discards its index key, so that requests
+// for it fail with ErrUnknownOrigin. If an OriginKeyProvider is configured,
+// this only drops the cached key, and the provider is consulted again on the
+// next request for origin. It fails with ErrUnknownOrigin if origin is not
+// registered.
+func (i *RateLimitedIssuer) RemoveOrigin(origin string) error {
+	origin, err := i.normalizeOriginName(origin)
+	if err != nil {
+		return err
+	}
+
+	i.originKeyMu.Lock()
+	defer i.originKeyMu.Unlock()
+	if _, ok := i.originIndexKeys[origin]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownOrigin, origin)
+	}
+	delete(i.originIndexKeys, origin)
+	return nil
+}
+
+// ListOrigins returns the registered origins in sorted order, including those
+// whose index keys were resolved and cached from the OriginKeyProvider.
+func (i *RateLimitedIssuer) ListOrigins() []string {
+	i.originKeyMu.RLock()
+	defer i.originKeyMu.RUnlock()
+	origins := make([]string, 0, len(i.originIndexKeys))
+	for origin := range i.originIndexKeys {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+	return origins
+}
+
+// OriginIndexPublicKey returns the public index key for origin, i.e., the
+// generator blinded by the origin's index key. Clients use it with
+// RateLimitedClient.PredictIndex to compute the index the attester will see.
+func (i *RateLimitedIssuer) OriginIndexPublicKey(origin string) ([]byte, error) {
+	origin, err := i.normalizeOriginName(origin)
+	if err != nil {
+		return nil, err
+	}
+	originIndexKey, ok := i.lookupOriginIndexKey(origin)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownOrigin, origin)
+	}
+
+	generator := &ecdsa.PublicKey{
+		Curve: i.curve,
+		X:     i.curve.Params().Gx,
+		Y:     i.curve.Params().Gy,
+	}
+	publicKey, err := ecdsa.BlindPublicKeyWithContext(i.curve, generator, originIndexKey, blindContext(labelIssuerBlind))
+	if err != nil {
+		return nil, err
+	}
+
+	return elliptic.MarshalCompressed(i.curve, publicKey.X, publicKey.Y), nil
+}
+
+// TokenKey returns the public key of the current token key, or nil if the
+// issuer has none (see SetTokenKey).
 func (i *RateLimitedIssuer) TokenKey() *rsa.PublicKey {
-	return &i.tokenKey.PublicKey
+	tokenKey := i.currentTokenKey()
+	if tokenKey == nil {
+		return nil
+	}
+	return &tokenKey.PublicKey
 }
 
+// TokenKeyID returns the full key ID of the token key (see FullKeyID). Origin
+// token requests only carry its first byte (see WireKeyID). It returns nil if
+// the issuer has no token key, or one that cannot be encoded.
 func (i *RateLimitedIssuer) TokenKeyID() []byte {
-	publicKey := i.TokenKey()
-	publicKeyEnc, err := util.MarshalTokenKeyPSSOID(publicKey)
+	tokenKey := i.TokenKey()
+	if tokenKey == nil || tokenKey.N == nil {
+		return nil
+	}
+	keyID, err := FullKeyID(tokenKey)
 	if err != nil {
-		panic(err)
+		return nil
 	}
-	keyID := sha256.Sum256(publicKeyEnc)
-	return keyID[:]
+	return keyID
+}
+
+// ConfigErrors aggregates every problem found by ValidateConfig.
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "invalid issuer configuration: " + strings.Join(msgs, "; ")
+}
+
+func (e ConfigErrors) Unwrap() []error {
+	return e
+}
+
+// Is reports whether any of the aggregated errors matches target, for
+// toolchains whose errors.Is does not follow Unwrap() []error.
+func (e ConfigErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateConfig checks the token key, name key, and origin configuration of
+// the issuer, returning a ConfigErrors value listing every problem found, or
+// nil if the issuer is ready to serve requests.
+func (i *RateLimitedIssuer) ValidateConfig() error {
+	var errs ConfigErrors
+
+	tokenKey := i.currentTokenKey()
+	if tokenKey == nil {
+		errs = append(errs, fmt.Errorf("missing token key"))
+	} else {
+		if err := tokenKey.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid token key: %w", err))
+		}
+		if tokenKey.N != nil {
+			if err := checkTokenKeySize(&tokenKey.PublicKey); err != nil {
+				errs = append(errs, err)
+			}
+			if _, err := variantSaltLength(&tokenKey.PublicKey, i.variant, i.saltLength); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	nameKey := i.currentNameKey()
+	if nameKey.suite.KEM == nil || nameKey.suite.KDF == nil || nameKey.suite.AEAD == nil {
+		errs = append(errs, fmt.Errorf("missing name key suite"))
+	} else {
+		if _, err := hpke.AssembleCipherSuite(nameKey.suite.KEM.ID(), nameKey.suite.KDF.ID(), nameKey.suite.AEAD.ID()); err != nil {
+			errs = append(errs, fmt.Errorf("unsupported name key suite: %w", err))
+		}
+		if nameKey.privateKey == nil || nameKey.publicKey == nil {
+			errs = append(errs, fmt.Errorf("missing name key"))
+		}
+	}
+
+	if !i.IsConfigured() {
+		errs = append(errs, fmt.Errorf("no origins registered"))
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
 func max(a, b int) int {
@@ -100,19 +704,40 @@ func max(a, b int) int {
 	return b
 }
 
-func decryptOriginTokenRequest(nameKey PrivateEncapKey, requestKey []byte, encryptedTokenRequest []byte) (InnerTokenRequest, []byte, error) {
-	issuerConfigID := sha256.Sum256(nameKey.Public().Marshal())
+// checkEnc checks that the encrypted token request starts with an
+// encapsulated key that decodes as a public key of the suite's KEM, so that a
+// malformed one is reported as such rather than as an opaque HPKE error. Any
+// 32 bytes decode as an X25519 public key, so for that KEM it also rejects the
+// low-order points, for which the shared secret would be zero.
+func checkEnc(suite hpke.CipherSuite, encryptedTokenRequest []byte) error {
+	encLen := suite.KEM.PublicKeySize()
+	if len(encryptedTokenRequest) < encLen {
+		return fmt.Errorf("%w: %d bytes, expected %d", ErrInvalidEnc, len(encryptedTokenRequest), encLen)
+	}
+	enc := encryptedTokenRequest[:encLen]
+	if _, err := suite.KEM.DeserializePublicKey(enc); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEnc, err)
+	}
+	if suite.KEM.ID() == hpke.DHKEM_X25519 {
+		// Clamped scalars clear the cofactor, so any scalar maps a low-order
+		// point to zero
+		if _, err := curve25519.X25519(curve25519.Basepoint, enc); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidEnc, err)
+		}
+	}
+	return nil
+}
+
+// decryptOriginTokenRequest decrypts the origin token request and parses it
+// with the first of blindedMsgSizes that fits, one per token key size the
+// issuer holds.
+func decryptOriginTokenRequest(nameKey PrivateEncapKey, requestKey []byte, encryptedTokenRequest []byte, blindedMsgSizes ...int) (InnerTokenRequest, []byte, error) {
+	if err := checkEnc(nameKey.suite, encryptedTokenRequest); err != nil {
+		return InnerTokenRequest{}, nil, err
+	}
 
 	// Decrypt the origin name
-	b := cryptobyte.NewBuilder(nil)
-	b.AddUint8(nameKey.id)
-	b.AddUint16(uint16(nameKey.suite.KEM.ID()))
-	b.AddUint16(uint16(nameKey.suite.KDF.ID()))
-	b.AddUint16(uint16(nameKey.suite.AEAD.ID()))
-	b.AddUint16(RateLimitedTokenType)
-	b.AddBytes(requestKey)
-	b.AddBytes(issuerConfigID[:])
-	aad := b.BytesOrPanic()
+	aad := originTokenRequestAAD(nameKey.Public(), requestKey)
 
 	enc := encryptedTokenRequest[0:nameKey.suite.KEM.PublicKeySize()]
 	ct := encryptedTokenRequest[nameKey.suite.KEM.PublicKeySize():]
@@ -128,7 +753,23 @@ func decryptOriginTokenRequest(nameKey PrivateEncapKey, requestKey []byte, encry
 	}
 
 	tokenRequest := &InnerTokenRequest{}
-	if !tokenRequest.Unmarshal(tokenRequestEnc) {
+	parsed := false
+	for _, blindedMsgSize := range blindedMsgSizes {
+		if tokenRequest.unmarshal(tokenRequestEnc, blindedMsgSize) {
+			parsed = true
+			break
+		}
+	}
+	if !parsed {
+		// Tell clients using a token key of another size apart from garbage
+		for _, kLen := range supportedTokenKeyLens {
+			if new(InnerTokenRequest).unmarshal(tokenRequestEnc, kLen) {
+				return InnerTokenRequest{}, nil, fmt.Errorf("%w: expected %v bytes, got %d", ErrKeySizeMismatch, blindedMsgSizes, kLen)
+			}
+		}
+		return InnerTokenRequest{}, nil, ErrMalformedOriginTokenRequest
+	}
+	if err := validatePadding(tokenRequest.paddedOrigin); err != nil {
 		return InnerTokenRequest{}, nil, err
 	}
 
@@ -137,30 +778,153 @@ func decryptOriginTokenRequest(nameKey PrivateEncapKey, requestKey []byte, encry
 	return *tokenRequest, secret, err
 }
 
+// Evaluate cannot enforce challenge expiry: the challenge digest is part of the
+// blinded token input, so the issuer never learns it. Expiring challenges are
+// checked by the client and by the origin at redemption instead.
+//
 // https://ietf-wg-privacypass.github.io/draft-ietf-privacypass-rate-limit-tokens/draft-ietf-privacypass-rate-limit-tokens.html#name-issuer-to-attester-response
-func (i RateLimitedIssuer) Evaluate(encodedRequest []byte) ([]byte, []byte, error) {
+func (i *RateLimitedIssuer) Evaluate(encodedRequest []byte) ([]byte, []byte, error) {
+	return i.EvaluateContext(context.Background(), encodedRequest)
+}
+
+// EvaluateContext behaves like Evaluate, but gives up with ctx.Err() if ctx is
+// done before the request is blind signed, the expensive part of evaluation.
+// Once signing has started the evaluation runs to completion. Cancelled
+// evaluations are recorded in the audit log as rejected.
+//
+// If the issuer has an IdempotencyCache (see SetIdempotencyCache) and the
+// request carries an idempotency key (see SetIdempotencyKey), the response is
+// cached and returned verbatim if the same request is retried with the same
+// key before the cache entry expires, so a retry does not consume another
+// issuance. A retry that arrives while the first evaluation is running waits
+// for its result. A key reused for a different request does not match the
+// cached entry and is evaluated as a new request. Failed evaluations are not
+// cached.
+func (i *RateLimitedIssuer) EvaluateContext(ctx context.Context, encodedRequest []byte) ([]byte, []byte, error) {
+	if i.idempotencyCache != nil {
+		req := &RateLimitedTokenRequest{}
+		if req.UnmarshalForCurve(i.curve, encodedRequest) && len(req.IdempotencyKey) > 0 {
+			return i.evaluateIdempotent(ctx, req.IdempotencyKey, encodedRequest)
+		}
+	}
+	return i.evaluateAudited(ctx, rand.Reader, encodedRequest)
+}
+
+// EvaluateWithRandom behaves like Evaluate, but draws the response nonce from
+// rng instead of crypto/rand, unless a deterministic response nonce key is set
+// (see SetDeterministicResponseNonceKey). The blind RSA signature itself is
+// deterministic. With a seeded rng the response is byte-identical across runs,
+// which is meant for generating test vectors only.
+func (i *RateLimitedIssuer) EvaluateWithRandom(rng io.Reader, encodedRequest []byte) ([]byte, []byte, error) {
+	return i.evaluateAudited(context.Background(), rng, encodedRequest)
+}
+
+func (i *RateLimitedIssuer) evaluateAudited(ctx context.Context, rng io.Reader, encodedRequest []byte) ([]byte, []byte, error) {
+	response, blindedRequestKeyEnc, originName, tokenKeyID, err := i.evaluate(ctx, rng, encodedRequest)
+	if logErr := i.audit(originName, tokenKeyID, err); logErr != nil {
+		return nil, nil, logErr
+	}
+	return response, blindedRequestKeyEnc, err
+}
+
+// audit records the outcome of evaluating a request for originName with the
+// token key identified by tokenKeyID in the audit log, if any. tokenKeyID is nil
+// if the request was rejected before a token key was selected. It returns an error if the entry for a successful
+// evaluation cannot be written, in which case the response must be withheld.
+func (i *RateLimitedIssuer) audit(originName string, tokenKeyID []byte, evalErr error) error {
+	if i.auditLog == nil {
+		return nil
+	}
+	outcome := AuditOutcomeIssued
+	if evalErr != nil {
+		outcome = AuditOutcomeRejected
+	}
+	if logErr := i.auditLog.append(originName, tokenKeyID, outcome); logErr != nil && evalErr == nil {
+		return fmt.Errorf("failed to write audit log: %w", logErr)
+	}
+	return nil
+}
+
+// decryptRequest selects the name key the request was encrypted to and
+// decrypts the origin token request.
+func (i *RateLimitedIssuer) decryptRequest(req *RateLimitedTokenRequest) (PrivateEncapKey, InnerTokenRequest, []byte, error) {
+	i.nameKeyMu.RLock()
+	nameKey, ok := i.nameKeys[string(req.NameKeyID)]
+	_, retired := i.retiredNameKeys[string(req.NameKeyID)]
+	i.nameKeyMu.RUnlock()
+	if !ok {
+		if retired {
+			return PrivateEncapKey{}, InnerTokenRequest{}, nil, ErrNameKeyRetired
+		}
+		return PrivateEncapKey{}, InnerTokenRequest{}, nil, ErrUnknownNameKey
+	}
+
+	// Blinded messages are as long as the token key modulus
+	originTokenRequest, secret, err := decryptOriginTokenRequest(nameKey, req.RequestKey, req.EncryptedTokenRequest, i.tokenKeyLens()...)
+	if err != nil {
+		return PrivateEncapKey{}, InnerTokenRequest{}, nil, err
+	}
+	return nameKey, originTokenRequest, secret, nil
+}
+
+// ResolveOrigin returns the origin name a request was encrypted for, failing
+// with ErrUnknownOrigin if it is not registered. It only selects the name key
+// and decrypts the request, which makes it the cheapest way to route or log
+// requests by origin. It does not verify the request signature, so it does
+// not authenticate the request: anyone can encrypt a request to the public
+// name key for any origin. Use Evaluate to process the request.
+func (i *RateLimitedIssuer) ResolveOrigin(req *RateLimitedTokenRequest) (string, error) {
+	_, originTokenRequest, _, err := i.decryptRequest(req)
+	if err != nil {
+		return "", err
+	}
+	originName, err := i.requestOriginName(originTokenRequest.paddedOrigin)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := i.lookupOriginIndexKey(originName); !ok {
+		return originName, ErrUnknownOrigin
+	}
+	return originName, nil
+}
+
+func (i *RateLimitedIssuer) evaluate(ctx context.Context, rng io.Reader, encodedRequest []byte) (response []byte, blindedRequestKeyEnc []byte, originName string, tokenKeyID []byte, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, originName, tokenKeyID, err
+	}
+	phaseStart := i.startPhases()
+
 	req := &RateLimitedTokenRequest{}
-	if !req.Unmarshal(encodedRequest) {
-		return nil, nil, fmt.Errorf("malformed request")
+	if !req.UnmarshalForCurve(i.curve, encodedRequest) {
+		return nil, nil, originName, tokenKeyID, ErrMalformedRequest
 	}
 
 	// Recover and validate the origin name
-	originTokenRequest, secret, err := decryptOriginTokenRequest(i.nameKey, req.RequestKey, req.EncryptedTokenRequest)
+	nameKey, originTokenRequest, secret, err := i.decryptRequest(req)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, originName, tokenKeyID, err
 	}
-	originName := unpadOriginName(originTokenRequest.paddedOrigin)
+	originName, err = i.requestOriginName(originTokenRequest.paddedOrigin)
+	if err != nil {
+		return nil, nil, originName, tokenKeyID, err
+	}
+	phaseStart = i.endPhase(PhaseDecrypt, phaseStart)
 
 	// Check to see if it's a registered origin
-	originIndexKey, ok := i.originIndexKeys[originName]
+	originIndexKey, ok := i.lookupOriginIndexKey(originName)
 	if !ok {
-		return nil, nil, fmt.Errorf("unknown origin: %s", originName)
+		return nil, nil, originName, tokenKeyID, ErrUnknownOrigin
+	}
+	if i.originPolicy != nil {
+		if retryAfter, err := i.originPolicy(originName); err != nil {
+			return nil, nil, originName, tokenKeyID, &PolicyError{RetryAfter: retryAfter, Err: err}
+		}
 	}
 
 	// Deserialize the request key
 	requestKey, err := unmarshalPublicKey(i.curve, req.RequestKey)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, originName, tokenKeyID, err
 	}
 
 	scalarLen := (i.curve.Params().Params().BitSize + 7) / 8
@@ -183,49 +947,100 @@ func (i RateLimitedIssuer) Evaluate(encodedRequest []byte) ([]byte, []byte, erro
 
 	valid := ecdsa.Verify(requestKey, digest, r, s)
 	if !valid {
-		return nil, nil, fmt.Errorf("invalid request signature")
+		return nil, nil, originName, tokenKeyID, fmt.Errorf("invalid request signature")
 	}
 
 	// Compute the request key
-	b = cryptobyte.NewBuilder(nil)
-	b.AddUint16(RateLimitedTokenType)
-	b.AddBytes([]byte("IssuerBlind"))
-	ctx := b.BytesOrPanic()
-	blindedRequestKey, err := ecdsa.BlindPublicKeyWithContext(i.curve, requestKey, originIndexKey, ctx)
+	blindedRequestKey, err := ecdsa.BlindPublicKeyWithContext(i.curve, requestKey, originIndexKey, blindContext(labelIssuerBlind))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, originName, tokenKeyID, err
 	}
-	blindedRequestKeyEnc := elliptic.MarshalCompressed(i.curve, blindedRequestKey.X, blindedRequestKey.Y)
+	blindedRequestKeyEnc = elliptic.MarshalCompressed(i.curve, blindedRequestKey.X, blindedRequestKey.Y)
+	phaseStart = i.endPhase(PhaseVerify, phaseStart)
 
 	// Compute the blinded signature
-	signer := blindrsa.NewRSASigner(i.tokenKey)
+	tokenKey, tokenKeyID, ok := i.lookupTokenKey(originTokenRequest.tokenKeyId)
+	if !ok {
+		return nil, nil, originName, tokenKeyID, fmt.Errorf("%w: wire key ID 0x%02x", ErrUnknownTokenKey, originTokenRequest.tokenKeyId)
+	}
+	expectedBlindedMsgLen := tokenKeyLen(&tokenKey.PublicKey)
+	if len(originTokenRequest.blindedMsg) != expectedBlindedMsgLen {
+		return nil, nil, originName, tokenKeyID, fmt.Errorf("%w: expected %d bytes, got %d", ErrKeySizeMismatch, expectedBlindedMsgLen, len(originTokenRequest.blindedMsg))
+	}
+	if err := checkBlindedMessage(&tokenKey.PublicKey, originTokenRequest.blindedMsg); err != nil {
+		return nil, nil, originName, tokenKeyID, err
+	}
+	if i.blindedMessages != nil && i.blindedMessages.Observe(sha256.Sum256(originTokenRequest.blindedMsg), originName) {
+		return nil, nil, originName, tokenKeyID, ErrCrossOriginReuse
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, originName, tokenKeyID, err
+	}
+	signer := blindrsa.NewRSASigner(tokenKey)
 	blindSignature, err := signer.BlindSign(originTokenRequest.blindedMsg)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, originName, tokenKeyID, err
 	}
+	phaseStart = i.endPhase(PhaseSign, phaseStart)
 
 	// Generate a fresh nonce for encrypting the response back to the client
-	responseNonceLen := max(i.nameKey.suite.AEAD.KeySize(), i.nameKey.suite.AEAD.NonceSize())
-	responseNonce := make([]byte, responseNonceLen)
-	_, err = rand.Read(responseNonce)
+	responseNonceLen := max(nameKey.suite.AEAD.KeySize(), nameKey.suite.AEAD.NonceSize())
+	responseNonce, err := i.responseNonce(rng, encodedRequest, responseNonceLen)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, originName, tokenKeyID, err
 	}
 
-	enc := make([]byte, i.nameKey.suite.KEM.PublicKeySize())
-	copy(enc, req.EncryptedTokenRequest[0:i.nameKey.suite.KEM.PublicKeySize()])
-	salt := append(append(enc, responseNonce...))
+	salt := responseSalt(req.EncryptedTokenRequest[0:nameKey.suite.KEM.PublicKeySize()], responseNonce)
 
 	// Derive encryption secrets
-	prk := i.nameKey.suite.KDF.Extract(salt, secret)
-	key := i.nameKey.suite.KDF.Expand(prk, []byte(labelResponseKey), i.nameKey.suite.AEAD.KeySize())
-	nonce := i.nameKey.suite.KDF.Expand(prk, []byte(labelResponseNonce), i.nameKey.suite.AEAD.NonceSize())
+	prk := nameKey.suite.KDF.Extract(salt, secret)
+	key := nameKey.suite.KDF.Expand(prk, []byte(labelResponseKey), nameKey.suite.AEAD.KeySize())
+	nonce := nameKey.suite.KDF.Expand(prk, []byte(labelResponseNonce), nameKey.suite.AEAD.NonceSize())
 
-	cipher, err := i.nameKey.suite.AEAD.New(key)
+	cipher, err := nameKey.suite.AEAD.New(key)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, originName, tokenKeyID, err
 	}
 	encryptedTokenResponse := append(responseNonce, cipher.Seal(nil, nonce, blindSignature, nil)...)
+	i.endPhase(PhaseEncrypt, phaseStart)
+
+	return encryptedTokenResponse, blindedRequestKeyEnc, originName, tokenKeyID, nil
+}
+
+// checkBlindedMessage checks that the blinded message is an integer in
+// [1, N-1]. Values of N or more are not canonical encodings of an element mod
+// N, and 0 signs to 0, so neither can come from blinding a token input; they
+// are rejected before reaching the signer.
+func checkBlindedMessage(tokenKey *rsa.PublicKey, blindedMessage []byte) error {
+	m := new(big.Int).SetBytes(blindedMessage)
+	if m.Sign() == 0 || m.Cmp(tokenKey.N) >= 0 {
+		return ErrBadBlindedMessage
+	}
+	return nil
+}
+
+// responseSalt returns concat(enc, response_nonce) in a fresh buffer. enc is
+// usually a sub-slice of the encrypted token request, so appending to it
+// directly would overwrite the ciphertext that follows it.
+func responseSalt(encapEnc, responseNonce []byte) []byte {
+	salt := make([]byte, 0, len(encapEnc)+len(responseNonce))
+	salt = append(salt, encapEnc...)
+	return append(salt, responseNonce...)
+}
+
+// evaluateIdempotent evaluates a request carrying idempotencyKey through the
+// issuer's IdempotencyCache.
+func (i *RateLimitedIssuer) evaluateIdempotent(ctx context.Context, idempotencyKey []byte, encodedRequest []byte) ([]byte, []byte, error) {
+	id, entry, reserved := i.idempotencyCache.reserve(idempotencyKey, encodedRequest)
+	if !reserved {
+		return entry.wait(ctx)
+	}
+
+	response, blindedRequestKey, err := i.evaluateAudited(ctx, rand.Reader, encodedRequest)
+	i.idempotencyCache.finish(id, entry, response, blindedRequestKey, err)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	return encryptedTokenResponse, blindedRequestKeyEnc, nil
+	return response, blindedRequestKey, nil
 }
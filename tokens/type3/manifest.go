@@ -0,0 +1,160 @@
+package type3
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/cloudflare/pat-go/ecdsa"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+var (
+	ErrInvalidOriginManifest = errors.New("invalid origin manifest")
+)
+
+var labelOriginManifest = []byte("OriginManifest")
+
+// OriginManifest lists the origins an issuer serves, as of Timestamp. Origins
+// are listed by the SHA-256 digest of their name, in ascending order.
+type OriginManifest struct {
+	Timestamp    time.Time
+	OriginHashes [][]byte
+}
+
+// Contains reports whether origin is listed in the manifest.
+func (m OriginManifest) Contains(origin string) bool {
+	originHash := sha256.Sum256([]byte(origin))
+	j := sort.Search(len(m.OriginHashes), func(j int) bool {
+		return bytes.Compare(m.OriginHashes[j], originHash[:]) >= 0
+	})
+	return j < len(m.OriginHashes) && bytes.Equal(m.OriginHashes[j], originHash[:])
+}
+
+// marshalContent encodes the manifest for signing as follows:
+//
+//	struct {
+//	  uint16 token_type;
+//	  uint8 timestamp[8];              // seconds since the Unix epoch
+//	  opaque origin_hashes<0..2^24-1>; // concatenated SHA-256 digests
+//	} OriginManifestContent;
+func (m OriginManifest) marshalContent() ([]byte, error) {
+	timestamp := make([]byte, 8)
+	binary.BigEndian.PutUint64(timestamp, uint64(m.Timestamp.Unix()))
+
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16(RateLimitedTokenType)
+	b.AddBytes(timestamp)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, originHash := range m.OriginHashes {
+			b.AddBytes(originHash)
+		}
+	})
+	return b.Bytes()
+}
+
+func originManifestDigest(content []byte) []byte {
+	hash := sha512.New384()
+	hash.Write(labelOriginManifest)
+	hash.Write(content)
+	return hash.Sum(nil)
+}
+
+// SignOriginManifest returns a manifest of the origins registered with the
+// issuer, including those cached from the OriginKeyProvider, signed with the
+// P-384 manifest key. Attesters verify it with VerifyOriginManifest and can
+// reject issuance for origins it does not list.
+//
+// The manifest is deliberately not signed with the token key. The issuer blind
+// signs whatever a client sends it, so any client could obtain a valid token
+// key signature over a manifest of its choosing. The manifest key must not be
+// used for anything else either.
+func (i *RateLimitedIssuer) SignOriginManifest(manifestKey *ecdsa.PrivateKey, timestamp time.Time) ([]byte, error) {
+	if manifestKey == nil || manifestKey.Curve == nil || manifestKey.Curve.Params().Name != elliptic.P384().Params().Name {
+		return nil, fmt.Errorf("%w: manifest key must be a P-384 key", ErrInvalidOriginManifest)
+	}
+
+	i.originKeyMu.RLock()
+	originHashes := make([][]byte, 0, len(i.originIndexKeys))
+	for origin := range i.originIndexKeys {
+		originHash := sha256.Sum256([]byte(origin))
+		originHashes = append(originHashes, originHash[:])
+	}
+	i.originKeyMu.RUnlock()
+	sort.Slice(originHashes, func(j, k int) bool {
+		return bytes.Compare(originHashes[j], originHashes[k]) < 0
+	})
+
+	content, err := OriginManifest{
+		Timestamp:    timestamp,
+		OriginHashes: originHashes,
+	}.marshalContent()
+	if err != nil {
+		return nil, fmt.Errorf("%w: too many origins: %v", ErrInvalidOriginManifest, err)
+	}
+
+	r, s, err := ecdsa.Sign(rand.Reader, manifestKey, originManifestDigest(content))
+	if err != nil {
+		return nil, err
+	}
+	return append(content, encodeRequestSignature(manifestKey.Curve, r, s)...), nil
+}
+
+// VerifyOriginManifest verifies a manifest produced by SignOriginManifest
+// against the issuer's P-384 manifest public key and returns its contents. It
+// does not check the timestamp; attesters should reject manifests older than
+// they are willing to trust.
+func VerifyOriginManifest(signedManifest []byte, manifestKey *ecdsa.PublicKey) (OriginManifest, error) {
+	curve := elliptic.P384()
+	if manifestKey == nil || manifestKey.Curve == nil || manifestKey.Curve.Params().Name != curve.Params().Name {
+		return OriginManifest{}, fmt.Errorf("%w: manifest key must be a P-384 key", ErrInvalidOriginManifest)
+	}
+
+	scalarLen := (curve.Params().BitSize + 7) / 8
+	if len(signedManifest) < 2*scalarLen {
+		return OriginManifest{}, ErrInvalidOriginManifest
+	}
+	content := signedManifest[:len(signedManifest)-2*scalarLen]
+	signature := signedManifest[len(content):]
+	r := new(big.Int).SetBytes(signature[:scalarLen])
+	s := new(big.Int).SetBytes(signature[scalarLen:])
+	if !ecdsa.Verify(manifestKey, originManifestDigest(content), r, s) {
+		return OriginManifest{}, fmt.Errorf("%w: bad signature", ErrInvalidOriginManifest)
+	}
+
+	var tokenType uint16
+	var timestamp []byte
+	var originHashes cryptobyte.String
+	str := cryptobyte.String(content)
+	if !str.ReadUint16(&tokenType) ||
+		tokenType != RateLimitedTokenType ||
+		!str.ReadBytes(&timestamp, 8) ||
+		!str.ReadUint24LengthPrefixed(&originHashes) ||
+		!str.Empty() ||
+		len(originHashes)%sha256.Size != 0 {
+		return OriginManifest{}, fmt.Errorf("%w: malformed content", ErrInvalidOriginManifest)
+	}
+
+	manifest := OriginManifest{
+		Timestamp:    time.Unix(int64(binary.BigEndian.Uint64(timestamp)), 0),
+		OriginHashes: make([][]byte, 0, len(originHashes)/sha256.Size),
+	}
+	for !originHashes.Empty() {
+		var originHash []byte
+		originHashes.ReadBytes(&originHash, sha256.Size)
+		if n := len(manifest.OriginHashes); n > 0 && bytes.Compare(manifest.OriginHashes[n-1], originHash) >= 0 {
+			return OriginManifest{}, fmt.Errorf("%w: origins not sorted", ErrInvalidOriginManifest)
+		}
+		manifest.OriginHashes = append(manifest.OriginHashes, append([]byte{}, originHash...))
+	}
+
+	return manifest, nil
+}
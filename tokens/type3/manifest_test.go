@@ -0,0 +1,68 @@
+package type3
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/pat-go/ecdsa"
+)
+
+func TestOriginManifest(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	origins := []string{"a.example", "b.example", "c.example"}
+	for _, origin := range origins {
+		issuer.AddOrigin(origin)
+	}
+
+	manifestKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Unix(1700000000, 0)
+	signedManifest, err := issuer.SignOriginManifest(manifestKey, timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := VerifyOriginManifest(signedManifest, &manifestKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !manifest.Timestamp.Equal(timestamp) {
+		t.Fatalf("unexpected timestamp %v", manifest.Timestamp)
+	}
+	if len(manifest.OriginHashes) != len(origins) {
+		t.Fatalf("expected %d origins, got %d", len(origins), len(manifest.OriginHashes))
+	}
+	for _, origin := range origins {
+		if !manifest.Contains(origin) {
+			t.Fatalf("manifest does not contain %s", origin)
+		}
+	}
+	if manifest.Contains("unknown.example") {
+		t.Fatal("manifest contains an unregistered origin")
+	}
+
+	// Tampering with any byte invalidates the manifest
+	for j := range signedManifest {
+		tampered := append([]byte{}, signedManifest...)
+		tampered[j] ^= 0x01
+		if _, err := VerifyOriginManifest(tampered, &manifestKey.PublicKey); !errors.Is(err, ErrInvalidOriginManifest) {
+			t.Fatalf("tampered byte %d: expected ErrInvalidOriginManifest, got %v", j, err)
+		}
+	}
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyOriginManifest(signedManifest, &otherKey.PublicKey); !errors.Is(err, ErrInvalidOriginManifest) {
+		t.Fatalf("expected ErrInvalidOriginManifest, got %v", err)
+	}
+	if _, err := VerifyOriginManifest(signedManifest[:10], &manifestKey.PublicKey); !errors.Is(err, ErrInvalidOriginManifest) {
+		t.Fatalf("expected ErrInvalidOriginManifest, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package type3
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+// DefaultNameKeyCacheSize is the number of name keys a NameKeyCache created
+// with NewNameKeyCache holds. Issuers publish few name keys at a time, so this
+// covers the keys of several issuers across rotations.
+const DefaultNameKeyCacheSize = 64
+
+// NameKeyCache caches parsed name keys keyed by their fingerprint, i.e., the
+// SHA-256 digest of the encoded key (which is also the name key ID). Clients
+// that repeatedly receive the same encoded name key from an issuer directory
+// can use it to skip re-parsing the key and re-assembling its HPKE suite.
+// Only the public key and suite are cached; CreateTokenRequest still runs a
+// fresh HPKE setup, with a new ephemeral key, for every request.
+//
+// CreateTokenRequest does not consult the cache itself: it takes a parsed
+// name key, so only callers that obtain their name keys through Get benefit.
+// The cache holds a bounded number of keys and evicts the oldest one first.
+type NameKeyCache struct {
+	mu    sync.RWMutex
+	size  int
+	keys  map[[32]byte]EncapKey
+	order [][32]byte // insertion order, oldest first
+}
+
+func NewNameKeyCache() *NameKeyCache {
+	return NewNameKeyCacheWithSize(DefaultNameKeyCacheSize)
+}
+
+// NewNameKeyCacheWithSize returns a NameKeyCache that holds at most size name
+// keys. A size below 1 is treated as 1.
+func NewNameKeyCacheWithSize(size int) *NameKeyCache {
+	if size < 1 {
+		size = 1
+	}
+	return &NameKeyCache{
+		size: size,
+		keys: make(map[[32]byte]EncapKey),
+	}
+}
+
+// Get returns the parsed name key for the encoded name key data, parsing and
+// caching it on first use.
+func (c *NameKeyCache) Get(data []byte) (EncapKey, error) {
+	fingerprint := sha256.Sum256(data)
+
+	c.mu.RLock()
+	nameKey, ok := c.keys[fingerprint]
+	c.mu.RUnlock()
+	if ok {
+		return nameKey, nil
+	}
+
+	nameKey, err := UnmarshalEncapKey(data)
+	if err != nil {
+		return EncapKey{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.keys[fingerprint]; ok {
+		return nameKey, nil
+	}
+	if len(c.order) >= c.size {
+		delete(c.keys, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.keys[fingerprint] = nameKey
+	c.order = append(c.order, fingerprint)
+
+	return nameKey, nil
+}
@@ -0,0 +1,182 @@
+package type3
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/cloudflare/pat-go/ecdsa"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+var (
+	ErrInvalidOriginKeyExport = errors.New("invalid origin key export")
+	ErrOriginKeyConflict      = errors.New("origin already registered with a different index key")
+	ErrInvalidIndexKey        = errors.New("invalid origin index key")
+)
+
+// ImportMode selects how ImportOriginKeys treats origins that are already
+// registered.
+type ImportMode int
+
+const (
+	// ImportMerge adds the imported origins to the registered ones. Importing
+	// an origin that is registered with a different index key fails with
+	// ErrOriginKeyConflict, as replacing the key would change every client
+	// index for the origin.
+	ImportMerge ImportMode = iota
+	// ImportReplace discards all registered origins before importing.
+	ImportReplace
+)
+
+var labelOriginKeyExport = []byte("OriginIndexKeys")
+
+// ExportOriginKeys serializes the registered origins and their index keys,
+// encrypted and authenticated with AES-GCM under encKey, which must be 16, 24,
+// or 32 bytes. Importing them into another issuer with ImportOriginKeys
+// preserves the anonymous issuer origin IDs clients get for those origins.
+// Keys cached from an OriginKeyProvider are exported too.
+func (i *RateLimitedIssuer) ExportOriginKeys(encKey []byte) ([]byte, error) {
+	aead, err := newOriginKeyExportAEAD(encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	scalarLen := (i.curve.Params().BitSize + 7) / 8
+	b := cryptobyte.NewBuilder(nil)
+	i.originKeyMu.RLock()
+	for origin, key := range i.originIndexKeys {
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(origin))
+		})
+		b.AddBytes(key.D.FillBytes(make([]byte, scalarLen)))
+	}
+	i.originKeyMu.RUnlock()
+	plaintext, err := b.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, labelOriginKeyExport), nil
+}
+
+// ImportOriginKeys registers the origins and index keys in data, as returned by
+// ExportOriginKeys with the same encKey. Registered origins are kept or
+// discarded according to mode. Nothing is imported if data is invalid or, when
+// merging, any origin conflicts.
+func (i *RateLimitedIssuer) ImportOriginKeys(data, encKey []byte, mode ImportMode) error {
+	aead, err := newOriginKeyExportAEAD(encKey)
+	if err != nil {
+		return err
+	}
+	if len(data) < aead.NonceSize() {
+		return ErrInvalidOriginKeyExport
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], labelOriginKeyExport)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidOriginKeyExport, err)
+	}
+
+	scalarLen := (i.curve.Params().BitSize + 7) / 8
+	imported := make(map[string]*ecdsa.PrivateKey)
+	s := cryptobyte.String(plaintext)
+	for !s.Empty() {
+		var origin cryptobyte.String
+		var scalar []byte
+		if !s.ReadUint16LengthPrefixed(&origin) || !s.ReadBytes(&scalar, scalarLen) {
+			return ErrInvalidOriginKeyExport
+		}
+		key, err := i.parseOriginIndexKey(scalar)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidOriginKeyExport, err)
+		}
+		imported[string(origin)] = key
+	}
+
+	return i.importOriginKeys(imported, mode)
+}
+
+// ExportOriginKeyScalars returns the registered origins and their index keys,
+// encoded as big-endian scalars of the curve's scalar size. Unlike
+// ExportOriginKeys, the keys are not encrypted, so this is meant for storage
+// that protects them by other means, e.g., a secrets manager. Keys cached from
+// an OriginKeyProvider are exported too.
+func (i *RateLimitedIssuer) ExportOriginKeyScalars() map[string][]byte {
+	scalarLen := (i.curve.Params().BitSize + 7) / 8
+	i.originKeyMu.RLock()
+	defer i.originKeyMu.RUnlock()
+	scalars := make(map[string][]byte, len(i.originIndexKeys))
+	for origin, key := range i.originIndexKeys {
+		scalars[origin] = key.D.FillBytes(make([]byte, scalarLen))
+	}
+	return scalars
+}
+
+// ImportOriginKeyScalars registers the origins and index key scalars in
+// scalars, as returned by ExportOriginKeyScalars. Registered origins are kept
+// or discarded according to mode. Nothing is imported if any scalar is invalid
+// or, when merging, any origin conflicts.
+func (i *RateLimitedIssuer) ImportOriginKeyScalars(scalars map[string][]byte, mode ImportMode) error {
+	imported := make(map[string]*ecdsa.PrivateKey, len(scalars))
+	for origin, scalar := range scalars {
+		key, err := i.parseOriginIndexKey(scalar)
+		if err != nil {
+			return fmt.Errorf("%s: %w", origin, err)
+		}
+		imported[origin] = key
+	}
+
+	return i.importOriginKeys(imported, mode)
+}
+
+// parseOriginIndexKey returns the index key for a big-endian scalar, which must
+// be exactly the scalar size of the issuer's curve and in [1, N-1].
+func (i *RateLimitedIssuer) parseOriginIndexKey(scalar []byte) (*ecdsa.PrivateKey, error) {
+	scalarLen := (i.curve.Params().BitSize + 7) / 8
+	if len(scalar) != scalarLen {
+		return nil, fmt.Errorf("%w: %d-byte scalar, expected %d bytes", ErrInvalidIndexKey, len(scalar), scalarLen)
+	}
+	d := new(big.Int).SetBytes(scalar)
+	if d.Sign() == 0 || d.Cmp(i.curve.Params().N) >= 0 {
+		return nil, fmt.Errorf("%w: scalar out of range", ErrInvalidIndexKey)
+	}
+	return ecdsa.CreateKey(i.curve, scalar)
+}
+
+func (i *RateLimitedIssuer) importOriginKeys(imported map[string]*ecdsa.PrivateKey, mode ImportMode) error {
+	i.originKeyMu.Lock()
+	defer i.originKeyMu.Unlock()
+	switch mode {
+	case ImportReplace:
+		i.originIndexKeys = imported
+	case ImportMerge:
+		for origin, key := range imported {
+			if existing, ok := i.originIndexKeys[origin]; ok && existing.D.Cmp(key.D) != 0 {
+				return fmt.Errorf("%w: %s", ErrOriginKeyConflict, origin)
+			}
+		}
+		for origin, key := range imported {
+			i.originIndexKeys[origin] = key
+		}
+	default:
+		return fmt.Errorf("unknown import mode %d", mode)
+	}
+	i.markReadyLocked()
+
+	return nil
+}
+
+func newOriginKeyExportAEAD(encKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
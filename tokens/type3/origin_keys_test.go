@@ -0,0 +1,235 @@
+package type3
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/cloudflare/pat-go/ecdsa"
+)
+
+func TestExportImportOriginKeys(t *testing.T) {
+	tokenKey := loadPrivateKey(t)
+	issuer := createTestIssuer(t, tokenKey)
+	origins := []string{"origin.example", "other.example"}
+	for _, origin := range origins {
+		issuer.AddOrigin(origin)
+	}
+
+	encKey := make([]byte, 32)
+	rand.Reader.Read(encKey)
+	data, err := issuer.ExportOriginKeys(encKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newIssuer := createTestIssuer(t, tokenKey)
+	newIssuer.AddOrigin("new.example")
+	if err := newIssuer.ImportOriginKeys(data, encKey, ImportMerge); err != nil {
+		t.Fatal(err)
+	}
+	for _, origin := range origins {
+		oldKey, err := issuer.OriginIndexPublicKey(origin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newKey, err := newIssuer.OriginIndexPublicKey(origin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(oldKey, newKey) {
+			t.Fatalf("%s: index key mismatch", origin)
+		}
+	}
+	if newIssuer.OriginIndexKey("new.example") == nil {
+		t.Fatal("merge dropped a registered origin")
+	}
+
+	// Client indices carry over to the new issuer
+	client, requestState := createTestTokenRequest(t, newIssuer, origins[0])
+	_, blindedRequestKey, err := newIssuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	attester := NewRateLimitedAttester(NewMemoryClientStateCache())
+	anonymousOriginID := make([]byte, 32)
+	rand.Reader.Read(anonymousOriginID)
+	if err := attester.VerifyRequest(*requestState.Request(), requestState.Blind(), requestState.ClientKey(), anonymousOriginID); err != nil {
+		t.Fatal(err)
+	}
+	index, err := attester.FinalizeIndex(requestState.ClientKey(), requestState.Blind(), blindedRequestKey, anonymousOriginID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	originIndexPublicKey, err := issuer.OriginIndexPublicKey(origins[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedIndex, err := client.PredictIndex(requestState.Blind(), originIndexPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(index, expectedIndex) {
+		t.Fatal("index changed across issuers")
+	}
+
+	// Merging a different key for a registered origin fails
+	conflicting := createTestIssuer(t, tokenKey)
+	conflicting.AddOrigin(origins[0])
+	if err := conflicting.ImportOriginKeys(data, encKey, ImportMerge); !errors.Is(err, ErrOriginKeyConflict) {
+		t.Fatalf("expected ErrOriginKeyConflict, got %v", err)
+	}
+	if conflicting.OriginIndexKey(origins[1]) != nil {
+		t.Fatal("conflicting import was partially applied")
+	}
+	if err := conflicting.ImportOriginKeys(data, encKey, ImportReplace); err != nil {
+		t.Fatal(err)
+	}
+	if conflicting.OriginIndexKey(origins[0]).D.Cmp(issuer.OriginIndexKey(origins[0]).D) != 0 {
+		t.Fatal("replace did not import the index key")
+	}
+
+	wrongKey := make([]byte, 32)
+	rand.Reader.Read(wrongKey)
+	if err := newIssuer.ImportOriginKeys(data, wrongKey, ImportMerge); !errors.Is(err, ErrInvalidOriginKeyExport) {
+		t.Fatalf("expected ErrInvalidOriginKeyExport, got %v", err)
+	}
+	tampered := append([]byte{}, data...)
+	tampered[len(tampered)-1] ^= 0x01
+	if err := newIssuer.ImportOriginKeys(tampered, encKey, ImportMerge); !errors.Is(err, ErrInvalidOriginKeyExport) {
+		t.Fatalf("expected ErrInvalidOriginKeyExport, got %v", err)
+	}
+}
+
+func TestExportImportOriginKeyScalars(t *testing.T) {
+	tokenKey := loadPrivateKey(t)
+	issuer := createTestIssuer(t, tokenKey)
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	curve := elliptic.P384()
+	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	attester := NewRateLimitedAttester(NewMemoryClientStateCache())
+	anonymousOriginID := make([]byte, 32)
+	rand.Reader.Read(anonymousOriginID)
+
+	finalizeIndex := func(issuer *RateLimitedIssuer) []byte {
+		blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		challenge := make([]byte, 32)
+		rand.Reader.Read(challenge)
+		nonce := make([]byte, 32)
+		rand.Reader.Read(nonce)
+		requestState, err := client.CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := attester.VerifyRequest(*requestState.Request(), requestState.Blind(), requestState.ClientKey(), anonymousOriginID); err != nil {
+			t.Fatal(err)
+		}
+		_, blindedRequestKey, err := issuer.Evaluate(requestState.Request().Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		index, err := attester.FinalizeIndex(requestState.ClientKey(), requestState.Blind(), blindedRequestKey, anonymousOriginID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return index
+	}
+
+	index := finalizeIndex(issuer)
+
+	scalars := issuer.ExportOriginKeyScalars()
+	if len(scalars) != 1 || len(scalars[testOrigin]) != 48 {
+		t.Fatalf("unexpected export %x", scalars)
+	}
+	restarted := createTestIssuer(t, tokenKey)
+	if err := restarted.ImportOriginKeyScalars(scalars, ImportMerge); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(finalizeIndex(restarted), index) {
+		t.Fatal("index changed across export and import")
+	}
+
+	// Invalid scalars are rejected without importing anything
+	for _, scalar := range [][]byte{
+		make([]byte, 48),
+		make([]byte, 47),
+		curve.Params().N.FillBytes(make([]byte, 48)),
+	} {
+		fresh := createTestIssuer(t, tokenKey)
+		err := fresh.ImportOriginKeyScalars(map[string][]byte{
+			testOrigin:      scalars[testOrigin],
+			"other.example": scalar,
+		}, ImportMerge)
+		if !errors.Is(err, ErrInvalidIndexKey) {
+			t.Fatalf("expected ErrInvalidIndexKey, got %v", err)
+		}
+		if len(fresh.ListOrigins()) != 0 {
+			t.Fatal("invalid import was partially applied")
+		}
+	}
+}
+
+func TestAddOriginWithKey(t *testing.T) {
+	tokenKey := loadPrivateKey(t)
+	testOrigin := "origin.example"
+	indexKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scalar := indexKey.D.FillBytes(make([]byte, 48))
+
+	issuer := createTestIssuer(t, tokenKey)
+	if err := issuer.AddOriginWithKey(testOrigin, scalar); err != nil {
+		t.Fatal(err)
+	}
+	// A replica shares the token key, name key, and index key
+	replica := createTestIssuer(t, tokenKey)
+	replica.nameKey = issuer.nameKey
+	replica.nameKeys = issuer.nameKeys
+	if err := replica.AddOriginWithKey(testOrigin, scalar); err != nil {
+		t.Fatal(err)
+	}
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	encodedRequest := requestState.Request().Marshal()
+	_, blindedRequestKey, err := issuer.Evaluate(encodedRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, replicaBlindedRequestKey, err := replica.Evaluate(encodedRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(blindedRequestKey, replicaBlindedRequestKey) {
+		t.Fatal("blinded request key differs across replicas")
+	}
+
+	for _, scalar := range [][]byte{
+		nil,
+		make([]byte, 48),
+		scalar[1:],
+		append([]byte{0x00}, scalar...),
+		elliptic.P384().Params().N.FillBytes(make([]byte, 48)),
+	} {
+		if err := issuer.AddOriginWithKey("other.example", scalar); !errors.Is(err, ErrInvalidIndexKey) {
+			t.Fatalf("expected ErrInvalidIndexKey, got %v", err)
+		}
+	}
+	if issuer.OriginIndexKey("other.example") != nil {
+		t.Fatal("invalid scalar registered an origin")
+	}
+}
@@ -0,0 +1,352 @@
+package type3
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	hpke "github.com/cisco/go-hpke"
+	"github.com/cloudflare/circl/blindsign"
+	"github.com/cloudflare/circl/blindsign/blindrsa"
+	"github.com/cloudflare/pat-go/tokens"
+)
+
+var (
+	ErrUnexpectedBlindRSAVariant  = errors.New("unexpected blind RSA variant")
+	ErrUnsupportedBlindRSAVariant = errors.New("unsupported blind RSA variant")
+	ErrBlindRSAVariantMismatch    = errors.New("token does not verify under the configured blind RSA variant")
+	ErrInvalidSaltLength          = errors.New("invalid PSS salt length")
+	ErrUnsupportedTokenKeySize    = errors.New("unsupported token key size")
+	ErrUnsupportedContextHash     = errors.New("unsupported context hash")
+	ErrUnsupportedCurve           = errors.New("unsupported request key curve")
+)
+
+// BlindRSAVariant names a blind RSA signature variant for token authenticators.
+// The client's variant must match the one the issuer's signer is used with;
+// the signer itself cannot tell them apart.
+type BlindRSAVariant string
+
+const (
+	// EMSA-PSS encoding with SHA-384 and a random salt, whose length is the
+	// configured salt length. This is the default.
+	BlindRSAVariantPSS BlindRSAVariant = "RSABSSA-SHA384-PSS-Deterministic"
+	// EMSA-PSS encoding with SHA-384 and an empty salt.
+	BlindRSAVariantPSSZero BlindRSAVariant = "RSABSSA-SHA384-PSSZERO-Deterministic"
+)
+
+// variantSaltLength returns the PSS salt length used by variant, given the
+// configured salt length for variants with a random salt.
+func variantSaltLength(tokenKey *rsa.PublicKey, variant BlindRSAVariant, saltLength int) (int, error) {
+	switch variant {
+	case BlindRSAVariantPSS:
+		if err := checkSaltLength(tokenKey, saltLength); err != nil {
+			return 0, err
+		}
+		return saltLength, nil
+	case BlindRSAVariantPSSZero:
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("%w: %s", ErrUnsupportedBlindRSAVariant, variant)
+	}
+}
+
+const (
+	// TokenKeyBits is the default modulus size, in bits, of token keys. Token
+	// keys of 3072 and 4096 bits are supported too.
+	TokenKeyBits = 2048
+	// BlindedMessageSize is the size, in bytes, of blinded messages, blind
+	// signatures, and token authenticators for TokenKeyBits-bit token keys.
+	BlindedMessageSize = TokenKeyBits / 8
+)
+
+// ProtocolParams describes the algorithms and field sizes used by the
+// rate-limited token type.
+type ProtocolParams struct {
+	TokenType          uint16
+	SignatureAlgorithm string         // Blind RSA signature variant used for token authenticators
+	SaltLength         int            // PSS salt length of token authenticators, in bytes
+	Hash               crypto.Hash    // Hash used for token authenticators and request signatures
+	ContextHash        crypto.Hash    // Hash of the challenge used as the token context
+	Curve              elliptic.Curve // Curve used for request key blinding and request signatures
+	KEM                hpke.KEMID     // HPKE KEM used by the default name key
+	KDF                hpke.KDFID     // HPKE KDF used by the default name key
+	AEAD               hpke.AEADID    // HPKE AEAD used by the default name key
+
+	NonceSize         int // Token nonce size, in bytes
+	ContextSize       int // Token context size, in bytes
+	KeyIDSize         int // Token key ID size, in bytes
+	AuthenticatorSize int // Token authenticator size for 2048-bit token keys, in bytes
+	NameKeyIDSize     int // Name key ID size, in bytes
+	RequestKeySize    int // Compressed request key size, in bytes
+	SignatureSize     int // Request signature size, in bytes
+}
+
+// RateLimitedParams returns the protocol parameters of the rate-limited token type.
+func RateLimitedParams() ProtocolParams {
+	return rateLimitedParams(elliptic.P384())
+}
+
+// RateLimitedParamsForCurve returns the protocol parameters of the rate-limited
+// token type with curve for request key blinding and request signatures. P-384
+// is the default; P-256 is also supported, for deployments whose hardware
+// keystores lack P-384. Client, issuer, and attester must agree on the curve,
+// as it determines the request key and signature sizes on the wire.
+func RateLimitedParamsForCurve(curve elliptic.Curve) (ProtocolParams, error) {
+	if err := checkRequestKeyCurve(curve); err != nil {
+		return ProtocolParams{}, err
+	}
+	return rateLimitedParams(curve), nil
+}
+
+func rateLimitedParams(curve elliptic.Curve) ProtocolParams {
+	scalarLen := (curve.Params().BitSize + 7) / 8
+
+	return ProtocolParams{
+		TokenType:          RateLimitedTokenType,
+		SignatureAlgorithm: string(BlindRSAVariantPSS),
+		SaltLength:         crypto.SHA384.Size(),
+		Hash:               crypto.SHA384,
+		ContextHash:        crypto.SHA256,
+		Curve:              curve,
+		KEM:                fixedKEM,
+		KDF:                fixedKDF,
+		AEAD:               fixedAEAD,
+
+		NonceSize:         32,
+		ContextSize:       32,
+		KeyIDSize:         32,
+		AuthenticatorSize: BlindedMessageSize,
+		NameKeyIDSize:     32,
+		RequestKeySize:    1 + scalarLen,
+		SignatureSize:     2 * scalarLen,
+	}
+}
+
+// supportedRequestKeyCurves are the curves a request key may be on, in order of
+// preference.
+var supportedRequestKeyCurves = []elliptic.Curve{elliptic.P384(), elliptic.P256()}
+
+func checkRequestKeyCurve(curve elliptic.Curve) error {
+	if curve == nil {
+		return fmt.Errorf("%w: missing curve", ErrUnsupportedCurve)
+	}
+	for _, supported := range supportedRequestKeyCurves {
+		if curve.Params().Name == supported.Params().Name {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrUnsupportedCurve, curve.Params().Name)
+}
+
+// curveForRequestKey returns the supported curve whose compressed points are
+// len(pointEnc) bytes long. Compressed point sizes differ between supported
+// curves, so parties that only see encoded points, like the attester, can tell
+// the curve from them.
+func curveForRequestKey(pointEnc []byte) (elliptic.Curve, error) {
+	for _, curve := range supportedRequestKeyCurves {
+		if len(pointEnc) == rateLimitedParams(curve).RequestKeySize {
+			return curve, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no curve with %d-byte points", ErrUnsupportedCurve, len(pointEnc))
+}
+
+// contextDigest hashes the challenge into a token context with hash, which
+// must produce contexts of the fixed context size.
+func contextDigest(hash crypto.Hash, challenge []byte) ([]byte, error) {
+	if !hash.Available() || hash.Size() != RateLimitedParams().ContextSize {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedContextHash, hash)
+	}
+	h := hash.New()
+	h.Write(challenge)
+	return h.Sum(nil), nil
+}
+
+// TokenContext returns the token context for challenge under ContextHash. The
+// hash must produce ContextSize bytes, e.g., SHA-256 or SHA-512/256. Origins
+// recompute the context this way to check that a token answers their
+// challenge (see TokenMatchesChallenge).
+func (p ProtocolParams) TokenContext(challenge []byte) ([]byte, error) {
+	return contextDigest(p.ContextHash, challenge)
+}
+
+// TokenMatchesChallenge reports whether the token context is the context of
+// challenge under ContextHash, comparing in constant time. It is false if the
+// context hash is unsupported.
+func (p ProtocolParams) TokenMatchesChallenge(token tokens.Token, challenge []byte) bool {
+	context, err := p.TokenContext(challenge)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(token.Context, context) == 1
+}
+
+// newTokenVerifier returns the blind RSA verifier for token keys. Tokens use
+// EMSA-PSS encoding with SHA-384 without message randomization. In the circl
+// blindrsa package this is RSAVerifier, whose FixedBlind takes the salt, so it
+// serves every BlindRSAVariant; DeterminsiticRSAVerifier always uses an empty
+// salt. The matching signer is RSASigner.
+func newTokenVerifier(tokenKey *rsa.PublicKey) blindrsa.RSAVerifier {
+	return blindrsa.NewRSAVerifier(tokenKey, crypto.SHA384)
+}
+
+// tokenKeyLen returns the length in bytes of blinded messages, blind
+// signatures, and authenticators for the token key. Moduli need not be a
+// multiple of 8 bits, so this is rounded up from the modulus size.
+func tokenKeyLen(tokenKey *rsa.PublicKey) int {
+	return (tokenKey.N.BitLen() + 7) / 8
+}
+
+// supportedTokenKeyLens are the lengths in bytes of blinded messages and
+// authenticators for the supported token key sizes: 2048 bits, the default,
+// and 3072 and 4096 bits for longer-lived keys.
+var supportedTokenKeyLens = []int{BlindedMessageSize, 3072 / 8, 4096 / 8}
+
+func isSupportedTokenKeyLen(kLen int) bool {
+	for _, supported := range supportedTokenKeyLens {
+		if kLen == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTokenKeySize checks that the token key has a supported size. Blinded
+// messages and authenticators are as long as the modulus, rounded up to whole
+// bytes, so e.g. a 2041- to 2048-bit modulus is a 2048-bit token key.
+func checkTokenKeySize(tokenKey *rsa.PublicKey) error {
+	if !isSupportedTokenKeyLen(tokenKeyLen(tokenKey)) {
+		return fmt.Errorf("%w: %d bits, expected 2048, 3072, or 4096", ErrUnsupportedTokenKeySize, tokenKey.N.BitLen())
+	}
+	return nil
+}
+
+// checkSaltLength checks that a PSS salt of saltLength bytes fits in the
+// EMSA-PSS encoding for the token key. Empty salts are rejected: they belong to
+// a different blind RSA variant, and rsa.VerifyPSS treats a zero salt length as
+// "detect automatically", so it could not be enforced.
+func checkSaltLength(tokenKey *rsa.PublicKey, saltLength int) error {
+	emLen := (tokenKey.N.BitLen() - 1 + 7) / 8
+	if saltLength <= 0 || emLen < crypto.SHA384.Size()+saltLength+2 {
+		return fmt.Errorf("%w: %d", ErrInvalidSaltLength, saltLength)
+	}
+	return nil
+}
+
+// blindTokenInput blinds the token input for the token key under variant,
+// using a random PSS salt of saltLength bytes if the variant has one.
+// RSAVerifier.Blind always uses a salt of the hash size, so the salt is
+// supplied through FixedBlind instead.
+func blindTokenInput(rng io.Reader, tokenKey *rsa.PublicKey, variant BlindRSAVariant, saltLength int, tokenInput []byte) ([]byte, blindsign.VerifierState, error) {
+	if err := checkTokenKeySize(tokenKey); err != nil {
+		return nil, nil, err
+	}
+	saltLength, err := variantSaltLength(tokenKey, variant, saltLength)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	salt := make([]byte, saltLength)
+	if _, err := io.ReadFull(rng, salt); err != nil {
+		return nil, nil, err
+	}
+
+	var blind *big.Int
+	for blind == nil || blind.Sign() == 0 || new(big.Int).ModInverse(blind, tokenKey.N) == nil {
+		var err error
+		blind, err = rand.Int(rng, tokenKey.N)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	blindedMessage, verifierState, err := newTokenVerifier(tokenKey).FixedBlind(tokenInput, blind.Bytes(), salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkTokenVerifierState(verifierState, saltLength); err != nil {
+		return nil, nil, err
+	}
+	return blindedMessage, verifierState, nil
+}
+
+// checkTokenVerifierState guards against the blind RSA dependency producing
+// verifier state for a different variant than newTokenVerifier documents.
+func checkTokenVerifierState(state blindsign.VerifierState, saltLength int) error {
+	rsaState, ok := state.(blindrsa.RSAVerifierState)
+	if !ok || len(rsaState.CopySalt()) != saltLength {
+		return ErrUnexpectedBlindRSAVariant
+	}
+	return nil
+}
+
+// verifyToken checks the token authenticator against the token key under
+// variant, requiring a PSS salt of exactly saltLength bytes if the variant has
+// one.
+func verifyToken(tokenKey *rsa.PublicKey, variant BlindRSAVariant, saltLength int, token tokens.Token) error {
+	saltLength, err := variantSaltLength(tokenKey, variant, saltLength)
+	if err != nil {
+		return err
+	}
+	if saltLength == 0 {
+		return verifyTokenZeroSalt(tokenKey, token)
+	}
+
+	hash := crypto.SHA384.New()
+	hash.Write(token.AuthenticatorInput())
+	digest := hash.Sum(nil)
+
+	return rsa.VerifyPSS(tokenKey, crypto.SHA384, digest, token.Authenticator, &rsa.PSSOptions{
+		Hash:       crypto.SHA384,
+		SaltLength: saltLength,
+	})
+}
+
+// verifyTokenZeroSalt checks the token authenticator for an empty PSS salt.
+// rsa.VerifyPSS cannot require an empty salt, but with one the EMSA-PSS
+// encoding is deterministic, so the authenticator is checked against it
+// directly. Blinding with a blind of 1 yields the encoded message itself.
+func verifyTokenZeroSalt(tokenKey *rsa.PublicKey, token tokens.Token) error {
+	encodedMessage, _, err := newTokenVerifier(tokenKey).FixedBlind(token.AuthenticatorInput(), []byte{0x01}, nil)
+	if err != nil {
+		return err
+	}
+
+	kLen := tokenKeyLen(tokenKey)
+	if len(token.Authenticator) != kLen {
+		return rsa.ErrVerification
+	}
+	s := new(big.Int).SetBytes(token.Authenticator)
+	if s.Cmp(tokenKey.N) >= 0 {
+		return rsa.ErrVerification
+	}
+	m := new(big.Int).Exp(s, big.NewInt(int64(tokenKey.E)), tokenKey.N)
+	if subtle.ConstantTimeCompare(m.FillBytes(make([]byte, kLen)), encodedMessage) != 1 {
+		return rsa.ErrVerification
+	}
+	return nil
+}
+
+// checkBlindSignature checks that blindSignature is the RSA signature of
+// blindedMessage, i.e., that blindSignature^e = blindedMessage mod n.
+func checkBlindSignature(tokenKey *rsa.PublicKey, blindedMessage, blindSignature []byte) error {
+	kLen := tokenKeyLen(tokenKey)
+	if len(blindSignature) != kLen {
+		return ErrBlindUnblindMismatch
+	}
+	z := new(big.Int).SetBytes(blindSignature)
+	if z.Cmp(tokenKey.N) >= 0 {
+		return ErrBlindUnblindMismatch
+	}
+	m := new(big.Int).Exp(z, big.NewInt(int64(tokenKey.E)), tokenKey.N)
+	if subtle.ConstantTimeCompare(m.FillBytes(make([]byte, kLen)), blindedMessage) != 1 {
+		return ErrBlindUnblindMismatch
+	}
+	return nil
+}
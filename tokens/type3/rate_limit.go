@@ -0,0 +1,116 @@
+package type3
+
+import (
+	"container/heap"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// RateLimitStore counts requests per key over fixed windows, for
+// RateLimitedAttester.CheckAndCount. Attesters that run on several hosts
+// should provide a store backed by shared state, e.g., a database with atomic
+// increments.
+type RateLimitStore interface {
+	// Take counts one request for key in its current window, a fixed window of
+	// the given length starting with the first request counted in it, unless
+	// limit requests were already counted there. It returns the number of
+	// requests counted in the window, including this one if it was counted.
+	// The check and the increment must be atomic.
+	Take(key string, limit int, window time.Duration) (count int, taken bool)
+}
+
+type rateLimitWindow struct {
+	count  int
+	expiry time.Time
+}
+
+// MemoryRateLimitStore is a RateLimitStore that keeps its windows in memory.
+// Windows are evicted once they expire, so memory grows with the number of
+// indices seen per window.
+type MemoryRateLimitStore struct {
+	mu       sync.Mutex
+	windows  map[string]rateLimitWindow
+	expiries rateLimitExpiries
+	now      func() time.Time
+}
+
+type rateLimitExpiry struct {
+	key    string
+	expiry time.Time
+}
+
+// rateLimitExpiries is a min-heap of window expiries. Window lengths are
+// chosen per call, so windows do not expire in the order they were opened.
+type rateLimitExpiries []rateLimitExpiry
+
+func (h rateLimitExpiries) Len() int            { return len(h) }
+func (h rateLimitExpiries) Less(i, j int) bool  { return h[i].expiry.Before(h[j].expiry) }
+func (h rateLimitExpiries) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *rateLimitExpiries) Push(x interface{}) { *h = append(*h, x.(rateLimitExpiry)) }
+func (h *rateLimitExpiries) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		windows: make(map[string]rateLimitWindow),
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryRateLimitStore) Take(key string, limit int, window time.Duration) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.evictExpiredLocked(now)
+
+	w, ok := s.windows[key]
+	if !ok {
+		w = rateLimitWindow{expiry: now.Add(window)}
+		heap.Push(&s.expiries, rateLimitExpiry{key, w.expiry})
+	}
+	if w.count >= limit {
+		return w.count, false
+	}
+	w.count++
+	s.windows[key] = w
+	return w.count, true
+}
+
+// evictExpiredLocked drops expired windows, visiting only the expired ones.
+func (s *MemoryRateLimitStore) evictExpiredLocked(now time.Time) {
+	for s.expiries.Len() > 0 && !now.Before(s.expiries[0].expiry) {
+		item := heap.Pop(&s.expiries).(rateLimitExpiry)
+		if w, ok := s.windows[item.key]; ok && w.expiry.Equal(item.expiry) {
+			delete(s.windows, item.key)
+		}
+	}
+}
+
+// SetRateLimitStore configures the store CheckAndCount counts requests in. The
+// default is a MemoryRateLimitStore.
+func (a *RateLimitedAttester) SetRateLimitStore(store RateLimitStore) {
+	a.rateLimits = store
+}
+
+// CheckAndCount enforces a rate limit of limit requests per window for the
+// anonymous issuer origin ID index, as returned by FinalizeIndex, i.e., per
+// client and origin. It counts the request and reports true if the limit is
+// not yet reached, and reports false without counting it otherwise. remaining
+// is the number of requests still allowed in the current window.
+func (a *RateLimitedAttester) CheckAndCount(index []byte, limit int, window time.Duration) (allowed bool, remaining int) {
+	if limit <= 0 {
+		return false, 0
+	}
+	count, taken := a.rateLimits.Take(hex.EncodeToString(index), limit, window)
+	remaining = limit - count
+	if remaining < 0 {
+		remaining = 0
+	}
+	return taken, remaining
+}
@@ -0,0 +1,72 @@
+package type3
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckAndCount(t *testing.T) {
+	attester := NewRateLimitedAttester(NewMemoryClientStateCache())
+	store := NewMemoryRateLimitStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	attester.SetRateLimitStore(store)
+
+	index := []byte("index")
+	otherIndex := []byte("other index")
+	limit := 3
+	window := time.Hour
+	for j := 0; j < limit; j++ {
+		allowed, remaining := attester.CheckAndCount(index, limit, window)
+		if !allowed || remaining != limit-j-1 {
+			t.Fatalf("request %d: allowed %v, remaining %d", j, allowed, remaining)
+		}
+	}
+
+	// The limit is exceeded, and denied requests are not counted
+	for j := 0; j < 2; j++ {
+		if allowed, remaining := attester.CheckAndCount(index, limit, window); allowed || remaining != 0 {
+			t.Fatalf("request over limit: allowed %v, remaining %d", allowed, remaining)
+		}
+	}
+
+	// Other indices are counted separately
+	if allowed, remaining := attester.CheckAndCount(otherIndex, limit, window); !allowed || remaining != limit-1 {
+		t.Fatalf("other index: allowed %v, remaining %d", allowed, remaining)
+	}
+
+	// Expired windows are evicted and the count starts over
+	now = now.Add(window)
+	if allowed, remaining := attester.CheckAndCount(index, limit, window); !allowed || remaining != limit-1 {
+		t.Fatalf("new window: allowed %v, remaining %d", allowed, remaining)
+	}
+	if len(store.windows) != 1 {
+		t.Fatalf("expected 1 window after eviction, got %d", len(store.windows))
+	}
+
+	if allowed, _ := attester.CheckAndCount(index, 0, window); allowed {
+		t.Fatal("request allowed with a zero limit")
+	}
+}
+
+func TestMemoryRateLimitStoreMixedWindows(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	// Windows opened later may expire earlier
+	store.Take("long", 1, time.Hour)
+	store.Take("short", 1, time.Minute)
+
+	now = now.Add(time.Minute)
+	store.Take("other", 1, time.Hour)
+	if _, ok := store.windows["short"]; ok {
+		t.Fatal("expected the short window to be evicted")
+	}
+	if _, ok := store.windows["long"]; !ok {
+		t.Fatal("expected the long window to be kept")
+	}
+	if len(store.windows) != len(store.expiries) {
+		t.Fatalf("%d windows but %d expiries", len(store.windows), len(store.expiries))
+	}
+}
@@ -0,0 +1,73 @@
+package type3
+
+import (
+	"crypto/rsa"
+)
+
+// Ready returns a channel that is closed once the issuer has a token key, a
+// name key, and at least one origin or an OriginKeyProvider (see
+// IsConfigured), i.e., once it can serve requests. Servers that load keys
+// asynchronously, e.g., from a KMS at startup, can wait on it before taking
+// traffic; HTTPHandler and BatchHTTPHandler fail with 503 until then. The
+// channel stays closed even if origins are later removed, but the handlers
+// fail with 503 again while the issuer has no origins.
+func (i *RateLimitedIssuer) Ready() <-chan struct{} {
+	return i.ready
+}
+
+// canServe reports whether the HTTP handlers should evaluate requests: the
+// issuer must have become ready and must still be configured.
+func (i *RateLimitedIssuer) canServe() bool {
+	return i.isReady() && i.IsConfigured()
+}
+
+func (i *RateLimitedIssuer) isReady() bool {
+	select {
+	case <-i.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// markReadyLocked closes the ready channel if the issuer is fully configured.
+// It must be called with originKeyMu held.
+func (i *RateLimitedIssuer) markReadyLocked() {
+	if i.ready == nil || i.currentTokenKey() == nil || i.currentNameKey().privateKey == nil || !i.isConfiguredLocked() {
+		return
+	}
+	i.readyOnce.Do(func() {
+		close(i.ready)
+	})
+}
+
+// SetTokenKey sets the token key of an issuer created without one, e.g.,
+// with NewRateLimitedIssuer(nil) while the key is fetched from a KMS, or
+// replaces the current token key, which is safe while the issuer serves
+// requests. The key is also added to the keys Evaluate signs with; keys
+// clients may still hold challenges for can be kept alongside it with
+// AddTokenKey. Like AddTokenKey, it fails with ErrTokenKeyIDInUse, and leaves
+// the current token key unchanged, if a key the issuer holds, including the
+// current one, has the same wire key ID.
+func (i *RateLimitedIssuer) SetTokenKey(key *rsa.PrivateKey) error {
+	var keyID []byte
+	if key != nil && key.N != nil {
+		// Keys without a key ID are left for ValidateConfig to report
+		keyID, _ = FullKeyID(&key.PublicKey)
+	}
+
+	i.originKeyMu.Lock()
+	defer i.originKeyMu.Unlock()
+	i.tokenKeyMu.Lock()
+	if keyID != nil {
+		if err := i.checkWireKeyIDLocked(keyID); err != nil {
+			i.tokenKeyMu.Unlock()
+			return err
+		}
+	}
+	i.tokenKey = key
+	i.registerTokenKeyLocked(key)
+	i.tokenKeyMu.Unlock()
+	i.markReadyLocked()
+	return nil
+}
@@ -0,0 +1,153 @@
+package type3
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"testing"
+
+	"github.com/cloudflare/pat-go/ecdsa"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// The checked-in vectors use the reference (upstream cloudflare/pat-go) vector
+// format. This implementation intentionally diverges from it as follows:
+//
+//   - The origin token request carries a single byte of the token key ID, the
+//     first byte of the SHA-256 key ID, in the vectors' token_key_id field.
+//     Only the token carries the full 32-byte key ID.
+//   - The anonymous origin ID vectors blind keys without a context string.
+//     Requests blind the request key with the "ClientBlind" context and the
+//     issuer blinds it with the "IssuerBlind" context (see labelClientBlind and labelIssuerBlind), so
+//     those vectors cover computeIndex but not the request path.
+//
+// A mismatch anywhere else is a bug.
+
+func loadReferenceVectors(t *testing.T, fileName string, vectors json.Unmarshaler) {
+	encoded, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vectors.UnmarshalJSON(encoded); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReferenceOriginEncryptionVectors(t *testing.T) {
+	vectors := originEncryptionTestVectorArray{t: t}
+	loadReferenceVectors(t, "type3-origin-encryption-test-vectors.json", &vectors)
+	if len(vectors.vectors) == 0 {
+		t.Fatal("no vectors")
+	}
+
+	for _, vector := range vectors.vectors {
+		nameKey := vector.nameKey.Public()
+		nameKeyID := sha256.Sum256(nameKey.Marshal())
+		if !bytes.Equal(nameKeyID[:], vector.issuerKeyID) {
+			t.Fatal("name key ID mismatch")
+		}
+
+		// AAD layout from the reference implementation
+		b := cryptobyte.NewBuilder(nil)
+		b.AddUint8(nameKey.id)
+		b.AddUint16(uint16(vector.kemID))
+		b.AddUint16(uint16(vector.kdfID))
+		b.AddUint16(uint16(vector.aeadID))
+		b.AddUint16(vector.tokenType)
+		b.AddBytes(vector.requestKey)
+		b.AddBytes(vector.issuerKeyID)
+		if !bytes.Equal(originTokenRequestAAD(nameKey, vector.requestKey), b.BytesOrPanic()) {
+			t.Fatal("AAD mismatch")
+		}
+
+		originTokenRequest, secret, err := decryptOriginTokenRequest(vector.nameKey, vector.requestKey, vector.encryptedTokenRequest, BlindedMessageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if originTokenRequest.tokenKeyId != vector.tokenKeyID {
+			t.Fatal("token key ID mismatch")
+		}
+		if !bytes.Equal(originTokenRequest.blindedMsg, vector.blindMessage) {
+			t.Fatal("blinded message mismatch")
+		}
+		if unpadOriginName(originTokenRequest.paddedOrigin) != vector.originName {
+			t.Fatal("origin name mismatch")
+		}
+		if !bytes.Equal(secret, vector.encapSecret) {
+			t.Fatal("encap secret mismatch")
+		}
+	}
+}
+
+func TestReferenceAnonOriginIDVectors(t *testing.T) {
+	encoded, err := ioutil.ReadFile("type3-anon-origin-id-test-vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyAnonOriginIDTestVectors(t, encoded)
+}
+
+func TestReferenceRequestAndTokenEncoding(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	request := requestState.Request()
+
+	// The request signature is r || s, each a big-endian P-384 scalar, over
+	// the SHA-384 digest of the request up to the signature
+	curve := elliptic.P384()
+	if len(request.Signature) != 2*48 {
+		t.Fatalf("unexpected signature length %d", len(request.Signature))
+	}
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16(RateLimitedTokenType)
+	b.AddBytes(request.RequestKey)
+	b.AddBytes(request.NameKeyID)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(request.EncryptedTokenRequest)
+	})
+	digest := sha512.Sum384(b.BytesOrPanic())
+	requestKey, err := unmarshalPublicKey(curve, request.RequestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := new(big.Int).SetBytes(request.Signature[:48])
+	s := new(big.Int).SetBytes(request.Signature[48:])
+	if !ecdsa.Verify(requestKey, digest[:], r, s) {
+		t.Fatal("request signature does not verify")
+	}
+
+	response, _, err := issuer.Evaluate(request.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := requestState.FinalizeToken(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The token is token_type || nonce || context || key_id || authenticator,
+	// with an RSASSA-PSS (SHA-384, 48-byte salt) authenticator over the rest
+	tokenEnc := token.Marshal()
+	if len(tokenEnc) != 2+32+32+32+256 {
+		t.Fatalf("unexpected token length %d", len(tokenEnc))
+	}
+	if !bytes.Equal(token.KeyID, issuer.TokenKeyID()) {
+		t.Fatal("token key ID mismatch")
+	}
+	tokenDigest := sha512.Sum384(tokenEnc[:len(tokenEnc)-256])
+	if err := rsa.VerifyPSS(issuer.TokenKey(), crypto.SHA384, tokenDigest[:], tokenEnc[len(tokenEnc)-256:], &rsa.PSSOptions{
+		Hash:       crypto.SHA384,
+		SaltLength: 48,
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
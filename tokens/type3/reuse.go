@@ -0,0 +1,94 @@
+package type3
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrCrossOriginReuse = errors.New("blinded message reused across origins")
+)
+
+// BlindedMessageTracker detects a blinded message being submitted for more
+// than one origin, which a client could use to correlate issuer responses.
+type BlindedMessageTracker interface {
+	// Observe records that the blinded message with the given SHA-256 digest
+	// was submitted for originName, and reports whether it was already seen
+	// for a different origin.
+	Observe(blindedMsgDigest [32]byte, originName string) bool
+}
+
+type blindedMessageEntry struct {
+	originDigest [32]byte
+	expiry       time.Time
+}
+
+// MemoryBlindedMessageTracker is a BlindedMessageTracker that remembers each
+// blinded message for a fixed window. It stores two SHA-256 digests and an
+// expiry per blinded message, roughly 100 bytes with map overhead, so memory
+// grows with the issuance rate times the window. Deployments that need a
+// longer window or shared state across issuers should provide their own
+// BlindedMessageTracker.
+type MemoryBlindedMessageTracker struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[[32]byte]blindedMessageEntry
+	queue   []blindedMessageExpiry // observation, and thus expiry, order
+	now     func() time.Time
+}
+
+// blindedMessageExpiry records when an observation of a blinded message
+// expires. A later observation of the same message supersedes it.
+type blindedMessageExpiry struct {
+	blindedMsgDigest [32]byte
+	expiry           time.Time
+}
+
+func NewMemoryBlindedMessageTracker(window time.Duration) *MemoryBlindedMessageTracker {
+	return &MemoryBlindedMessageTracker{
+		window:  window,
+		entries: make(map[[32]byte]blindedMessageEntry),
+		now:     time.Now,
+	}
+}
+
+func (t *MemoryBlindedMessageTracker) Observe(blindedMsgDigest [32]byte, originName string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.evictExpiredLocked(now)
+
+	originDigest := sha256.Sum256([]byte(originName))
+	entry, ok := t.entries[blindedMsgDigest]
+	if ok && entry.originDigest != originDigest {
+		return true
+	}
+
+	expiry := now.Add(t.window)
+	t.entries[blindedMsgDigest] = blindedMessageEntry{
+		originDigest: originDigest,
+		expiry:       expiry,
+	}
+	t.queue = append(t.queue, blindedMessageExpiry{blindedMsgDigest, expiry})
+	return false
+}
+
+// evictExpiredLocked drops expired entries. Every observation has the same
+// window, so the queue is in expiry order and only its expired prefix is
+// visited. Queue items superseded by a later observation are skipped.
+func (t *MemoryBlindedMessageTracker) evictExpiredLocked(now time.Time) {
+	n := 0
+	for ; n < len(t.queue); n++ {
+		item := t.queue[n]
+		if now.Before(item.expiry) {
+			break
+		}
+		if entry, ok := t.entries[item.blindedMsgDigest]; ok && entry.expiry.Equal(item.expiry) {
+			delete(t.entries, item.blindedMsgDigest)
+		}
+	}
+	t.queue = t.queue[n:]
+}
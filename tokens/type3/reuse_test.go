@@ -0,0 +1,99 @@
+package type3
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	mathrand "math/rand"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/pat-go/ecdsa"
+)
+
+func TestCrossOriginBlindedMessageReuse(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	origins := []string{"a.example", "b.example"}
+	for _, origin := range origins {
+		issuer.AddOrigin(origin)
+	}
+	tracker := NewMemoryBlindedMessageTracker(time.Minute)
+	issuer.SetBlindedMessageTracker(tracker)
+
+	curve := elliptic.P384()
+	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge := make([]byte, 32)
+	rand.Reader.Read(challenge)
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+
+	// Requests for both origins built from the same nonce, blind, and blinding
+	// randomness share the same blinded message
+	requestStates := make([]RateLimitedTokenRequestState, len(origins))
+	for i, origin := range origins {
+		rng := mathrand.New(mathrand.NewSource(1))
+		requestStates[i], err = client.CreateTokenRequestWithRandom(rng, challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), origin, issuer.NameKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := issuer.Evaluate(requestStates[0].Request().Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	// Retrying for the same origin is allowed
+	if _, _, err := issuer.Evaluate(requestStates[0].Request().Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := issuer.Evaluate(requestStates[1].Request().Marshal()); err != ErrCrossOriginReuse {
+		t.Fatalf("expected ErrCrossOriginReuse, got %v", err)
+	}
+
+	// Once the window has passed, the blinded message is forgotten
+	tracker.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if _, _, err := issuer.Evaluate(requestStates[1].Request().Marshal()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryBlindedMessageTrackerEviction(t *testing.T) {
+	tracker := NewMemoryBlindedMessageTracker(time.Minute)
+	now := time.Now()
+	tracker.now = func() time.Time { return now }
+
+	first := sha256.Sum256([]byte("first"))
+	second := sha256.Sum256([]byte("second"))
+	tracker.Observe(first, "a.example")
+	now = now.Add(30 * time.Second)
+	tracker.Observe(second, "a.example")
+	// Observing first again extends its window past the earlier expiry
+	tracker.Observe(first, "a.example")
+
+	now = now.Add(45 * time.Second)
+	if !tracker.Observe(first, "b.example") {
+		t.Fatal("expected the renewed observation to be kept")
+	}
+	if !tracker.Observe(second, "b.example") {
+		t.Fatal("expected the second observation to be kept")
+	}
+
+	now = now.Add(time.Minute)
+	if tracker.Observe(first, "b.example") {
+		t.Fatal("expected the observation to expire")
+	}
+	if len(tracker.entries) != 1 {
+		t.Fatalf("expected 1 entry after eviction, got %d", len(tracker.entries))
+	}
+}
@@ -0,0 +1,35 @@
+package type3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// OriginStatKeyer derives stable keys for origin names for use in metrics and
+// logs. Keys are HMAC-SHA256 under an operator secret rather than plain hashes,
+// so that someone who obtains the metrics or logs cannot recover the origins
+// by hashing a dictionary of candidate names.
+type OriginStatKeyer struct {
+	secret []byte
+}
+
+// NewOriginStatKeyer returns a keyer for the given operator secret, which
+// should be at least 32 random bytes. Keys are only comparable across issuers
+// sharing the same secret.
+func NewOriginStatKeyer(secret []byte) OriginStatKeyer {
+	return OriginStatKeyer{
+		secret: append([]byte{}, secret...),
+	}
+}
+
+func (k OriginStatKeyer) originStatDigest(origin string) []byte {
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write([]byte(origin))
+	return mac.Sum(nil)
+}
+
+// OriginStatKey returns the hex-encoded key for origin.
+func (k OriginStatKeyer) OriginStatKey(origin string) string {
+	return hex.EncodeToString(k.originStatDigest(origin))
+}
@@ -0,0 +1,59 @@
+package type3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestOriginStatKey(t *testing.T) {
+	keyer := NewOriginStatKeyer([]byte("operator secret"))
+	if keyer.OriginStatKey("origin.example") != keyer.OriginStatKey("origin.example") {
+		t.Fatal("origin stat key is not stable")
+	}
+	if keyer.OriginStatKey("origin.example") == keyer.OriginStatKey("other.example") {
+		t.Fatal("different origins have the same stat key")
+	}
+
+	unkeyed := sha256.Sum256([]byte("origin.example"))
+	if keyer.OriginStatKey("origin.example") == hex.EncodeToString(unkeyed[:]) {
+		t.Fatal("origin stat key is an unkeyed hash")
+	}
+	if keyer.OriginStatKey("origin.example") == NewOriginStatKeyer([]byte("other secret")).OriginStatKey("origin.example") {
+		t.Fatal("origin stat key does not depend on the secret")
+	}
+}
+
+func TestAuditLogOriginStatKey(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	keyer := NewOriginStatKeyer([]byte("operator secret"))
+	var buf bytes.Buffer
+	log := NewAuditLog(&buf)
+	log.SetOriginStatKeyer(keyer)
+	issuer.SetAuditLog(log)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	if _, _, err := issuer.Evaluate(requestState.Request().Marshal()); err != nil {
+		t.Fatal(err)
+	}
+
+	logData := buf.Bytes()
+	if err := VerifyAuditLog(bytes.NewReader(logData)); err != nil {
+		t.Fatal(err)
+	}
+	unkeyed := sha256.Sum256([]byte(testOrigin))
+	if bytes.Contains(logData, unkeyed[:]) {
+		t.Fatal("audit log contains the unkeyed origin hash")
+	}
+	statKey, err := hex.DecodeString(keyer.OriginStatKey(testOrigin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(logData, statKey) {
+		t.Fatal("audit log does not contain the origin stat key")
+	}
+}
@@ -0,0 +1,67 @@
+package type3
+
+import (
+	"time"
+)
+
+// EvaluatePhase identifies a phase of Evaluate for latency attribution.
+type EvaluatePhase int
+
+const (
+	// Request parsing and HPKE decryption of the origin token request
+	PhaseDecrypt EvaluatePhase = iota
+	// Origin lookup, request signature verification, and request key blinding
+	PhaseVerify
+	// Blind RSA signing of the blinded message
+	PhaseSign
+	// Encryption of the token response
+	PhaseEncrypt
+)
+
+func (p EvaluatePhase) String() string {
+	switch p {
+	case PhaseDecrypt:
+		return "decrypt"
+	case PhaseVerify:
+		return "verify"
+	case PhaseSign:
+		return "sign"
+	case PhaseEncrypt:
+		return "encrypt"
+	default:
+		return "unknown"
+	}
+}
+
+// PhaseTimer receives the duration of each Evaluate phase, in order, as it
+// completes. Phases are contiguous, so their durations add up to the time spent
+// in Evaluate. A request that fails only reports the phases before the
+// failure.
+type PhaseTimer func(phase EvaluatePhase, duration time.Duration)
+
+// SetPhaseTimer configures the timer called for every phase of Evaluate, e.g.,
+// to export per-phase latency histograms. The timer runs synchronously on the
+// evaluating goroutine, so it should be cheap. A nil timer disables timing,
+// in which case Evaluate does not read the clock at all.
+func (i *RateLimitedIssuer) SetPhaseTimer(timer PhaseTimer) {
+	i.phaseTimer = timer
+}
+
+// startPhases returns the start time of the first phase, if timing is enabled.
+func (i *RateLimitedIssuer) startPhases() time.Time {
+	if i.phaseTimer == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// endPhase reports the phase that began at start and returns the start time of
+// the next phase.
+func (i *RateLimitedIssuer) endPhase(phase EvaluatePhase, start time.Time) time.Time {
+	if i.phaseTimer == nil {
+		return start
+	}
+	now := time.Now()
+	i.phaseTimer(phase, now.Sub(start))
+	return now
+}
@@ -0,0 +1,47 @@
+package type3
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPhaseTimer(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	var phases []EvaluatePhase
+	var durations []time.Duration
+	issuer.SetPhaseTimer(func(phase EvaluatePhase, duration time.Duration) {
+		phases = append(phases, phase)
+		durations = append(durations, duration)
+	})
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	if _, _, err := issuer.Evaluate(requestState.Request().Marshal()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []EvaluatePhase{PhaseDecrypt, PhaseVerify, PhaseSign, PhaseEncrypt}
+	if len(phases) != len(expected) {
+		t.Fatalf("expected %d phases, got %v", len(expected), phases)
+	}
+	for j, phase := range expected {
+		if phases[j] != phase {
+			t.Fatalf("expected phase %s at %d, got %s", phase, j, phases[j])
+		}
+		if durations[j] <= 0 {
+			t.Fatalf("phase %s has duration %v", phase, durations[j])
+		}
+	}
+
+	// Failing requests only report the phases before the failure
+	phases = nil
+	_, requestState = createTestTokenRequest(t, issuer, "unknown.example")
+	if _, _, err := issuer.Evaluate(requestState.Request().Marshal()); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(phases) != 1 || phases[0] != PhaseDecrypt {
+		t.Fatalf("unexpected phases %v", phases)
+	}
+}
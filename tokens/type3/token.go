@@ -1,12 +1,81 @@
 package type3
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 
 	"github.com/cloudflare/pat-go/tokens"
+	"github.com/cloudflare/pat-go/util"
 	"golang.org/x/crypto/cryptobyte"
 )
 
+var (
+	ErrMalformedToken = errors.New("malformed token")
+	ErrNoMatchingKey  = errors.New("token does not verify under any candidate key")
+	ErrInvalidKeyID   = errors.New("invalid token key ID")
+
+	ErrUnexpectedTokenType = errors.New("challenge is not for the rate-limited token type")
+)
+
+// FullKeyID returns the token key ID, the SHA-256 digest of the token key
+// encoded as SPKI with the RSASSA-PSS OID. Tokens carry the full key ID, and
+// clients and origins use it to match token keys, e.g., against an issuer
+// directory.
+func FullKeyID(tokenKey *rsa.PublicKey) ([]byte, error) {
+	tokenKeyEnc, err := util.MarshalTokenKeyPSSOID(tokenKey)
+	if err != nil {
+		return nil, err
+	}
+	keyID := sha256.Sum256(tokenKeyEnc)
+	return keyID[:], nil
+}
+
+// TokenKeyEqual reports whether a and b are the same token key, e.g., to check
+// that a token key fetched from an issuer directory is the expected one. The
+// moduli are compared in constant time. Two nil keys are equal.
+func TokenKeyEqual(a, b *rsa.PublicKey) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.N == nil || b.N == nil {
+		return a.N == nil && b.N == nil && a.E == b.E
+	}
+	return a.E == b.E && subtle.ConstantTimeCompare(a.N.Bytes(), b.N.Bytes()) == 1
+}
+
+// WireKeyID returns the truncated key ID carried in origin token requests, the
+// first byte of the full key ID. It only hints at the token key to use and
+// collides across keys, so it must not be used to match keys.
+func WireKeyID(fullKeyID []byte) (uint8, error) {
+	if len(fullKeyID) != RateLimitedParams().KeyIDSize {
+		return 0, fmt.Errorf("%w: %d bytes, expected a full key ID", ErrInvalidKeyID, len(fullKeyID))
+	}
+	return fullKeyID[0], nil
+}
+
+// UnmarshalTokenChallenge decodes a TokenChallenge (see
+// tokens.UnmarshalTokenChallenge) and checks that it asks for a rate-limited
+// token. Clients pass the encoded challenge itself, not the decoded one, to
+// CreateTokenRequest.
+func UnmarshalTokenChallenge(data []byte) (tokens.TokenChallenge, error) {
+	challenge, err := tokens.UnmarshalTokenChallenge(data)
+	if err != nil {
+		return tokens.TokenChallenge{}, err
+	}
+	if challenge.TokenType != RateLimitedTokenType {
+		return tokens.TokenChallenge{}, fmt.Errorf("%w: 0x%04x", ErrUnexpectedTokenType, challenge.TokenType)
+	}
+	return challenge, nil
+}
+
+// UnmarshalToken decodes a rate-limited token. The authenticator is the rest of
+// the encoding, which must be the authenticator size of a supported token key
+// size.
 func UnmarshalToken(data []byte) (tokens.Token, error) {
 	s := cryptobyte.String(data)
 
@@ -15,9 +84,145 @@ func UnmarshalToken(data []byte) (tokens.Token, error) {
 		!s.ReadBytes(&token.Nonce, 32) ||
 		!s.ReadBytes(&token.Context, 32) ||
 		!s.ReadBytes(&token.KeyID, 32) ||
-		!s.ReadBytes(&token.Authenticator, 256) {
+		!isSupportedTokenKeyLen(len(s)) ||
+		!s.ReadBytes(&token.Authenticator, len(s)) {
 		return tokens.Token{}, fmt.Errorf("invalid Token encoding")
 	}
 
 	return token, nil
 }
+
+// ValidateToken performs structural checks on a rate-limited token, as a cheap
+// filter before verifying its authenticator. If tokenKey is nil, the
+// authenticator length is not checked against the modulus size.
+func ValidateToken(token tokens.Token, tokenKey *rsa.PublicKey) error {
+	params := RateLimitedParams()
+	if token.TokenType != RateLimitedTokenType {
+		return fmt.Errorf("%w: token type 0x%04x", ErrMalformedToken, token.TokenType)
+	}
+	if len(token.Nonce) != params.NonceSize {
+		return fmt.Errorf("%w: nonce length %d", ErrMalformedToken, len(token.Nonce))
+	}
+	if len(token.Context) != params.ContextSize {
+		return fmt.Errorf("%w: context length %d", ErrMalformedToken, len(token.Context))
+	}
+	if len(token.KeyID) != crypto.SHA256.Size() {
+		return fmt.Errorf("%w: key ID length %d", ErrMalformedToken, len(token.KeyID))
+	}
+	if tokenKey != nil && len(token.Authenticator) != tokenKeyLen(tokenKey) {
+		return fmt.Errorf("%w: authenticator length %d", ErrMalformedToken, len(token.Authenticator))
+	}
+	return nil
+}
+
+// VerifyToken verifies the token authenticator against the token key, as an
+// origin does when a token is redeemed. It checks the EMSA-PSS signature with
+// SHA-384 over the authenticator input and the default salt length, i.e., the
+// parameters of the default BlindRSAVariantPSS variant. It does not check the
+// token context; see TokenMatchesChallenge.
+func VerifyToken(token tokens.Token, tokenKey *rsa.PublicKey) error {
+	if tokenKey == nil {
+		return ErrNilTokenKey
+	}
+	return verifyToken(tokenKey, BlindRSAVariantPSS, RateLimitedParams().SaltLength, token)
+}
+
+// VerifyTokenAny verifies the token against each candidate key, e.g., the
+// current and previous token keys during a key rotation, and returns the key it
+// verifies under. The key whose ID matches the token's key ID is tried first,
+// so a well-formed token costs a single verification.
+func VerifyTokenAny(token tokens.Token, keys []*rsa.PublicKey) (*rsa.PublicKey, error) {
+	params := RateLimitedParams()
+	preferred := -1
+	for j, key := range keys {
+		if key == nil {
+			continue
+		}
+		keyEnc, err := util.MarshalTokenKeyPSSOID(key)
+		if err != nil {
+			continue
+		}
+		keyID := sha256.Sum256(keyEnc)
+		if bytes.Equal(keyID[:], token.KeyID) {
+			preferred = j
+			break
+		}
+	}
+	if preferred >= 0 && verifyToken(keys[preferred], BlindRSAVariantPSS, params.SaltLength, token) == nil {
+		return keys[preferred], nil
+	}
+
+	for j, key := range keys {
+		if j == preferred || key == nil {
+			continue
+		}
+		if verifyToken(key, BlindRSAVariantPSS, params.SaltLength, token) == nil {
+			return key, nil
+		}
+	}
+	return nil, ErrNoMatchingKey
+}
+
+// Version of the origin-bound context derivation, bumped on any change to it.
+const originBoundContextVersion = 0x01
+
+// OriginBoundContext returns the token context binding a token to both the
+// challenge and the origin it was requested for (see
+// RateLimitedClient.WithOriginBoundContext).
+func OriginBoundContext(challenge []byte, originName string) []byte {
+	challengeDigest := sha256.Sum256(challenge)
+
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16(RateLimitedTokenType)
+	b.AddBytes([]byte("OriginBoundContext"))
+	b.AddUint8(originBoundContextVersion)
+	b.AddBytes(challengeDigest[:])
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte(originName))
+	})
+	context := sha256.Sum256(b.BytesOrPanic())
+	return context[:]
+}
+
+// TokenMatchesOrigin reports whether the token has the origin-bound context for
+// the challenge and originName, i.e., it was requested for that origin. The
+// authenticator must still be verified separately.
+func TokenMatchesOrigin(token tokens.Token, challenge []byte, originName string) bool {
+	return subtle.ConstantTimeCompare(token.Context, OriginBoundContext(challenge, originName)) == 1
+}
+
+// Version of the redemption-bound context derivation, bumped on any change to
+// it.
+const redemptionBoundContextVersion = 0x01
+
+// RedemptionBoundContext returns the token context binding a token to both the
+// challenge and a redemption context chosen by the client, e.g., a session
+// identifier the origin will require at redemption (see
+// RateLimitedClient.WithRedemptionContext). It is
+//
+//	SHA-256(token_type || "RedemptionBoundContext" || version ||
+//	        SHA-256(challenge) || uint16 len || redemption_context)
+//
+// with token_type a uint16 and version a uint8. This is separate from the
+// redemption nonce in the challenge, which the origin chooses.
+func RedemptionBoundContext(challenge, redemptionContext []byte) []byte {
+	challengeDigest := sha256.Sum256(challenge)
+
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16(RateLimitedTokenType)
+	b.AddBytes([]byte("RedemptionBoundContext"))
+	b.AddUint8(redemptionBoundContextVersion)
+	b.AddBytes(challengeDigest[:])
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(redemptionContext)
+	})
+	context := sha256.Sum256(b.BytesOrPanic())
+	return context[:]
+}
+
+// TokenMatchesRedemptionContext reports whether the token has the
+// redemption-bound context for the challenge and redemptionContext. The
+// authenticator must still be verified separately.
+func TokenMatchesRedemptionContext(token tokens.Token, challenge, redemptionContext []byte) bool {
+	return subtle.ConstantTimeCompare(token.Context, RedemptionBoundContext(challenge, redemptionContext)) == 1
+}
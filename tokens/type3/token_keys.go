@@ -0,0 +1,161 @@
+package type3
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrUnknownTokenKey       = errors.New("unknown token key")
+	ErrTokenKeyIDInUse       = errors.New("token key wire id already in use")
+	ErrRemoveCurrentTokenKey = errors.New("cannot remove the current token key")
+)
+
+// registerTokenKey adds key to the keys Evaluate signs with, if it is usable.
+// Invalid keys are left for ValidateConfig to report.
+func (i *RateLimitedIssuer) registerTokenKey(key *rsa.PrivateKey) {
+	i.tokenKeyMu.Lock()
+	defer i.tokenKeyMu.Unlock()
+	i.registerTokenKeyLocked(key)
+}
+
+// registerTokenKeyLocked is registerTokenKey with tokenKeyMu held.
+func (i *RateLimitedIssuer) registerTokenKeyLocked(key *rsa.PrivateKey) {
+	if key == nil || key.N == nil {
+		return
+	}
+	keyID, err := FullKeyID(&key.PublicKey)
+	if err != nil {
+		return
+	}
+	i.tokenKeys[string(keyID)] = key
+}
+
+// checkWireKeyIDLocked fails with ErrTokenKeyIDInUse if a key other than the
+// one with the full key ID keyID has the same wire key ID. It must be called
+// with tokenKeyMu held.
+func (i *RateLimitedIssuer) checkWireKeyIDLocked(keyID []byte) error {
+	for otherKeyID := range i.tokenKeys {
+		if otherKeyID[0] == keyID[0] && otherKeyID != string(keyID) {
+			return fmt.Errorf("%w: 0x%02x", ErrTokenKeyIDInUse, keyID[0])
+		}
+	}
+	return nil
+}
+
+// currentTokenKey returns the current token key, or nil if there is none.
+func (i *RateLimitedIssuer) currentTokenKey() *rsa.PrivateKey {
+	i.tokenKeyMu.RLock()
+	defer i.tokenKeyMu.RUnlock()
+	return i.tokenKey
+}
+
+// AddTokenKey adds a token key that Evaluate signs with, alongside the current
+// one, e.g., to keep issuing for challenges that reference a previous key
+// while clients move to a new one. Requests select their key by its wire key
+// ID (see WireKeyID), so it fails with ErrTokenKeyIDInUse if another key has
+// the same wire key ID. Adding a key twice is a no-op. The current token key
+// (see TokenKey) is unchanged, unless the issuer has none, in which case the
+// key becomes the current one. Token keys can be added and removed while the
+// issuer serves requests.
+func (i *RateLimitedIssuer) AddTokenKey(key *rsa.PrivateKey) error {
+	if key == nil || key.N == nil {
+		return ErrNilTokenKey
+	}
+	if err := checkTokenKeySize(&key.PublicKey); err != nil {
+		return err
+	}
+	keyID, err := FullKeyID(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	// Lock ordering matches SetTokenKey, as the key may become the current one
+	i.originKeyMu.Lock()
+	defer i.originKeyMu.Unlock()
+	i.tokenKeyMu.Lock()
+	if _, ok := i.tokenKeys[string(keyID)]; ok {
+		i.tokenKeyMu.Unlock()
+		return nil
+	}
+	if err := i.checkWireKeyIDLocked(keyID); err != nil {
+		i.tokenKeyMu.Unlock()
+		return err
+	}
+	i.tokenKeys[string(keyID)] = key
+	becameCurrent := i.tokenKey == nil
+	if becameCurrent {
+		i.tokenKey = key
+	}
+	i.tokenKeyMu.Unlock()
+
+	if becameCurrent {
+		i.markReadyLocked()
+	}
+	return nil
+}
+
+// RemoveTokenKey removes the token key with the given full key ID, after which
+// requests for it fail with ErrUnknownTokenKey. It fails with
+// ErrUnknownTokenKey if there is no such key, and with ErrRemoveCurrentTokenKey
+// for the current token key.
+func (i *RateLimitedIssuer) RemoveTokenKey(id []byte) error {
+	i.tokenKeyMu.Lock()
+	defer i.tokenKeyMu.Unlock()
+	if i.tokenKey != nil && i.tokenKey.N != nil {
+		if currentKeyID, err := FullKeyID(&i.tokenKey.PublicKey); err == nil && string(currentKeyID) == string(id) {
+			return ErrRemoveCurrentTokenKey
+		}
+	}
+	if _, ok := i.tokenKeys[string(id)]; !ok {
+		return ErrUnknownTokenKey
+	}
+	delete(i.tokenKeys, string(id))
+	return nil
+}
+
+// lookupTokenKey returns the token key with the given wire key ID, and its full
+// key ID, preferring the current token key.
+func (i *RateLimitedIssuer) lookupTokenKey(wireKeyID uint8) (*rsa.PrivateKey, []byte, bool) {
+	i.tokenKeyMu.RLock()
+	defer i.tokenKeyMu.RUnlock()
+	var match *rsa.PrivateKey
+	var matchID string
+	for keyID, key := range i.tokenKeys {
+		if keyID[0] != wireKeyID {
+			continue
+		}
+		if key == i.tokenKey {
+			return key, []byte(keyID), true
+		}
+		match, matchID = key, keyID
+	}
+	return match, []byte(matchID), match != nil
+}
+
+// tokenKeyLens returns the distinct blinded message sizes of the issuer's token
+// keys, that of the current key first, or the default size if it has none.
+func (i *RateLimitedIssuer) tokenKeyLens() []int {
+	i.tokenKeyMu.RLock()
+	defer i.tokenKeyMu.RUnlock()
+
+	var lens []int
+	if i.tokenKey != nil && i.tokenKey.N != nil {
+		lens = append(lens, tokenKeyLen(&i.tokenKey.PublicKey))
+	}
+	for _, key := range i.tokenKeys {
+		kLen := tokenKeyLen(&key.PublicKey)
+		seen := false
+		for _, l := range lens {
+			seen = seen || l == kLen
+		}
+		if !seen {
+			lens = append(lens, kLen)
+		}
+	}
+	if len(lens) == 0 {
+		lens = append(lens, BlindedMessageSize)
+	}
+	return lens
+}
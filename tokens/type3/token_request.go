@@ -2,7 +2,11 @@ package type3
 
 import (
 	"bytes"
+	"crypto/elliptic"
+	"encoding/hex"
+	"fmt"
 
+	"github.com/cloudflare/pat-go/util"
 	"golang.org/x/crypto/cryptobyte"
 )
 
@@ -10,13 +14,36 @@ var (
 	RateLimitedTokenType = uint16(0x0003)
 )
 
+const (
+	// ExtensionTypeIdempotencyKey is the type of the token request extension
+	// that carries IdempotencyKey.
+	ExtensionTypeIdempotencyKey = uint16(0xff01)
+
+	// MaxIdempotencyKeySize is the maximum size of an idempotency key.
+	MaxIdempotencyKeySize = 64
+)
+
 // https://tfpauly.github.io/privacy-proxy/draft-privacypass-rate-limit-tokens.html#section-5.3
+//
+// A request may end with a list of extensions after the signature:
+//
+//	struct {
+//	    uint16 extension_type;
+//	    opaque extension_data<1..2^16-1>;
+//	} Extension;
+//
+//	Extension extensions<1..2^16-1>;
+//
+// The list is omitted if there are no extensions. The only extension is the
+// idempotency key (see EvaluateContext), and it is not covered by the
+// signature, so that a client can add it to a request it already created.
 type RateLimitedTokenRequest struct {
 	raw                   []byte
 	RequestKey            []byte // Npk bytes
 	NameKeyID             []byte // 32 bytes
 	EncryptedTokenRequest []byte // 16-bit length prefixed slice
 	Signature             []byte // Nsig bytes
+	IdempotencyKey        []byte // Optional, at most MaxIdempotencyKeySize bytes
 }
 
 func (r RateLimitedTokenRequest) Type() uint16 {
@@ -27,7 +54,8 @@ func (r RateLimitedTokenRequest) Equal(r2 RateLimitedTokenRequest) bool {
 	if bytes.Equal(r.RequestKey, r2.RequestKey) &&
 		bytes.Equal(r.NameKeyID, r2.NameKeyID) &&
 		bytes.Equal(r.EncryptedTokenRequest, r2.EncryptedTokenRequest) &&
-		bytes.Equal(r.Signature, r2.Signature) {
+		bytes.Equal(r.Signature, r2.Signature) &&
+		bytes.Equal(r.IdempotencyKey, r2.IdempotencyKey) {
 		return true
 	}
 
@@ -47,19 +75,50 @@ func (r *RateLimitedTokenRequest) Marshal() []byte {
 		b.AddBytes(r.EncryptedTokenRequest)
 	})
 	b.AddBytes(r.Signature)
+	if len(r.IdempotencyKey) > 0 {
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(ExtensionTypeIdempotencyKey)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(r.IdempotencyKey)
+			})
+		})
+	}
 
 	r.raw = b.BytesOrPanic()
 	return r.raw
 }
 
+// SetIdempotencyKey sets the idempotency key carried in the request's
+// extensions, or removes it if key is empty, and drops any encoding cached by
+// Marshal. The signature does not cover the key, so it can be set after the
+// request was created.
+func (r *RateLimitedTokenRequest) SetIdempotencyKey(key []byte) {
+	r.IdempotencyKey = key
+	r.raw = nil
+}
+
+// Unmarshal decodes a request encoded by Marshal, rejecting truncated inputs,
+// trailing data, and extensions other than a single idempotency key of at most
+// MaxIdempotencyKeySize bytes. The decoded request re-encodes to exactly data. The
+// request key must be on P-384; see UnmarshalForCurve for other curves.
 func (r *RateLimitedTokenRequest) Unmarshal(data []byte) bool {
+	return r.UnmarshalForCurve(elliptic.P384(), data)
+}
+
+// UnmarshalForCurve is Unmarshal for a request key on curve, which determines
+// the request key and signature sizes. It fails for unsupported curves.
+func (r *RateLimitedTokenRequest) UnmarshalForCurve(curve elliptic.Curve, data []byte) bool {
+	params, err := RateLimitedParamsForCurve(curve)
+	if err != nil {
+		return false
+	}
 	s := cryptobyte.String(data)
 
 	var tokenType uint16
 	if !s.ReadUint16(&tokenType) ||
 		tokenType != RateLimitedTokenType ||
-		!s.ReadBytes(&r.RequestKey, 49) ||
-		!s.ReadBytes(&r.NameKeyID, 32) {
+		!s.ReadBytes(&r.RequestKey, params.RequestKeySize) ||
+		!s.ReadBytes(&r.NameKeyID, params.NameKeyIDSize) {
 		return false
 	}
 
@@ -70,10 +129,146 @@ func (r *RateLimitedTokenRequest) Unmarshal(data []byte) bool {
 	r.EncryptedTokenRequest = make([]byte, len(encryptedTokenRequest))
 	copy(r.EncryptedTokenRequest, encryptedTokenRequest)
 
-	s.ReadBytes(&r.Signature, 96)
-	if !s.Empty() {
+	if !s.ReadBytes(&r.Signature, params.SignatureSize) {
 		return false
 	}
 
+	r.IdempotencyKey = nil
+	if !s.Empty() {
+		var extensions cryptobyte.String
+		var extensionType uint16
+		var idempotencyKey cryptobyte.String
+		if !s.ReadUint16LengthPrefixed(&extensions) || !s.Empty() ||
+			!extensions.ReadUint16(&extensionType) ||
+			extensionType != ExtensionTypeIdempotencyKey ||
+			!extensions.ReadUint16LengthPrefixed(&idempotencyKey) || !extensions.Empty() ||
+			idempotencyKey.Empty() || len(idempotencyKey) > MaxIdempotencyKeySize {
+			return false
+		}
+		r.IdempotencyKey = make([]byte, len(idempotencyKey))
+		copy(r.IdempotencyKey, idempotencyKey)
+	}
+
+	// Drop any encoding cached by Marshal before the request was overwritten
+	r.raw = nil
 	return true
 }
+
+// String returns a human-readable dump of the request for logs and test
+// failures. It shows the public fields in hex and only the length of the
+// encrypted origin token request, so it reveals nothing that decryption would.
+func (r *RateLimitedTokenRequest) String() string {
+	return fmt.Sprintf("RateLimitedTokenRequest{token_type: 0x%04x, request_key: %s, name_key_id: %s, encrypted_token_request: %d bytes, signature: %s, idempotency_key: %s}",
+		RateLimitedTokenType,
+		hex.EncodeToString(r.RequestKey),
+		hex.EncodeToString(r.NameKeyID),
+		len(r.EncryptedTokenRequest),
+		hex.EncodeToString(r.Signature),
+		hex.EncodeToString(r.IdempotencyKey))
+}
+
+// FieldSpec describes one field of a wire format encoding.
+type FieldSpec struct {
+	Name         string
+	Offset       int // Byte offset of the field, or -1 if it follows a variable-length field
+	Size         int // Size of the field in bytes, or 0 if it is variable-length
+	LengthPrefix int // Size of the field's length prefix in bytes, or 0 if it is fixed-length
+}
+
+// RateLimitedTokenRequestLayout returns the fields of the RateLimitedTokenRequest
+// encoding produced by Marshal, in order. The token key ID is not among them:
+// its single wire byte (see WireKeyID) is part of the encrypted origin token
+// request. Neither are extensions (see RateLimitedTokenRequest), which follow
+// the signature when present. Sizes are for request keys on P-384.
+func RateLimitedTokenRequestLayout() []FieldSpec {
+	params := RateLimitedParams()
+	return []FieldSpec{
+		{Name: "token_type", Offset: 0, Size: 2},
+		{Name: "request_key", Offset: 2, Size: params.RequestKeySize},
+		{Name: "name_key_id", Offset: 2 + params.RequestKeySize, Size: params.NameKeyIDSize},
+		{Name: "encrypted_token_request", Offset: 2 + params.RequestKeySize + params.NameKeyIDSize, LengthPrefix: 2},
+		{Name: "signature", Offset: -1, Size: params.SignatureSize},
+	}
+}
+
+// CBOR map keys for RateLimitedTokenRequest fields.
+const (
+	cborKeyTokenType             = 1
+	cborKeyRequestKey            = 2
+	cborKeyNameKeyID             = 3
+	cborKeyEncryptedTokenRequest = 4
+	cborKeySignature             = 5
+	cborKeyIdempotencyKey        = 6
+)
+
+// MarshalCBOR encodes the request as a deterministic CBOR map with integer
+// keys. This is a transport convenience for ecosystems that prefer CBOR, not
+// the Privacy Pass wire format; use Marshal for interoperability. The
+// idempotency key is included only if it is set.
+func (r *RateLimitedTokenRequest) MarshalCBOR() ([]byte, error) {
+	fields := map[uint64]interface{}{
+		cborKeyTokenType:             uint64(RateLimitedTokenType),
+		cborKeyRequestKey:            r.RequestKey,
+		cborKeyNameKeyID:             r.NameKeyID,
+		cborKeyEncryptedTokenRequest: r.EncryptedTokenRequest,
+		cborKeySignature:             r.Signature,
+	}
+	if len(r.IdempotencyKey) > 0 {
+		fields[cborKeyIdempotencyKey] = r.IdempotencyKey
+	}
+	return util.MarshalCBORMap(fields)
+}
+
+// UnmarshalCBOR decodes a request encoded with MarshalCBOR, applying the same
+// field size checks as UnmarshalForCurve for the curve of the request key.
+func (r *RateLimitedTokenRequest) UnmarshalCBOR(data []byte) error {
+	fields, err := util.UnmarshalCBORMap(data)
+	if err != nil {
+		return err
+	}
+	expectedFields := 5
+	var idempotencyKey []byte
+	if _, ok := fields[cborKeyIdempotencyKey]; ok {
+		idempotencyKey, ok = util.CBORBytes(fields, cborKeyIdempotencyKey)
+		if !ok || len(idempotencyKey) == 0 || len(idempotencyKey) > MaxIdempotencyKeySize {
+			return util.ErrInvalidCBOR
+		}
+		expectedFields++
+	}
+	if len(fields) != expectedFields {
+		return util.ErrInvalidCBOR
+	}
+
+	tokenType, ok := util.CBORUint(fields, cborKeyTokenType)
+	if !ok || tokenType != uint64(RateLimitedTokenType) {
+		return util.ErrInvalidCBOR
+	}
+	requestKey, ok1 := util.CBORBytes(fields, cborKeyRequestKey)
+	nameKeyID, ok2 := util.CBORBytes(fields, cborKeyNameKeyID)
+	encryptedTokenRequest, ok3 := util.CBORBytes(fields, cborKeyEncryptedTokenRequest)
+	signature, ok4 := util.CBORBytes(fields, cborKeySignature)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return util.ErrInvalidCBOR
+	}
+	// CBOR fields carry their own lengths, so the curve follows from the
+	// request key size
+	curve, err := curveForRequestKey(requestKey)
+	if err != nil {
+		return util.ErrInvalidCBOR
+	}
+	params := rateLimitedParams(curve)
+	if len(nameKeyID) != params.NameKeyIDSize ||
+		len(encryptedTokenRequest) == 0 || len(encryptedTokenRequest) > 0xffff ||
+		len(signature) != params.SignatureSize {
+		return util.ErrInvalidCBOR
+	}
+
+	*r = RateLimitedTokenRequest{
+		RequestKey:            requestKey,
+		NameKeyID:             nameKeyID,
+		EncryptedTokenRequest: encryptedTokenRequest,
+		Signature:             signature,
+		IdempotencyKey:        idempotencyKey,
+	}
+	return nil
+}
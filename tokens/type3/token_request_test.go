@@ -1,22 +1,30 @@
 package type3
 
 import (
+	"bytes"
 	"crypto/elliptic"
 	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
 	"testing"
 
 	"github.com/cloudflare/pat-go/ecdsa"
+	"golang.org/x/crypto/cryptobyte"
 )
 
 func TestRequestMarshal(t *testing.T) {
-	issuer := NewRateLimitedIssuer(loadPrivateKey(t))
+	issuer := createTestIssuer(t, loadPrivateKey(t))
 	testOrigin := "origin.example"
 	issuer.AddOrigin(testOrigin)
 
 	curve := elliptic.P384()
 	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
 	blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
-	client := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	challenge := make([]byte, 32)
 	rand.Reader.Read(challenge)
@@ -43,3 +51,266 @@ func TestRequestMarshal(t *testing.T) {
 		t.Fatal("Token marshal mismatch")
 	}
 }
+
+func TestRequestUnmarshalMalformed(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	encoded := requestState.Request().Marshal()
+
+	// Every truncation fails, including one that drops the whole signature
+	params := RateLimitedParams()
+	for n := 0; n < len(encoded); n++ {
+		var decoded RateLimitedTokenRequest
+		if decoded.Unmarshal(encoded[:n]) {
+			t.Fatalf("truncated request of %d bytes decoded", n)
+		}
+	}
+	withoutSignature := encoded[:len(encoded)-params.SignatureSize]
+	var decoded RateLimitedTokenRequest
+	if decoded.Unmarshal(withoutSignature) {
+		t.Fatal("request without signature decoded")
+	}
+	if decoded.Unmarshal(append(append([]byte{}, encoded...), 0x00)) {
+		t.Fatal("request with trailing data decoded")
+	}
+	wrongType := append([]byte{}, encoded...)
+	wrongType[1] = 0x02
+	if decoded.Unmarshal(wrongType) {
+		t.Fatal("request with wrong token type decoded")
+	}
+	emptyEncryptedRequest := append(append([]byte{}, encoded[:2+params.RequestKeySize+params.NameKeyIDSize]...), 0x00, 0x00)
+	emptyEncryptedRequest = append(emptyEncryptedRequest, make([]byte, params.SignatureSize)...)
+	if decoded.Unmarshal(emptyEncryptedRequest) {
+		t.Fatal("request with empty encrypted token request decoded")
+	}
+
+	// Decoding into a request that was already marshaled replaces its
+	// cached encoding
+	_, otherState := createTestTokenRequest(t, issuer, testOrigin)
+	reused := otherState.Request()
+	reused.Marshal()
+	if !reused.Unmarshal(encoded) {
+		t.Fatal("failed to decode request")
+	}
+	if !bytes.Equal(reused.Marshal(), encoded) {
+		t.Fatal("re-encoded request does not match")
+	}
+}
+
+func TestRequestIdempotencyKey(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	tokenRequest := requestState.Request()
+	encoded := append([]byte{}, tokenRequest.Marshal()...)
+
+	// Setting the key replaces the cached encoding, and the extension follows
+	// the signature
+	idempotencyKey := []byte("retry-key")
+	tokenRequest.SetIdempotencyKey(idempotencyKey)
+	withKey := tokenRequest.Marshal()
+	if !bytes.Equal(withKey[:len(encoded)], encoded) {
+		t.Fatal("extension changed the encoding of the request fields")
+	}
+	var decoded RateLimitedTokenRequest
+	if !decoded.Unmarshal(withKey) {
+		t.Fatal("failed to decode request with an idempotency key")
+	}
+	if !bytes.Equal(decoded.IdempotencyKey, idempotencyKey) || !decoded.Equal(*tokenRequest) {
+		t.Fatal("idempotency key round trip mismatch")
+	}
+	if !bytes.Equal(decoded.Marshal(), withKey) {
+		t.Fatal("re-encoded request does not match")
+	}
+
+	// Decoding a request without extensions clears the key
+	if !decoded.Unmarshal(encoded) || decoded.IdempotencyKey != nil {
+		t.Fatal("decoded request kept a stale idempotency key")
+	}
+
+	extensions := func(extensionType uint16, data []byte) []byte {
+		b := cryptobyte.NewBuilder(append([]byte{}, encoded...))
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(extensionType)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(data)
+			})
+		})
+		return b.BytesOrPanic()
+	}
+	for name, data := range map[string][]byte{
+		"unknown extension": extensions(0x0001, idempotencyKey),
+		"empty key":         extensions(ExtensionTypeIdempotencyKey, nil),
+		"oversized key":     extensions(ExtensionTypeIdempotencyKey, make([]byte, MaxIdempotencyKeySize+1)),
+		"empty extensions":  append(append([]byte{}, encoded...), 0x00, 0x00),
+		"trailing data":     append(extensions(ExtensionTypeIdempotencyKey, idempotencyKey), 0x00),
+		"truncated key":     withKey[:len(withKey)-1],
+		"second extension":  append(extensions(ExtensionTypeIdempotencyKey, idempotencyKey), 0xff, 0x01, 0x00, 0x01, 0x00),
+	} {
+		if decoded.Unmarshal(data) {
+			t.Fatalf("%s: decoded", name)
+		}
+	}
+
+	// The key is not covered by the signature, so the issuer accepts it
+	if _, _, err := issuer.Evaluate(withKey); err != nil {
+		t.Fatal(err)
+	}
+
+	cborEncoded, err := tokenRequest.MarshalCBOR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recovered RateLimitedTokenRequest
+	if err := recovered.UnmarshalCBOR(cborEncoded); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(recovered.Marshal(), withKey) {
+		t.Fatal("CBOR round trip lost the idempotency key")
+	}
+}
+
+func TestRequestCBORRoundTrip(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	tokenRequest := requestState.Request()
+
+	encoded, err := tokenRequest.MarshalCBOR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recovered RateLimitedTokenRequest
+	if err := recovered.UnmarshalCBOR(encoded); err != nil {
+		t.Fatal(err)
+	}
+	if !tokenRequest.Equal(recovered) {
+		t.Fatal("CBOR round trip mismatch")
+	}
+	if !bytes.Equal(tokenRequest.Marshal(), recovered.Marshal()) {
+		t.Fatal("CBOR round trip changed the wire encoding")
+	}
+
+	// The decoded request is accepted by the issuer
+	if _, _, err := issuer.Evaluate(recovered.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := recovered.UnmarshalCBOR(tokenRequest.Marshal()); err == nil {
+		t.Fatal("wire encoding decoded as CBOR")
+	}
+}
+
+func TestRequestString(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	tokenRequest := requestState.Request()
+	dump := tokenRequest.String()
+
+	for _, field := range [][]byte{tokenRequest.RequestKey, tokenRequest.NameKeyID, tokenRequest.Signature} {
+		if !strings.Contains(dump, hex.EncodeToString(field)) {
+			t.Fatalf("missing %x in %s", field, dump)
+		}
+	}
+	if strings.Contains(dump, testOrigin) || strings.Contains(dump, hex.EncodeToString([]byte(testOrigin))) {
+		t.Fatalf("origin name leaked in %s", dump)
+	}
+	if strings.Contains(dump, hex.EncodeToString(tokenRequest.EncryptedTokenRequest)) {
+		t.Fatalf("encrypted token request included in %s", dump)
+	}
+}
+
+func TestRequestLayout(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	tokenRequest := requestState.Request()
+	encoded := tokenRequest.Marshal()
+
+	tokenType := make([]byte, 2)
+	binary.BigEndian.PutUint16(tokenType, RateLimitedTokenType)
+	expected := map[string][]byte{
+		"token_type":              tokenType,
+		"request_key":             tokenRequest.RequestKey,
+		"name_key_id":             tokenRequest.NameKeyID,
+		"encrypted_token_request": tokenRequest.EncryptedTokenRequest,
+		"signature":               tokenRequest.Signature,
+	}
+
+	layout := RateLimitedTokenRequestLayout()
+	if len(layout) != len(expected) {
+		t.Fatalf("expected %d fields, got %d", len(expected), len(layout))
+	}
+	offset := 0
+	for _, field := range layout {
+		if field.Offset >= 0 && field.Offset != offset {
+			t.Fatalf("%s: expected offset %d, got %d", field.Name, offset, field.Offset)
+		}
+		size := field.Size
+		if field.LengthPrefix > 0 {
+			size = 0
+			for _, b := range encoded[offset : offset+field.LengthPrefix] {
+				size = size<<8 | int(b)
+			}
+			offset += field.LengthPrefix
+		}
+		value, ok := expected[field.Name]
+		if !ok {
+			t.Fatalf("unexpected field %s", field.Name)
+		}
+		if !bytes.Equal(encoded[offset:offset+size], value) {
+			t.Fatalf("%s: value mismatch", field.Name)
+		}
+		offset += size
+	}
+	if offset != len(encoded) {
+		t.Fatalf("layout covers %d of %d bytes", offset, len(encoded))
+	}
+}
+
+func TestInnerTokenRequestUnmarshalMalformed(t *testing.T) {
+	blindedMsg := make([]byte, BlindedMessageSize)
+	rand.Reader.Read(blindedMsg)
+	tokenRequest := InnerTokenRequest{
+		tokenKeyId:   0x01,
+		blindedMsg:   blindedMsg,
+		paddedOrigin: padOriginName("origin.example"),
+	}
+	encoded := tokenRequest.Marshal()
+
+	var decoded InnerTokenRequest
+	if !decoded.Unmarshal(encoded) || !bytes.Equal(decoded.Marshal(), encoded) {
+		t.Fatal("failed to round-trip origin token request")
+	}
+
+	if decoded.Unmarshal(append(append([]byte{}, encoded...), 0x00)) {
+		t.Fatal("accepted trailing data")
+	}
+	for _, n := range []int{0, 1, 1 + BlindedMessageSize - 1, 1 + BlindedMessageSize + 1, len(encoded) - 1} {
+		if decoded.Unmarshal(encoded[:n]) {
+			t.Fatalf("accepted %d-byte truncation", n)
+		}
+	}
+
+	// A 3072-bit blinded message does not parse as a 2048-bit one
+	longer := InnerTokenRequest{
+		tokenKeyId:   0x01,
+		blindedMsg:   make([]byte, 384),
+		paddedOrigin: padOriginName("origin.example"),
+	}
+	if decoded.Unmarshal(longer.Marshal()) {
+		t.Fatal("accepted blinded message of the wrong size")
+	}
+}
@@ -2,8 +2,10 @@ package type3
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -12,16 +14,26 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	mathrand "math/rand"
 	"os"
+	"reflect"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	hpke "github.com/cisco/go-hpke"
+	"github.com/cloudflare/circl/blindsign/blindrsa"
 	"golang.org/x/crypto/cryptobyte"
 
 	"github.com/cloudflare/pat-go/ecdsa"
 	"github.com/cloudflare/pat-go/ed25519"
+	"github.com/cloudflare/pat-go/tokens"
+	"github.com/cloudflare/pat-go/util"
 )
 
 // 2048-bit RSA private key
@@ -90,6 +102,14 @@ func loadPrivateKeyForBenchmark(b *testing.B) *rsa.PrivateKey {
 	return privateKey
 }
 
+func createTestIssuer(t testing.TB, key *rsa.PrivateKey) *RateLimitedIssuer {
+	issuer, err := NewRateLimitedIssuer(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issuer
+}
+
 type MemoryClientStateCache struct {
 	cache map[string]*ClientState
 }
@@ -109,6 +129,35 @@ func (c MemoryClientStateCache) Put(clientID string, state *ClientState) {
 	c.cache[clientID] = state
 }
 
+func createTestTokenRequest(t *testing.T, issuer *RateLimitedIssuer, origin string) (RateLimitedClient, RateLimitedTokenRequestState) {
+	curve := elliptic.P384()
+	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge := make([]byte, 32)
+	rand.Reader.Read(challenge)
+
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+
+	requestState, err := client.CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), origin, issuer.NameKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client, requestState
+}
+
 func TestSignatureDifferences(t *testing.T) {
 	_, secretKey, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
@@ -134,14 +183,17 @@ func TestSignatureDifferences(t *testing.T) {
 }
 
 func TestRateLimitedIssuanceRoundTrip(t *testing.T) {
-	issuer := NewRateLimitedIssuer(loadPrivateKey(t))
+	issuer := createTestIssuer(t, loadPrivateKey(t))
 	testOrigin := "origin.example"
 	issuer.AddOrigin(testOrigin)
 
 	curve := elliptic.P384()
 	clientSecretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
 	requestKey, err := ecdsa.GenerateKey(curve, rand.Reader)
-	client := NewRateLimitedClientFromSecret(clientSecretKey.D.Bytes())
+	client, err := NewRateLimitedClientFromSecret(clientSecretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
 	attester := NewRateLimitedAttester(NewMemoryClientStateCache())
 
 	challenge := make([]byte, 32)
@@ -225,7 +277,7 @@ func TestRateLimitedIssuanceRoundTrip(t *testing.T) {
 }
 
 func TestRateLimitedIssuerOriginRepeatFailure(t *testing.T) {
-	issuer := NewRateLimitedIssuer(loadPrivateKey(t))
+	issuer := createTestIssuer(t, loadPrivateKey(t))
 	testOriginA := "A.example"
 	testOriginB := "B.example"
 
@@ -239,7 +291,10 @@ func TestRateLimitedIssuerOriginRepeatFailure(t *testing.T) {
 
 	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
 	blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
-	client := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
 	attester := NewRateLimitedAttester(NewMemoryClientStateCache())
 
 	challenge := make([]byte, 32)
@@ -460,7 +515,7 @@ func generateOriginEncryptionTestVector(t *testing.T, kemID hpke.KEMID, kdfID hp
 	rand.Reader.Read(blindMessage)
 
 	originName := "test.example"
-	_, encryptedTokenRequest, secret, err := encryptOriginTokenRequest(nameKey.Public(), tokenKeyIDBuf[0], blindMessage, requestKey, originName)
+	_, encryptedTokenRequest, secret, err := encryptOriginTokenRequest(rand.Reader, nameKey.Public(), tokenKeyIDBuf[0], blindMessage, requestKey, originName, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -503,7 +558,7 @@ func verifyOriginEncryptionTestVector(t *testing.T, vector originEncryptionTestV
 		t.Fatal(err)
 	}
 
-	originTokenRequest, _, err := decryptOriginTokenRequest(privateNameKey, vector.requestKey, vector.encryptedTokenRequest)
+	originTokenRequest, _, err := decryptOriginTokenRequest(privateNameKey, vector.requestKey, vector.encryptedTokenRequest, BlindedMessageSize)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -786,7 +841,7 @@ func TestVectorVerifyAnonOriginID(t *testing.T) {
 }
 
 func BenchmarkRateLimitedTokenRoundTrip(b *testing.B) {
-	issuer := NewRateLimitedIssuer(loadPrivateKeyForBenchmark(b))
+	issuer := createTestIssuer(b, loadPrivateKeyForBenchmark(b))
 	testOrigin := "origin.example"
 	issuer.AddOrigin(testOrigin)
 
@@ -795,7 +850,10 @@ func BenchmarkRateLimitedTokenRoundTrip(b *testing.B) {
 	curve := elliptic.P384()
 	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
 	requestKey, err := ecdsa.GenerateKey(curve, rand.Reader)
-	client := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		b.Fatal(err)
+	}
 
 	challenge := make([]byte, 32)
 	rand.Reader.Read(challenge)
@@ -860,3 +918,3517 @@ func BenchmarkRateLimitedTokenRoundTrip(b *testing.B) {
 		}
 	})
 }
+
+func TestIssuerValidateConfig(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	issuer.AddOrigin("origin.example")
+	if err := issuer.ValidateConfig(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIssuerValidateConfigMultipleErrors(t *testing.T) {
+	smallKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := createTestIssuer(t, smallKey)
+	issuer.nameKey = PrivateEncapKey{}
+
+	err = issuer.ValidateConfig()
+	if err == nil {
+		t.Fatal("expected configuration errors")
+	}
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("expected ConfigErrors, got %T", err)
+	}
+	if len(errs) != 3 {
+		t.Fatalf("expected 3 configuration errors, got %d: %v", len(errs), err)
+	}
+}
+
+func TestClientPredictIndex(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	curve := elliptic.P384()
+	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	attester := NewRateLimitedAttester(NewMemoryClientStateCache())
+
+	challenge := make([]byte, 32)
+	rand.Reader.Read(challenge)
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+	anonymousOriginID := make([]byte, 32)
+	rand.Reader.Read(anonymousOriginID)
+
+	requestState, err := client.CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKeyEnc := requestState.ClientKey()
+	err = attester.VerifyRequest(*requestState.Request(), blindKey.D.Bytes(), clientKeyEnc, anonymousOriginID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, blindedRequestKey, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := attester.FinalizeIndex(clientKeyEnc, blindKey.D.Bytes(), blindedRequestKey, anonymousOriginID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	originIndexPublicKey, err := issuer.OriginIndexPublicKey(testOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	predictedIndex, err := client.PredictIndex(blindKey.D.Bytes(), originIndexPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(index, predictedIndex) {
+		t.Fatal("predicted index does not match attester index")
+	}
+
+	originIndexKey, err := unmarshalPublicKey(curve, originIndexPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anonymousIssuerOriginID, err := client.AnonymousOriginID(blindKey.D.Bytes(), originIndexKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(index, anonymousIssuerOriginID) {
+		t.Fatal("anonymous origin ID does not match attester index")
+	}
+	if _, err := client.AnonymousOriginID(blindKey.D.Bytes(), nil); err == nil {
+		t.Fatal("expected an error for a missing origin index key")
+	}
+}
+
+func TestIssuerNameKeyRotation(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	if err := issuer.SetNameKeyID(0x01); err != nil {
+		t.Fatal(err)
+	}
+	oldNameKey := issuer.NameKey()
+	if oldNameKey.Marshal()[0] != 0x01 {
+		t.Fatal("name key id not reflected in encoding")
+	}
+
+	if _, err := issuer.RotateNameKey(0x01); err != ErrNameKeyIDInUse {
+		t.Fatalf("expected ErrNameKeyIDInUse, got %v", err)
+	}
+	newNameKey, err := issuer.RotateNameKey(0x02)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := issuer.SetNameKeyID(0x01); err != ErrNameKeyIDInUse {
+		t.Fatalf("expected ErrNameKeyIDInUse, got %v", err)
+	}
+
+	for _, nameKey := range []EncapKey{oldNameKey, newNameKey} {
+		curve := elliptic.P384()
+		secretKey, _ := ecdsa.GenerateKey(curve, rand.Reader)
+		blindKey, _ := ecdsa.GenerateKey(curve, rand.Reader)
+		client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		nonce := make([]byte, 32)
+		rand.Reader.Read(nonce)
+		requestState, err := client.CreateTokenRequest(nonce, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, nameKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(requestState.Request().NameKeyID, nameKeyConfigID(nameKey)) {
+			t.Fatal("request name key ID mismatch")
+		}
+
+		response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = requestState.FinalizeToken(response); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIssuerUnknownNameKey(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	otherIssuer := createTestIssuer(t, loadPrivateKey(t))
+	_, requestState := createTestTokenRequest(t, otherIssuer, testOrigin)
+	_, _, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != ErrUnknownNameKey {
+		t.Fatalf("expected ErrUnknownNameKey, got %v", err)
+	}
+}
+
+func TestIssuerRetiredNameKey(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	// Request against the initial name key, which is then rotated and retired
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	if _, err := issuer.RotateNameKey(0x01); err != nil {
+		t.Fatal(err)
+	}
+	if err := issuer.RetireNameKey(0x01); err != ErrRetireCurrentNameKey {
+		t.Fatalf("expected ErrRetireCurrentNameKey, got %v", err)
+	}
+	if err := issuer.RetireNameKey(0x02); err != ErrUnknownNameKey {
+		t.Fatalf("expected ErrUnknownNameKey, got %v", err)
+	}
+	if err := issuer.RetireNameKey(0x00); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != ErrNameKeyRetired {
+		t.Fatalf("expected ErrNameKeyRetired, got %v", err)
+	}
+
+	_, requestState = createTestTokenRequest(t, issuer, testOrigin)
+	if _, _, err := issuer.Evaluate(requestState.Request().Marshal()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// naiveComputeIndex implements HKDF-SHA384 (RFC 5869) directly with HMAC, for
+// differential testing of computeIndex.
+func naiveComputeIndex(clientKey, indexKey []byte) []byte {
+	extractor := hmac.New(sha512.New384, clientKey)
+	extractor.Write(indexKey)
+	prk := extractor.Sum(nil)
+
+	expander := hmac.New(sha512.New384, prk)
+	expander.Write([]byte("IssuerOriginAlias"))
+	expander.Write([]byte{0x01})
+	return expander.Sum(nil)
+}
+
+func TestComputeIndexDifferential(t *testing.T) {
+	curve := elliptic.P384()
+	for i := 0; i < 16; i++ {
+		clientKey, _ := ecdsa.GenerateKey(curve, rand.Reader)
+		indexKey, _ := ecdsa.GenerateKey(curve, rand.Reader)
+		clientKeyEnc := elliptic.MarshalCompressed(curve, clientKey.X, clientKey.Y)
+		indexKeyEnc := elliptic.MarshalCompressed(curve, indexKey.X, indexKey.Y)
+
+		index, err := computeIndex(clientKeyEnc, indexKeyEnc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(index, naiveComputeIndex(clientKeyEnc, indexKeyEnc)) {
+			t.Fatal("computeIndex mismatch")
+		}
+	}
+}
+
+func BenchmarkFinalizeIndex(b *testing.B) {
+	curve := elliptic.P384()
+	clientKey, _ := ecdsa.GenerateKey(curve, rand.Reader)
+	blindKey, _ := ecdsa.GenerateKey(curve, rand.Reader)
+	originIndexKey, _ := ecdsa.GenerateKey(curve, rand.Reader)
+	clientKeyEnc := elliptic.MarshalCompressed(curve, clientKey.X, clientKey.Y)
+
+	requestKey, err := ecdsa.BlindPublicKeyWithContext(curve, &clientKey.PublicKey, blindKey, blindContext(labelClientBlind))
+	if err != nil {
+		b.Fatal(err)
+	}
+	blindedRequestKey, err := ecdsa.BlindPublicKeyWithContext(curve, requestKey, originIndexKey, blindContext(labelIssuerBlind))
+	if err != nil {
+		b.Fatal(err)
+	}
+	blindedRequestKeyEnc := elliptic.MarshalCompressed(curve, blindedRequestKey.X, blindedRequestKey.Y)
+
+	cache := NewMemoryClientStateCache()
+	cache.Put(hex.EncodeToString(clientKeyEnc), &ClientState{
+		originIndices: make(map[string]string),
+		clientIndices: make(map[string]string),
+		originCounts:  make(map[string]int),
+	})
+	attester := NewRateLimitedAttester(cache)
+	anonymousOriginID := make([]byte, 32)
+	rand.Reader.Read(anonymousOriginID)
+
+	b.Run("FinalizeIndex", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			_, err := attester.FinalizeIndex(clientKeyEnc, blindKey.D.Bytes(), blindedRequestKeyEnc, anonymousOriginID)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("ComputeIndex", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			_, err := computeIndex(clientKeyEnc, blindedRequestKeyEnc)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestFinalizeTokenRejectsForgedResponse(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	_, otherRequestState := createTestTokenRequest(t, issuer, testOrigin)
+
+	// A forger knows enc and the blinded message, but not the exporter secret
+	suite := requestState.nameKey.suite
+	signer := blindrsa.NewRSASigner(loadPrivateKey(t))
+	originTokenRequest, _, err := decryptOriginTokenRequest(issuer.nameKey, requestState.Request().RequestKey, requestState.Request().EncryptedTokenRequest, BlindedMessageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindSignature, err := signer.BlindSign(originTokenRequest.blindedMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	guessedSecret := make([]byte, suite.AEAD.KeySize())
+	rand.Reader.Read(guessedSecret)
+	responseNonce := make([]byte, max(suite.AEAD.KeySize(), suite.AEAD.NonceSize()))
+	rand.Reader.Read(responseNonce)
+	salt := append(append([]byte{}, requestState.encapEnc...), responseNonce...)
+	prk := suite.KDF.Extract(salt, guessedSecret)
+	key := suite.KDF.Expand(prk, []byte(labelResponseKey), suite.AEAD.KeySize())
+	nonce := suite.KDF.Expand(prk, []byte(labelResponseNonce), suite.AEAD.NonceSize())
+	cipher, err := suite.AEAD.New(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgedResponse := append(responseNonce, cipher.Seal(nil, nonce, blindSignature, nil)...)
+
+	if _, err := requestState.FinalizeToken(forgedResponse); err != ErrInvalidResponse {
+		t.Fatalf("expected ErrInvalidResponse, got %v", err)
+	}
+
+	// A genuine response for a different request is bound to a different secret
+	otherResponse, _, err := issuer.Evaluate(otherRequestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := requestState.FinalizeToken(otherResponse); err != ErrInvalidResponse {
+		t.Fatalf("expected ErrInvalidResponse, got %v", err)
+	}
+
+	if _, err := requestState.FinalizeToken(responseNonce[:4]); err != ErrInvalidResponse {
+		t.Fatalf("expected ErrInvalidResponse, got %v", err)
+	}
+}
+
+func TestRateLimitedParams(t *testing.T) {
+	params := RateLimitedParams()
+	if params.TokenType != RateLimitedTokenType {
+		t.Fatal("token type mismatch")
+	}
+	if params.Hash != crypto.SHA384 {
+		t.Fatal("hash mismatch")
+	}
+
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	client, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	if client.curve != params.Curve || issuer.curve != params.Curve {
+		t.Fatal("curve mismatch")
+	}
+
+	nameKey := issuer.NameKey()
+	if nameKey.suite.KEM.ID() != params.KEM || nameKey.suite.KDF.ID() != params.KDF || nameKey.suite.AEAD.ID() != params.AEAD {
+		t.Fatal("name key suite mismatch")
+	}
+
+	request := requestState.Request()
+	if len(request.RequestKey) != params.RequestKeySize ||
+		len(request.NameKeyID) != params.NameKeyIDSize ||
+		len(request.Signature) != params.SignatureSize {
+		t.Fatal("request field size mismatch")
+	}
+
+	response, _, err := issuer.Evaluate(request.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := requestState.FinalizeToken(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token.Nonce) != params.NonceSize ||
+		len(token.Context) != params.ContextSize ||
+		len(token.KeyID) != params.KeyIDSize ||
+		len(token.Authenticator) != params.AuthenticatorSize {
+		t.Fatal("token field size mismatch")
+	}
+
+	digester := params.Hash.New()
+	digester.Write(token.AuthenticatorInput())
+	err = rsa.VerifyPSS(issuer.TokenKey(), params.Hash, digester.Sum(nil), token.Authenticator, &rsa.PSSOptions{
+		Hash:       params.Hash,
+		SaltLength: params.Hash.Size(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIssuerKeySizeMismatch(t *testing.T) {
+	largeKey, err := rsa.GenerateKey(rand.Reader, 3072)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := createTestIssuer(t, largeKey)
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	// The client builds its request against a 2048-bit token key
+	curve := elliptic.P384()
+	secretKey, _ := ecdsa.GenerateKey(curve, rand.Reader)
+	blindKey, _ := ecdsa.GenerateKey(curve, rand.Reader)
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+	smallKey := loadPrivateKey(t)
+	requestState, err := client.CreateTokenRequest(nonce, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), &smallKey.PublicKey, testOrigin, issuer.NameKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = issuer.Evaluate(requestState.Request().Marshal())
+	if !errors.Is(err, ErrKeySizeMismatch) {
+		t.Fatalf("expected ErrKeySizeMismatch, got %v", err)
+	}
+}
+
+func TestNameKeyCache(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+	nameKeyEnc := issuer.NameKey().Marshal()
+
+	cache := NewNameKeyCache()
+	nameKey, err := cache.Get(nameKeyEnc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cachedNameKey, err := cache.Get(nameKeyEnc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nameKey != cachedNameKey {
+		t.Fatal("expected cached name key")
+	}
+	if _, err := cache.Get(nameKeyEnc[:10]); err == nil {
+		t.Fatal("expected failure for malformed name key")
+	}
+
+	// Each request still uses a fresh HPKE ephemeral key
+	curve := elliptic.P384()
+	secretKey, _ := ecdsa.GenerateKey(curve, rand.Reader)
+	blindKey, _ := ecdsa.GenerateKey(curve, rand.Reader)
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, 32)
+	encs := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		requestState, err := client.CreateTokenRequest(nonce, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, cachedNameKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc := string(requestState.encapEnc)
+		if encs[enc] {
+			t.Fatal("HPKE ephemeral key reused across requests")
+		}
+		encs[enc] = true
+
+		response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := requestState.FinalizeToken(response); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNameKeyCacheEviction(t *testing.T) {
+	cache := NewNameKeyCacheWithSize(2)
+	var encodedKeys [][]byte
+	for j := 0; j < 3; j++ {
+		seed := make([]byte, 32)
+		seed[0] = byte(j)
+		nameKey, err := CreatePrivateEncapKeyFromSeed(seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encodedKey := nameKey.Public().Marshal()
+		encodedKeys = append(encodedKeys, encodedKey)
+		if _, err := cache.Get(encodedKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(cache.keys) != 2 {
+		t.Fatalf("expected 2 cached keys, got %d", len(cache.keys))
+	}
+	if _, ok := cache.keys[sha256.Sum256(encodedKeys[0])]; ok {
+		t.Fatal("expected the oldest key to be evicted")
+	}
+}
+
+func BenchmarkNameKeyCache(b *testing.B) {
+	issuer := createTestIssuer(b, loadPrivateKeyForBenchmark(b))
+	nameKeyEnc := issuer.NameKey().Marshal()
+
+	b.Run("Unmarshal", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			if _, err := UnmarshalEncapKey(nameKeyEnc); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Cached", func(b *testing.B) {
+		cache := NewNameKeyCache()
+		for n := 0; n < b.N; n++ {
+			if _, err := cache.Get(nameKeyEnc); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+type mockOriginKeyProvider struct {
+	keys    map[string]*ecdsa.PrivateKey
+	lookups int
+}
+
+func (p *mockOriginKeyProvider) IndexKey(origin string) (*ecdsa.PrivateKey, bool) {
+	p.lookups++
+	key, ok := p.keys[origin]
+	return key, ok
+}
+
+func TestIssuerOriginKeyProvider(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+
+	originIndexKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &mockOriginKeyProvider{
+		keys: map[string]*ecdsa.PrivateKey{
+			testOrigin: originIndexKey,
+		},
+	}
+	issuer.SetOriginKeyProvider(provider)
+	if !issuer.IsConfigured() {
+		t.Fatal("issuer with an origin key provider reported as unconfigured")
+	}
+
+	for i := 0; i < 2; i++ {
+		_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+		response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := requestState.FinalizeToken(response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if provider.lookups != 1 {
+		t.Fatalf("expected provider result to be cached, got %d lookups", provider.lookups)
+	}
+	if issuer.OriginIndexKey(testOrigin) != originIndexKey {
+		t.Fatal("index key mismatch")
+	}
+
+	_, requestState := createTestTokenRequest(t, issuer, "other.example")
+	_, _, err = issuer.Evaluate(requestState.Request().Marshal())
+	if !errors.Is(err, ErrUnknownOrigin) {
+		t.Fatalf("expected ErrUnknownOrigin, got %v", err)
+	}
+}
+
+func TestOriginNameLengthBoundary(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+
+	// 32-byte enc, 1-byte token key ID, 256-byte blinded message, 2-byte
+	// length prefix and 16-byte tag leave 65228 bytes, i.e., 65216 bytes
+	// once rounded down to the padding block size.
+	longestOrigin := strings.Repeat("a", 65216)
+	issuer.AddOrigin(longestOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, longestOrigin)
+	response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := requestState.FinalizeToken(response); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, originLen := range []int{65217, 65535, 65536, 70000} {
+		curve := elliptic.P384()
+		secretKey, _ := ecdsa.GenerateKey(curve, rand.Reader)
+		blindKey, _ := ecdsa.GenerateKey(curve, rand.Reader)
+		client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce := make([]byte, 32)
+		_, err = client.CreateTokenRequest(nonce, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), strings.Repeat("a", originLen), issuer.NameKey())
+		if !errors.Is(err, ErrOriginNameTooLong) {
+			t.Fatalf("expected ErrOriginNameTooLong for %d-byte origin, got %v", originLen, err)
+		}
+	}
+}
+
+func TestTokenBlindRSAVariant(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := requestState.FinalizeToken(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := blindrsa.NewRSAVerifier(issuer.TokenKey(), crypto.SHA384)
+	if err := verifier.Verify(token.AuthenticatorInput(), token.Authenticator); err != nil {
+		t.Fatalf("token does not verify under RSABSSA-SHA384-PSS-Deterministic: %v", err)
+	}
+
+	zeroSaltVerifier := blindrsa.NewDeterministicRSAVerifier(issuer.TokenKey(), crypto.SHA384)
+	_, zeroSaltState, err := zeroSaltVerifier.Blind(rand.Reader, token.AuthenticatorInput())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkTokenVerifierState(zeroSaltState, crypto.SHA384.Size()); err != ErrUnexpectedBlindRSAVariant {
+		t.Fatalf("expected ErrUnexpectedBlindRSAVariant, got %v", err)
+	}
+}
+
+func TestCreateTokenRequestsForOrigins(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	origins := []string{"a.example", "b.example", "c.example"}
+	for _, origin := range origins {
+		issuer.AddOrigin(origin)
+	}
+	issuer.SetBlindedMessageTracker(NewMemoryBlindedMessageTracker(time.Minute))
+
+	secretKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge := make([]byte, 32)
+	rand.Reader.Read(challenge)
+
+	requestStates, err := client.CreateTokenRequestsForOrigins(challenge, issuer.TokenKeyID(), issuer.TokenKey(), origins, issuer.NameKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requestStates) != len(origins) {
+		t.Fatalf("expected %d requests, got %d", len(origins), len(requestStates))
+	}
+
+	attester := NewRateLimitedAttester(NewMemoryClientStateCache())
+	for i, requestState := range requestStates {
+		request := requestState.Request()
+		for _, other := range requestStates[:i] {
+			if bytes.Equal(request.RequestKey, other.Request().RequestKey) ||
+				bytes.Equal(requestState.blindedMessage, other.blindedMessage) {
+				t.Fatal("requests for different origins are linkable")
+			}
+		}
+		if err := attester.VerifyRequest(*request, requestState.Blind(), requestState.ClientKey(), []byte("anonymous origin")); err != nil {
+			t.Fatal(err)
+		}
+
+		// Each request is encrypted for its own origin, and is laid out like a
+		// request created for that origin alone
+		originName, err := issuer.ResolveOrigin(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if originName != origins[i] {
+			t.Fatalf("request %d resolved to %s, expected %s", i, originName, origins[i])
+		}
+		nonce := make([]byte, 32)
+		singleState, err := client.CreateTokenRequest(challenge, nonce, requestState.Blind(), issuer.TokenKeyID(), issuer.TokenKey(), origins[i], issuer.NameKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(singleState.Request().RequestKey, request.RequestKey) {
+			t.Fatal("request key differs from a single-origin request with the same blind")
+		}
+		if len(singleState.Request().Marshal()) != len(request.Marshal()) {
+			t.Fatal("request size differs from a single-origin request")
+		}
+
+		// Distinct blinded messages do not trip the cross-origin reuse check
+		response, _, err := issuer.Evaluate(request.Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := requestState.FinalizeToken(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyToken(token, issuer.TokenKey()); err != nil {
+			t.Fatal(err)
+		}
+		if !token.MatchesAnyChallenge([][]byte{challenge}) {
+			t.Fatal("token does not match its challenge")
+		}
+	}
+}
+
+func TestFinalizeIndexErrors(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	curve := elliptic.P384()
+	blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	attester := NewRateLimitedAttester(NewMemoryClientStateCache())
+
+	anonymousOriginID := make([]byte, 32)
+	rand.Reader.Read(anonymousOriginID)
+
+	clientKeyEnc := requestState.ClientKey()
+	_, blindedRequestKey, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	badBlinds := [][]byte{
+		nil,
+		make([]byte, 48),
+		curve.Params().N.Bytes(),
+		make([]byte, 49),
+	}
+	for _, blind := range badBlinds {
+		_, err := attester.FinalizeIndex(clientKeyEnc, blind, blindedRequestKey, anonymousOriginID)
+		if !errors.Is(err, ErrBadBlind) {
+			t.Fatalf("expected ErrBadBlind, got %v", err)
+		}
+		err = attester.VerifyRequest(*requestState.Request(), blind, clientKeyEnc, anonymousOriginID)
+		if !errors.Is(err, ErrBadBlind) {
+			t.Fatalf("expected ErrBadBlind from VerifyRequest, got %v", err)
+		}
+	}
+
+	unblindRequestKey = func(elliptic.Curve, *ecdsa.PublicKey, *ecdsa.PrivateKey, []byte) (*ecdsa.PublicKey, error) {
+		return nil, errors.New("unblind failure")
+	}
+	_, err = attester.FinalizeIndex(clientKeyEnc, blindKey.D.Bytes(), blindedRequestKey, anonymousOriginID)
+	unblindRequestKey = ecdsa.UnblindPublicKeyWithContext
+	if !errors.Is(err, ErrUnblindFailed) {
+		t.Fatalf("expected ErrUnblindFailed, got %v", err)
+	}
+
+	deriveIndex = func([]byte, []byte, uint64) ([]byte, error) {
+		return nil, errors.New("kdf failure")
+	}
+	_, err = attester.FinalizeIndex(clientKeyEnc, blindKey.D.Bytes(), blindedRequestKey, anonymousOriginID)
+	deriveIndex = computeEpochIndex
+	if !errors.Is(err, ErrIndexKDF) {
+		t.Fatalf("expected ErrIndexKDF, got %v", err)
+	}
+}
+
+func TestTokenSaltLength(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+	issuer.SetSaltLength(32)
+	if err := issuer.ValidateConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	curve := elliptic.P384()
+	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = client.WithSaltLength(issuer.SaltLength())
+
+	challenge := make([]byte, 32)
+	rand.Reader.Read(challenge)
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+
+	requestState, err := client.CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := requestState.FinalizeToken(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyToken(issuer.TokenKey(), BlindRSAVariantPSS, 32, token); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyToken(issuer.TokenKey(), BlindRSAVariantPSS, RateLimitedParams().SaltLength, token); err == nil {
+		t.Fatal("token verified under a different salt length")
+	}
+
+	_, defaultRequestState := createTestTokenRequest(t, issuer, testOrigin)
+	response, _, err = issuer.Evaluate(defaultRequestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err = defaultRequestState.FinalizeToken(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyToken(issuer.TokenKey(), BlindRSAVariantPSS, 32, token); err == nil {
+		t.Fatal("token verified under a different salt length")
+	}
+
+	issuer.SetSaltLength(0)
+	if err := issuer.ValidateConfig(); !errors.Is(err, ErrInvalidSaltLength) {
+		t.Fatalf("expected ErrInvalidSaltLength, got %v", err)
+	}
+	if err := verifyToken(issuer.TokenKey(), BlindRSAVariantPSS, 0, token); !errors.Is(err, ErrInvalidSaltLength) {
+		t.Fatalf("expected ErrInvalidSaltLength, got %v", err)
+	}
+}
+
+func TestIndexCommitment(t *testing.T) {
+	index := make([]byte, 48)
+	rand.Reader.Read(index)
+	salt := make([]byte, 32)
+	rand.Reader.Read(salt)
+
+	commitment := CommitIndex(index, salt)
+	if len(commitment) != crypto.SHA384.Size() {
+		t.Fatalf("unexpected commitment length %d", len(commitment))
+	}
+	if !bytes.Equal(commitment, CommitIndex(index, salt)) {
+		t.Fatal("commitment is not deterministic")
+	}
+	if !VerifyIndexCommitment(index, salt, commitment) {
+		t.Fatal("commitment did not verify")
+	}
+
+	otherIndex := make([]byte, 48)
+	rand.Reader.Read(otherIndex)
+	if VerifyIndexCommitment(otherIndex, salt, commitment) {
+		t.Fatal("commitment verified for a different index")
+	}
+	otherSalt := make([]byte, 32)
+	rand.Reader.Read(otherSalt)
+	if VerifyIndexCommitment(index, otherSalt, commitment) {
+		t.Fatal("commitment verified under a different salt")
+	}
+	if VerifyIndexCommitment(index, salt, commitment[:len(commitment)-1]) {
+		t.Fatal("truncated commitment verified")
+	}
+}
+
+func TestVerifyRequestSignature(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	request := requestState.Request()
+	requestKey := request.RequestKey
+
+	if err := VerifyRequestSignature(request, requestKey); err != nil {
+		t.Fatal(err)
+	}
+
+	_, otherRequestState := createTestTokenRequest(t, issuer, testOrigin)
+	if err := VerifyRequestSignature(request, otherRequestState.Request().RequestKey); err != ErrRequestKeyMismatch {
+		t.Fatalf("expected ErrRequestKeyMismatch, got %v", err)
+	}
+
+	tampered := *request
+	tampered.EncryptedTokenRequest = append([]byte{}, request.EncryptedTokenRequest...)
+	tampered.EncryptedTokenRequest[len(tampered.EncryptedTokenRequest)-1] ^= 0x01
+	if err := VerifyRequestSignature(&tampered, requestKey); err != ErrInvalidRequestSignature {
+		t.Fatalf("expected ErrInvalidRequestSignature, got %v", err)
+	}
+
+	tampered = *request
+	tampered.Signature = request.Signature[:10]
+	if err := VerifyRequestSignature(&tampered, requestKey); err != ErrInvalidRequestSignature {
+		t.Fatalf("expected ErrInvalidRequestSignature, got %v", err)
+	}
+}
+
+func TestIssuerDeterministicResponseNonce(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+	issuer.SetDeterministicResponseNonceKey([]byte("test vector key"))
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	encodedRequest := requestState.Request().Marshal()
+
+	response, blindedRequestKey, err := issuer.Evaluate(encodedRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherResponse, otherBlindedRequestKey, err := issuer.Evaluate(encodedRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, otherResponse) || !bytes.Equal(blindedRequestKey, otherBlindedRequestKey) {
+		t.Fatal("responses to the same request differ")
+	}
+	if _, err := requestState.FinalizeToken(response); err != nil {
+		t.Fatal(err)
+	}
+
+	issuer.SetDeterministicResponseNonceKey(nil)
+	randomResponse, _, err := issuer.Evaluate(encodedRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(response, randomResponse) {
+		t.Fatal("expected a random response nonce")
+	}
+}
+
+func TestCreateTokenRequestWithRandom(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	secretKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, 32)
+
+	issue := func(seed int64) ([]byte, []byte, tokens.Token) {
+		rng := mathrand.New(mathrand.NewSource(seed))
+		requestState, err := client.CreateTokenRequestWithRandom(rng, nonce, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		encodedRequest := requestState.Request().Marshal()
+		response, _, err := issuer.EvaluateWithRandom(rng, encodedRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := requestState.FinalizeToken(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encodedRequest, response, token
+	}
+
+	request, response, token := issue(1)
+	for run := 0; run < 3; run++ {
+		otherRequest, otherResponse, otherToken := issue(1)
+		if !bytes.Equal(request, otherRequest) {
+			t.Fatal("requests from the same seed differ")
+		}
+		if !bytes.Equal(response, otherResponse) {
+			t.Fatal("responses from the same seed differ")
+		}
+		if !bytes.Equal(token.Marshal(), otherToken.Marshal()) {
+			t.Fatal("tokens from the same seed differ")
+		}
+	}
+
+	otherRequest, _, _ := issue(2)
+	if bytes.Equal(request, otherRequest) {
+		t.Fatal("requests from different seeds are equal")
+	}
+}
+
+func TestNameKeyRequiredSuite(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	nameKey := issuer.NameKey()
+
+	suite, err := nameKey.RequiredSuite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suite.KEM.ID() != fixedKEM || suite.KDF.ID() != fixedKDF || suite.AEAD.ID() != fixedAEAD {
+		t.Fatal("required suite mismatch")
+	}
+
+	if _, err := (EncapKey{}).RequiredSuite(); err != ErrMissingSuite {
+		t.Fatalf("expected ErrMissingSuite, got %v", err)
+	}
+	if _, err := assembleSuite(hpke.KEMID(0xfefe), fixedKDF, fixedAEAD); !errors.Is(err, ErrUnsupportedKEM) {
+		t.Fatalf("expected ErrUnsupportedKEM, got %v", err)
+	}
+	if _, err := assembleSuite(fixedKEM, fixedKDF, hpke.AEADID(0xfefe)); !errors.Is(err, ErrUnsupportedAEAD) {
+		t.Fatalf("expected ErrUnsupportedAEAD, got %v", err)
+	}
+
+	// A name key with an unsupported KEM is rejected when parsed
+	encodedNameKey := nameKey.Marshal()
+	encodedNameKey[1] = 0xfe
+	encodedNameKey[2] = 0xfe
+	if _, err := UnmarshalEncapKey(encodedNameKey); !errors.Is(err, ErrUnsupportedKEM) {
+		t.Fatalf("expected ErrUnsupportedKEM, got %v", err)
+	}
+}
+
+func TestTokenBlindRSAVariantMismatch(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+	issuer.SetBlindRSAVariant(BlindRSAVariantPSSZero)
+	if err := issuer.ValidateConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	curve := elliptic.P384()
+	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = client.WithBlindRSAVariant(issuer.BlindRSAVariant())
+
+	challenge := make([]byte, 32)
+	rand.Reader.Read(challenge)
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+
+	createRequest := func() RateLimitedTokenRequestState {
+		requestState, err := client.CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return requestState
+	}
+
+	// Matching variants
+	requestState := createRequest()
+	response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := requestState.FinalizeToken(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyToken(issuer.TokenKey(), BlindRSAVariantPSSZero, 0, token); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyToken(issuer.TokenKey(), BlindRSAVariantPSS, RateLimitedParams().SaltLength, token); err == nil {
+		t.Fatal("PSSZERO token verified as PSS")
+	}
+
+	// Blinded under PSSZERO, finalized expecting PSS
+	requestState = createRequest()
+	response, _, err = issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestState.variant = BlindRSAVariantPSS
+	if _, err := requestState.FinalizeToken(response); !errors.Is(err, ErrBlindRSAVariantMismatch) {
+		t.Fatalf("expected ErrBlindRSAVariantMismatch, got %v", err)
+	}
+
+	// Blinded under PSS, finalized expecting PSSZERO
+	_, requestState = createTestTokenRequest(t, issuer, testOrigin)
+	response, _, err = issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestState.variant = BlindRSAVariantPSSZero
+	if _, err := requestState.FinalizeToken(response); !errors.Is(err, ErrBlindRSAVariantMismatch) {
+		t.Fatalf("expected ErrBlindRSAVariantMismatch, got %v", err)
+	}
+
+	issuer.SetBlindRSAVariant("RSABSSA-SHA384-UNKNOWN")
+	if err := issuer.ValidateConfig(); !errors.Is(err, ErrUnsupportedBlindRSAVariant) {
+		t.Fatalf("expected ErrUnsupportedBlindRSAVariant, got %v", err)
+	}
+}
+
+func TestValidateToken(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := requestState.FinalizeToken(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateToken(token, issuer.TokenKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateToken(token, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	malformed := map[string]func(token *tokens.Token){
+		"token type":    func(token *tokens.Token) { token.TokenType = 0x0002 },
+		"nonce":         func(token *tokens.Token) { token.Nonce = token.Nonce[:31] },
+		"context":       func(token *tokens.Token) { token.Context = append(token.Context, 0x00) },
+		"key ID":        func(token *tokens.Token) { token.KeyID = nil },
+		"authenticator": func(token *tokens.Token) { token.Authenticator = token.Authenticator[:128] },
+	}
+	for field, modify := range malformed {
+		malformedToken := token
+		modify(&malformedToken)
+		if err := ValidateToken(malformedToken, issuer.TokenKey()); !errors.Is(err, ErrMalformedToken) {
+			t.Fatalf("expected ErrMalformedToken for %s, got %v", field, err)
+		}
+	}
+
+	// Without the token key, the authenticator length is not known
+	shortToken := token
+	shortToken.Authenticator = token.Authenticator[:128]
+	if err := ValidateToken(shortToken, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFinalizeTokens(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	count := 6
+	states := make([]RateLimitedTokenRequestState, count)
+	responses := make([][]byte, count)
+	for i := range states {
+		_, states[i] = createTestTokenRequest(t, issuer, testOrigin)
+		response, _, err := issuer.Evaluate(states[i].Request().Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses[i] = response
+	}
+
+	// Tamper with every third response
+	for i := 0; i < count; i += 3 {
+		responses[i][len(responses[i])-1] ^= 0x01
+	}
+
+	finalizedTokens, errs := FinalizeTokens(states, responses, 4)
+	if len(finalizedTokens) != count || len(errs) != count {
+		t.Fatal("result length mismatch")
+	}
+	for i := range states {
+		if i%3 == 0 {
+			if errs[i] != ErrInvalidResponse {
+				t.Fatalf("expected ErrInvalidResponse at %d, got %v", i, errs[i])
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Fatalf("unexpected error at %d: %v", i, errs[i])
+		}
+		if !bytes.Equal(finalizedTokens[i].AuthenticatorInput(), states[i].tokenInput) {
+			t.Fatalf("token %d does not match its request state", i)
+		}
+	}
+
+	_, errs = FinalizeTokens(states, responses[1:], 4)
+	for _, err := range errs {
+		if err != ErrResponseCountMismatch {
+			t.Fatalf("expected ErrResponseCountMismatch, got %v", err)
+		}
+	}
+}
+
+// testHSM stands in for an HSM holding the client secret key. It only signs
+// digests as given, returning r || s.
+type testHSM struct {
+	secretKey *ecdsa.PrivateKey
+}
+
+func (h testHSM) Sign(digest []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, h.secretKey, digest)
+	if err != nil {
+		return nil, err
+	}
+	return encodeRequestSignature(h.secretKey.Curve, r, s), nil
+}
+
+func TestPrepareTokenRequestExternalSigner(t *testing.T) {
+	for _, curve := range []elliptic.Curve{elliptic.P384(), elliptic.P256()} {
+		t.Run(curve.Params().Name, func(t *testing.T) {
+			testPrepareTokenRequestExternalSigner(t, curve)
+		})
+	}
+}
+
+func testPrepareTokenRequestExternalSigner(t *testing.T, curve elliptic.Curve) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	if err := issuer.SetRequestKeyCurve(curve); err != nil {
+		t.Fatal(err)
+	}
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hsm := testHSM{secretKey}
+	blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKeyEnc := elliptic.MarshalCompressed(curve, secretKey.X, secretKey.Y)
+	client, err := NewRateLimitedClientFromPublicKeyWithCurve(curve, clientKeyEnc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge := make([]byte, 32)
+	rand.Reader.Read(challenge)
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+
+	if _, err := client.CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey()); !errors.Is(err, ErrNoSecretKey) {
+		t.Fatalf("expected ErrNoSecretKey, got %v", err)
+	}
+
+	prepared, err := client.PrepareTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A signature by the HSM over the wrong digest must be rejected
+	badSignature, err := hsm.Sign(make([]byte, 48))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := prepared.AttachSignature(badSignature); !errors.Is(err, ErrInvalidRequestSignature) {
+		t.Fatalf("expected ErrInvalidRequestSignature, got %v", err)
+	}
+
+	signature, err := hsm.Sign(prepared.Digest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestState, err := prepared.AttachSignature(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(requestState.ClientKey(), clientKeyEnc) {
+		t.Fatal("client key mismatch")
+	}
+
+	attester := NewRateLimitedAttester(NewMemoryClientStateCache())
+	if err := attester.VerifyRequest(*requestState.Request(), blindKey.D.Bytes(), clientKeyEnc, []byte("anonymous origin")); err != nil {
+		t.Fatal(err)
+	}
+
+	response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := requestState.FinalizeToken(response); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTokenRedemptionKey(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	issue := func() (tokens.Token, tokens.Token) {
+		_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+		response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		token1, err := requestState.FinalizeToken(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token2, err := requestState.FinalizeToken(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token1, token2
+	}
+
+	token1, token2 := issue()
+	if token1.RedemptionKey() != token2.RedemptionKey() {
+		t.Fatal("finalizations of the same issuance have different redemption keys")
+	}
+
+	// createTestTokenRequest samples a fresh nonce for every request
+	otherToken, _ := issue()
+	if bytes.Equal(otherToken.Nonce, token1.Nonce) {
+		t.Fatal("nonces unexpectedly equal")
+	}
+	if otherToken.RedemptionKey() == token1.RedemptionKey() {
+		t.Fatal("tokens with different nonces have the same redemption key")
+	}
+}
+
+func TestCreateTokenRequestChallengeExpiry(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	curve := elliptic.P384()
+	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+
+	createChallenge := func(expiry time.Time) []byte {
+		redemptionNonce, err := tokens.NewExpiringRedemptionNonce(expiry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokens.TokenChallenge{
+			TokenType:       RateLimitedTokenType,
+			IssuerName:      "issuer.example",
+			RedemptionNonce: redemptionNonce,
+			OriginInfo:      []string{testOrigin},
+		}.Marshal()
+	}
+
+	expiredChallenge := createChallenge(time.Now().Add(-time.Minute))
+	_, err = client.CreateTokenRequest(expiredChallenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+	if !errors.Is(err, tokens.ErrChallengeExpired) {
+		t.Fatalf("expected ErrChallengeExpired, got %v", err)
+	}
+
+	freshChallenge := createChallenge(time.Now().Add(time.Hour))
+	requestState, err := client.CreateTokenRequest(freshChallenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := requestState.FinalizeToken(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !token.MatchesAnyChallenge([][]byte{freshChallenge}) {
+		t.Fatal("token does not match the challenge")
+	}
+}
+
+func TestFinalizeTokenBlindSignatureCheck(t *testing.T) {
+	tokenKey := loadPrivateKey(t)
+	issuer := createTestIssuer(t, tokenKey)
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	client, _ := createTestTokenRequest(t, issuer, testOrigin)
+	blindKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := make([]byte, 32)
+	rand.Reader.Read(challenge)
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+
+	requestState, err := client.WithBlindSignatureCheck(true).CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validResponse, _, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Respond with a correctly encrypted but tampered blind signature
+	blindSignature, err := blindrsa.NewRSASigner(tokenKey).BlindSign(requestState.blindedMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindSignature[len(blindSignature)-1] ^= 0x01
+	responseNonceLen := max(requestState.nameKey.suite.AEAD.KeySize(), requestState.nameKey.suite.AEAD.NonceSize())
+	responseNonce := make([]byte, responseNonceLen)
+	rand.Reader.Read(responseNonce)
+	salt := responseSalt(requestState.encapEnc, responseNonce)
+	suite := requestState.nameKey.suite
+	prk := suite.KDF.Extract(salt, requestState.encapSecret)
+	key := suite.KDF.Expand(prk, []byte(labelResponseKey), suite.AEAD.KeySize())
+	aeadNonce := suite.KDF.Expand(prk, []byte(labelResponseNonce), suite.AEAD.NonceSize())
+	cipher, err := suite.AEAD.New(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := append(responseNonce, cipher.Seal(nil, aeadNonce, blindSignature, nil)...)
+	if _, err := requestState.FinalizeToken(response); !errors.Is(err, ErrBlindUnblindMismatch) {
+		t.Fatalf("expected ErrBlindUnblindMismatch, got %v", err)
+	}
+
+	// Without the check, the tampered signature is still rejected when unblinding
+	requestState.checkBlindSignature = false
+	if _, err := requestState.FinalizeToken(response); err == nil || errors.Is(err, ErrBlindUnblindMismatch) {
+		t.Fatalf("expected unblinding failure, got %v", err)
+	}
+
+	requestState.checkBlindSignature = true
+	if _, err := requestState.FinalizeToken(validResponse); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFinalizeTokenFailureBundle(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	encodedRequest := requestState.Request().Marshal()
+	response, _, err := issuer.Evaluate(encodedRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte{}, response...)
+	tampered[len(tampered)-1] ^= 0x01
+	_, bundle, err := requestState.FinalizeTokenWithBundle(tampered)
+	if !errors.Is(err, ErrInvalidResponse) {
+		t.Fatalf("expected ErrInvalidResponse, got %v", err)
+	}
+	if bundle == nil {
+		t.Fatal("missing failure bundle")
+	}
+	if !bytes.Equal(bundle.TokenInput, requestState.tokenInput) ||
+		!bytes.Equal(bundle.EncapEnc, requestState.encapEnc) ||
+		!bytes.Equal(bundle.Request, encodedRequest) ||
+		!bytes.Equal(bundle.Response, tampered) ||
+		!bytes.Equal(bundle.TokenKeyID, issuer.TokenKeyID()) {
+		t.Fatalf("unexpected failure bundle %+v", bundle)
+	}
+	for _, field := range [][]byte{bundle.TokenInput, bundle.EncapEnc, bundle.Request, bundle.Response, bundle.TokenKeyID} {
+		if bytes.Contains(field, requestState.encapSecret) {
+			t.Fatal("failure bundle contains the HPKE secret")
+		}
+	}
+
+	token, bundle, err := requestState.FinalizeTokenWithBundle(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundle != nil {
+		t.Fatal("unexpected failure bundle on success")
+	}
+	if token.Authenticator == nil {
+		t.Fatal("missing token authenticator")
+	}
+}
+
+func TestRequestStateBlind(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	client, _ := createTestTokenRequest(t, issuer, testOrigin)
+	blindKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindEnc := blindKey.D.Bytes()
+	challenge := make([]byte, 32)
+	rand.Reader.Read(challenge)
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+
+	requestState, err := client.CreateTokenRequest(challenge, nonce, blindEnc, issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(requestState.Blind(), blindEnc) {
+		t.Fatal("blind mismatch")
+	}
+
+	// The state alone carries everything the attester needs
+	attester := NewRateLimitedAttester(NewMemoryClientStateCache())
+	anonymousOriginID := make([]byte, 32)
+	rand.Reader.Read(anonymousOriginID)
+	if err := attester.VerifyRequest(*requestState.Request(), requestState.Blind(), requestState.ClientKey(), anonymousOriginID); err != nil {
+		t.Fatal(err)
+	}
+	_, blindedRequestKey, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := attester.FinalizeIndex(requestState.ClientKey(), requestState.Blind(), blindedRequestKey, anonymousOriginID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	originIndexPublicKey, err := issuer.OriginIndexPublicKey(testOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedIndex, err := client.PredictIndex(blindEnc, originIndexPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(index, expectedIndex) {
+		t.Fatal("index mismatch")
+	}
+}
+
+func TestIssuerOriginPattern(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+
+	// A nil pattern allows all names
+	if err := issuer.AddOrigin("*.anything"); err != nil {
+		t.Fatal(err)
+	}
+
+	issuer.SetOriginPattern(regexp.MustCompile(`^([a-z0-9-]+\.)*example\.com$`))
+	for _, origin := range []string{"example.com", "www.example.com"} {
+		if err := issuer.AddOrigin(origin); err != nil {
+			t.Fatalf("%s: %v", origin, err)
+		}
+		if issuer.OriginIndexKey(origin) == nil {
+			t.Fatalf("%s not registered", origin)
+		}
+	}
+	for _, origin := range []string{"*.example.com", "example.com.evil", "other.example", ""} {
+		if err := issuer.AddOrigin(origin); !errors.Is(err, ErrOriginNotAllowed) {
+			t.Fatalf("%s: expected ErrOriginNotAllowed, got %v", origin, err)
+		}
+		if issuer.OriginIndexKey(origin) != nil {
+			t.Fatalf("%s registered", origin)
+		}
+	}
+
+	issuer.SetOriginPattern(nil)
+	if err := issuer.AddOrigin("other.example"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAttesterIndexEpoch(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+	originIndexPublicKey, err := issuer.OriginIndexPublicKey(testOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := createTestTokenRequest(t, issuer, testOrigin)
+	attester := NewRateLimitedAttester(NewMemoryClientStateCache())
+	anonymousOriginID := make([]byte, 32)
+	rand.Reader.Read(anonymousOriginID)
+
+	finalizeIndex := func() []byte {
+		blindKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		challenge := make([]byte, 32)
+		rand.Reader.Read(challenge)
+		nonce := make([]byte, 32)
+		rand.Reader.Read(nonce)
+		requestState, err := client.CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := attester.VerifyRequest(*requestState.Request(), requestState.Blind(), requestState.ClientKey(), anonymousOriginID); err != nil {
+			t.Fatal(err)
+		}
+		_, blindedRequestKey, err := issuer.Evaluate(requestState.Request().Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		index, err := attester.FinalizeIndex(requestState.ClientKey(), requestState.Blind(), blindedRequestKey, anonymousOriginID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedIndex, err := client.PredictEpochIndex(requestState.Blind(), originIndexPublicKey, attester.IndexEpoch())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(index, expectedIndex) {
+			t.Fatal("index does not match the predicted index")
+		}
+		return index
+	}
+
+	if attester.IndexEpoch() != 0 {
+		t.Fatal("attester does not start in epoch 0")
+	}
+	index0 := finalizeIndex()
+	if !bytes.Equal(index0, finalizeIndex()) {
+		t.Fatal("index not stable within an epoch")
+	}
+
+	if epoch := attester.RotateIndexEpoch(); epoch != 1 {
+		t.Fatalf("expected epoch 1, got %d", epoch)
+	}
+	index1 := finalizeIndex()
+	if bytes.Equal(index0, index1) {
+		t.Fatal("index unchanged across epochs")
+	}
+	if !bytes.Equal(index1, finalizeIndex()) {
+		t.Fatal("index not stable within an epoch")
+	}
+}
+
+func TestValidatePadding(t *testing.T) {
+	for _, originName := range []string{"", "a", "origin.example", strings.Repeat("a", 31), strings.Repeat("a", 32), strings.Repeat("a", 33)} {
+		if err := validatePadding(padOriginName(originName)); err != nil {
+			t.Fatalf("%q: %v", originName, err)
+		}
+	}
+
+	malformed := [][]byte{
+		nil,
+		make([]byte, 31),
+		make([]byte, 64),
+		append([]byte("origin.example"), make([]byte, 49)...),
+		append([]byte("origin.example"), make([]byte, 17)...),
+		[]byte(strings.Repeat("a", 33)),
+	}
+	for _, paddedOrigin := range malformed {
+		if err := validatePadding(paddedOrigin); !errors.Is(err, ErrMalformedPadding) {
+			t.Fatalf("%x: expected ErrMalformedPadding, got %v", paddedOrigin, err)
+		}
+	}
+}
+
+func TestVerifyTokenAny(t *testing.T) {
+	tokenKey := loadPrivateKey(t)
+	issuer := createTestIssuer(t, tokenKey)
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := requestState.FinalizeToken(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherKeys := make([]*rsa.PublicKey, 2)
+	for j := range otherKeys {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherKeys[j] = &key.PublicKey
+	}
+
+	key, err := VerifyTokenAny(token, []*rsa.PublicKey{otherKeys[0], nil, issuer.TokenKey(), otherKeys[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != issuer.TokenKey() {
+		t.Fatal("wrong key returned")
+	}
+
+	// The key ID is covered by the authenticator, so no key verifies a token
+	// whose key ID was modified
+	token.KeyID = make([]byte, len(token.KeyID))
+	if _, err := VerifyTokenAny(token, []*rsa.PublicKey{otherKeys[0], issuer.TokenKey()}); err == nil {
+		t.Fatal("token with modified key ID verified")
+	}
+
+	if _, err := VerifyTokenAny(token, otherKeys); !errors.Is(err, ErrNoMatchingKey) {
+		t.Fatalf("expected ErrNoMatchingKey, got %v", err)
+	}
+	if _, err := VerifyTokenAny(token, nil); !errors.Is(err, ErrNoMatchingKey) {
+		t.Fatalf("expected ErrNoMatchingKey, got %v", err)
+	}
+}
+
+func TestOriginBoundContext(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	otherOrigin := "other.example"
+	issuer.AddOrigin(testOrigin)
+	issuer.AddOrigin(otherOrigin)
+
+	client, _ := createTestTokenRequest(t, issuer, testOrigin)
+	client = client.WithOriginBoundContext(true)
+	blindKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := make([]byte, 32)
+	rand.Reader.Read(challenge)
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+
+	requestState, err := client.CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	attester := NewRateLimitedAttester(NewMemoryClientStateCache())
+	anonymousOriginID := make([]byte, 32)
+	rand.Reader.Read(anonymousOriginID)
+	if err := attester.VerifyRequest(*requestState.Request(), requestState.Blind(), requestState.ClientKey(), anonymousOriginID); err != nil {
+		t.Fatal(err)
+	}
+	response, blindedRequestKey, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := attester.FinalizeIndex(requestState.ClientKey(), requestState.Blind(), blindedRequestKey, anonymousOriginID); err != nil {
+		t.Fatal(err)
+	}
+	token, err := requestState.FinalizeToken(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := VerifyTokenAny(token, []*rsa.PublicKey{issuer.TokenKey()}); err != nil {
+		t.Fatal(err)
+	}
+	if !TokenMatchesOrigin(token, challenge, testOrigin) {
+		t.Fatal("token does not match its origin")
+	}
+	if TokenMatchesOrigin(token, challenge, otherOrigin) {
+		t.Fatal("token matches another origin")
+	}
+	if token.MatchesAnyChallenge([][]byte{challenge}) {
+		t.Fatal("origin-bound token matches the unbound context")
+	}
+
+	// Requests for several origins each carry their own origin-bound context
+	origins := []string{testOrigin, otherOrigin}
+	requestStates, err := client.CreateTokenRequestsForOrigins(challenge, issuer.TokenKeyID(), issuer.TokenKey(), origins, issuer.NameKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, requestState := range requestStates {
+		response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := requestState.FinalizeToken(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !TokenMatchesOrigin(token, challenge, origins[i]) {
+			t.Fatal("token does not match its origin")
+		}
+	}
+}
+
+func TestResolveOrigin(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	originName, err := issuer.ResolveOrigin(requestState.Request())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if originName != testOrigin {
+		t.Fatalf("expected %s, got %s", testOrigin, originName)
+	}
+
+	// The signature is not checked
+	request := *requestState.Request()
+	request.Signature = nil
+	if originName, err := issuer.ResolveOrigin(&request); err != nil || originName != testOrigin {
+		t.Fatalf("unexpected result %s, %v", originName, err)
+	}
+
+	_, requestState = createTestTokenRequest(t, issuer, "unknown.example")
+	if originName, err := issuer.ResolveOrigin(requestState.Request()); !errors.Is(err, ErrUnknownOrigin) || originName != "unknown.example" {
+		t.Fatalf("expected ErrUnknownOrigin, got %s, %v", originName, err)
+	}
+
+	request = *requestState.Request()
+	request.NameKeyID = make([]byte, len(request.NameKeyID))
+	if _, err := issuer.ResolveOrigin(&request); !errors.Is(err, ErrUnknownNameKey) {
+		t.Fatalf("expected ErrUnknownNameKey, got %v", err)
+	}
+}
+
+func TestOriginNormalizer(t *testing.T) {
+	normalize := func(origin string) (string, error) {
+		if host, _, found := strings.Cut(origin, ":"); found {
+			origin = host
+		}
+		if origin == "" {
+			return "", errors.New("empty origin name")
+		}
+		return strings.ToLower(origin), nil
+	}
+
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	issuer.SetOriginNormalizer(normalize)
+	if err := issuer.AddOrigin("Origin.Example:443"); err != nil {
+		t.Fatal(err)
+	}
+	if err := issuer.AddOrigin(":443"); !errors.Is(err, ErrInvalidOriginName) {
+		t.Fatalf("expected ErrInvalidOriginName, got %v", err)
+	}
+	if issuer.OriginIndexKey("origin.example") == nil {
+		t.Fatal("origin not registered under its normalized name")
+	}
+
+	curve := elliptic.P384()
+	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = client.WithOriginNormalizer(normalize)
+
+	challenge := make([]byte, 32)
+	rand.Reader.Read(challenge)
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+
+	requestState, err := client.CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), "ORIGIN.example:8443", issuer.NameKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if originName, err := issuer.ResolveOrigin(requestState.Request()); err != nil || originName != "origin.example" {
+		t.Fatalf("unexpected origin %s, %v", originName, err)
+	}
+	response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := requestState.FinalizeToken(response); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), ":8443", issuer.NameKey()); !errors.Is(err, ErrInvalidOriginName) {
+		t.Fatalf("expected ErrInvalidOriginName, got %v", err)
+	}
+}
+
+func TestTokenKeyModulusNotByteMultiple(t *testing.T) {
+	// A 2047-bit modulus still yields 256-byte blinded messages and
+	// authenticators, with a 255-byte EMSA-PSS encoding
+	tokenKey, err := rsa.GenerateKey(rand.Reader, 2047)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := createTestIssuer(t, tokenKey)
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+	if err := issuer.ValidateConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := requestState.FinalizeToken(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token.Authenticator) != RateLimitedParams().AuthenticatorSize {
+		t.Fatalf("unexpected authenticator length %d", len(token.Authenticator))
+	}
+	parsedToken, err := UnmarshalToken(token.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateToken(parsedToken, issuer.TokenKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A 2056-bit modulus does not fit the wire format
+	largeKey, err := rsa.GenerateKey(rand.Reader, 2056)
+	if err != nil {
+		t.Fatal(err)
+	}
+	largeIssuer := createTestIssuer(t, largeKey)
+	largeIssuer.AddOrigin(testOrigin)
+	if err := largeIssuer.ValidateConfig(); !errors.Is(err, ErrUnsupportedTokenKeySize) {
+		t.Fatalf("expected ErrUnsupportedTokenKeySize, got %v", err)
+	}
+
+	curve := elliptic.P384()
+	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+	if _, err := client.CreateTokenRequest(nonce, nonce, blindKey.D.Bytes(), largeIssuer.TokenKeyID(), largeIssuer.TokenKey(), testOrigin, largeIssuer.NameKey()); !errors.Is(err, ErrUnsupportedTokenKeySize) {
+		t.Fatalf("expected ErrUnsupportedTokenKeySize, got %v", err)
+	}
+}
+
+func TestClientFromKey(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	curve := elliptic.P384()
+	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRateLimitedClientFromKey(secretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretClient, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge := make([]byte, 32)
+	rand.Reader.Read(challenge)
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+
+	requestState, err := client.CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretRequestState, err := secretClient.CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(requestState.ClientKey(), secretRequestState.ClientKey()) {
+		t.Fatal("client key mismatch")
+	}
+	if !bytes.Equal(requestState.RequestKey(), secretRequestState.RequestKey()) {
+		t.Fatal("request key mismatch")
+	}
+
+	response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := requestState.FinalizeToken(response); err != nil {
+		t.Fatal(err)
+	}
+
+	otherCurveKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mismatchedKey := *secretKey
+	mismatchedKey.D = blindKey.D
+	for _, key := range []*ecdsa.PrivateKey{nil, otherCurveKey, &mismatchedKey} {
+		if _, err := NewRateLimitedClientFromKey(key); !errors.Is(err, ErrInvalidClientKey) {
+			t.Fatalf("expected ErrInvalidClientKey, got %v", err)
+		}
+	}
+}
+
+func TestCreateTokenRequestMissingKeys(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	curve := elliptic.P384()
+	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+
+	for _, tokenKey := range []*rsa.PublicKey{nil, {}} {
+		if _, err := client.CreateTokenRequest(nonce, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), tokenKey, testOrigin, issuer.NameKey()); !errors.Is(err, ErrNilTokenKey) {
+			t.Fatalf("expected ErrNilTokenKey, got %v", err)
+		}
+		if _, err := client.PrepareTokenRequest(nonce, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), tokenKey, testOrigin, issuer.NameKey()); !errors.Is(err, ErrNilTokenKey) {
+			t.Fatalf("expected ErrNilTokenKey, got %v", err)
+		}
+	}
+	if _, err := client.CreateTokenRequest(nonce, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, EncapKey{}); !errors.Is(err, ErrZeroNameKey) {
+		t.Fatalf("expected ErrZeroNameKey, got %v", err)
+	}
+	if _, err := client.CreateTokenRequestsForOrigins(nonce, issuer.TokenKeyID(), issuer.TokenKey(), []string{testOrigin}, EncapKey{}); !errors.Is(err, ErrZeroNameKey) {
+		t.Fatalf("expected ErrZeroNameKey, got %v", err)
+	}
+}
+
+func TestFullAndWireKeyID(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	// The full key ID identifies the token key and is carried in tokens
+	fullKeyID, err := FullKeyID(issuer.TokenKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenKeyEnc, err := util.MarshalTokenKeyPSSOID(issuer.TokenKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedKeyID := sha256.Sum256(tokenKeyEnc)
+	if !bytes.Equal(fullKeyID, expectedKeyID[:]) || !bytes.Equal(fullKeyID, issuer.TokenKeyID()) {
+		t.Fatal("full key ID mismatch")
+	}
+
+	// The wire key ID is its first byte and is carried in origin token requests
+	wireKeyID, err := WireKeyID(fullKeyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wireKeyID != fullKeyID[0] {
+		t.Fatal("wire key ID mismatch")
+	}
+	if _, err := WireKeyID([]byte{wireKeyID}); !errors.Is(err, ErrInvalidKeyID) {
+		t.Fatalf("expected ErrInvalidKeyID, got %v", err)
+	}
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	originTokenRequest, _, err := decryptOriginTokenRequest(issuer.nameKey, requestState.Request().RequestKey, requestState.Request().EncryptedTokenRequest, BlindedMessageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if originTokenRequest.tokenKeyId != wireKeyID {
+		t.Fatal("request does not carry the wire key ID")
+	}
+	response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := requestState.FinalizeToken(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(token.KeyID, fullKeyID) {
+		t.Fatal("token does not carry the full key ID")
+	}
+
+	// Passing the wire key ID where the full key ID is expected fails
+	curve := elliptic.P384()
+	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+	if _, err := client.CreateTokenRequest(nonce, nonce, blindKey.D.Bytes(), []byte{wireKeyID}, issuer.TokenKey(), testOrigin, issuer.NameKey()); !errors.Is(err, ErrInvalidKeyID) {
+		t.Fatalf("expected ErrInvalidKeyID, got %v", err)
+	}
+}
+
+func TestClientFromIndexKeys(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	origins := []string{"a.example", "b.example"}
+	for _, origin := range origins {
+		issuer.AddOrigin(origin)
+	}
+	attester := NewRateLimitedAttester(NewMemoryClientStateCache())
+	curve := elliptic.P384()
+
+	// Run a request from client to origin through the attester and issuer and
+	// return the index key the attester retained
+	observe := func(client RateLimitedClient, origin string) []byte {
+		blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce := make([]byte, 32)
+		rand.Reader.Read(nonce)
+		anonymousOriginID := make([]byte, 32)
+		rand.Reader.Read(anonymousOriginID)
+
+		requestState, err := client.CreateTokenRequest(nonce, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), origin, issuer.NameKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := attester.VerifyRequest(*requestState.Request(), blindKey.D.Bytes(), requestState.ClientKey(), anonymousOriginID); err != nil {
+			t.Fatal(err)
+		}
+		_, blindedRequestKeyEnc, err := issuer.Evaluate(requestState.Request().Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := attester.FinalizeIndex(requestState.ClientKey(), blindKey.D.Bytes(), blindedRequestKeyEnc, anonymousOriginID); err != nil {
+			t.Fatal(err)
+		}
+
+		blindedRequestKey, err := unmarshalPublicKey(curve, blindedRequestKeyEnc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexKey, err := ecdsa.UnblindPublicKeyWithContext(curve, blindedRequestKey, blindKey, blindContext(labelClientBlind))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return elliptic.MarshalCompressed(curve, indexKey.X, indexKey.Y)
+	}
+
+	var clients []RateLimitedClient
+	var clientKeys [][]byte
+	for j := 0; j < 2; j++ {
+		secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
+		clientKeys = append(clientKeys, elliptic.MarshalCompressed(curve, secretKey.X, secretKey.Y))
+	}
+
+	indexKeys := [][]byte{
+		observe(clients[0], origins[0]),
+		observe(clients[1], origins[0]),
+		observe(clients[0], origins[1]),
+		[]byte("not a key"),
+	}
+
+	expected := [][]bool{
+		{true, false, true, false},
+		{false, true, false, false},
+	}
+	for j, clientKey := range clientKeys {
+		matches := attester.ClientFromIndexKeys(indexKeys, clientKey)
+		for k := range matches {
+			if matches[k] != expected[j][k] {
+				t.Fatalf("client %d: expected %v, got %v", j, expected[j], matches)
+			}
+		}
+	}
+
+	// Unknown clients match nothing
+	unknownKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, match := range attester.ClientFromIndexKeys(indexKeys, elliptic.MarshalCompressed(curve, unknownKey.X, unknownKey.Y)) {
+		if match {
+			t.Fatal("unknown client matched an index key")
+		}
+	}
+}
+
+func TestOriginPadder(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	padTo := func(size int, padding byte) OriginPadder {
+		return func(originName string) []byte {
+			padded := []byte(originName)
+			for len(padded)%size != 0 || len(padded) == 0 {
+				padded = append(padded, padding)
+			}
+			return padded
+		}
+	}
+
+	curve := elliptic.P384()
+	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+
+	testCases := []struct {
+		name     string
+		pad      OriginPadder
+		unpadded string // what the standard unpadder recovers
+		err      error
+	}{
+		{"standard", padOriginName, testOrigin, nil},
+		// Recovered, but not the padding length the issuer expects
+		{"zeros to 64 bytes", padTo(64, 0x00), testOrigin, ErrMalformedPadding},
+		// Not padding at all to the issuer, which sees a different origin
+		{"spaces to 32 bytes", padTo(32, ' '), testOrigin + strings.Repeat(" ", 32-len(testOrigin)), ErrUnknownOrigin},
+	}
+	for _, tc := range testCases {
+		client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client = client.WithOriginPadder(tc.pad)
+		requestState, err := client.CreateTokenRequest(nonce, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Decrypt without validating the padding
+		request := requestState.Request()
+		enc := request.EncryptedTokenRequest[:issuer.nameKey.suite.KEM.PublicKeySize()]
+		context, err := hpke.SetupBaseR(issuer.nameKey.suite, issuer.nameKey.privateKey, enc, []byte("TokenRequest"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := context.Open(originTokenRequestAAD(issuer.NameKey(), request.RequestKey), request.EncryptedTokenRequest[len(enc):])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var originTokenRequest InnerTokenRequest
+		if !originTokenRequest.Unmarshal(plaintext) {
+			t.Fatalf("%s: failed to unmarshal origin token request", tc.name)
+		}
+		if !bytes.Equal(originTokenRequest.paddedOrigin, tc.pad(testOrigin)) {
+			t.Fatalf("%s: padder not applied", tc.name)
+		}
+		if unpadded := unpadOriginName(originTokenRequest.paddedOrigin); unpadded != tc.unpadded {
+			t.Fatalf("%s: unexpected unpadded name %q", tc.name, unpadded)
+		}
+
+		if _, _, err := issuer.Evaluate(request.Marshal()); !errors.Is(err, tc.err) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestEncapKeyCompatible(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	nameKey := issuer.NameKey()
+	if !nameKey.Compatible(nameKey) {
+		t.Fatal("name key not compatible with itself")
+	}
+
+	// An id-only change keeps the key compatible, but changes its encoding
+	if err := issuer.SetNameKeyID(0x07); err != nil {
+		t.Fatal(err)
+	}
+	renamedKey := issuer.NameKey()
+	if !nameKey.Compatible(renamedKey) {
+		t.Fatal("id-only change reported as incompatible")
+	}
+	if bytes.Equal(nameKey.Marshal(), renamedKey.Marshal()) {
+		t.Fatal("id-only change did not change the encoding")
+	}
+
+	// A suite change with the same public key is incompatible
+	suite, err := hpke.AssembleCipherSuite(hpke.DHKEM_X25519, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resuitedKey := nameKey
+	resuitedKey.suite = suite
+	if nameKey.Compatible(resuitedKey) {
+		t.Fatal("suite change reported as compatible")
+	}
+
+	// As is a new key with the same suite and id
+	if _, err := issuer.RotateNameKey(0x08); err != nil {
+		t.Fatal(err)
+	}
+	rotatedKey := issuer.NameKey()
+	rotatedKey.id = nameKey.id
+	if nameKey.Compatible(rotatedKey) {
+		t.Fatal("new key reported as compatible")
+	}
+
+	if nameKey.Compatible(EncapKey{}) {
+		t.Fatal("zero key reported as compatible")
+	}
+}
+
+func TestEncapKeyEqual(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	nameKey := issuer.NameKey()
+
+	decoded, err := UnmarshalEncapKey(nameKey.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nameKey.Equal(decoded) {
+		t.Fatal("decoded name key not equal to the original")
+	}
+
+	renamedKey := nameKey
+	renamedKey.id++
+	if nameKey.Equal(renamedKey) {
+		t.Fatal("keys with different ids reported as equal")
+	}
+
+	for _, suiteIDs := range []struct {
+		kdfID  hpke.KDFID
+		aeadID hpke.AEADID
+	}{
+		{hpke.KDF_HKDF_SHA384, fixedAEAD},
+		{fixedKDF, hpke.AEAD_AESGCM256},
+		{fixedKDF, hpke.AEAD_CHACHA20POLY1305},
+	} {
+		suite, err := hpke.AssembleCipherSuite(fixedKEM, suiteIDs.kdfID, suiteIDs.aeadID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resuitedKey := nameKey
+		resuitedKey.suite = suite
+		if nameKey.Equal(resuitedKey) {
+			t.Fatalf("keys with suites 0x%04x/0x%04x and 0x%04x/0x%04x reported as equal", fixedKDF, fixedAEAD, suiteIDs.kdfID, suiteIDs.aeadID)
+		}
+	}
+
+	otherIssuer := createTestIssuer(t, loadPrivateKey(t))
+	if nameKey.Equal(otherIssuer.NameKey()) {
+		t.Fatal("different public keys reported as equal")
+	}
+	if nameKey.Equal(EncapKey{}) || (EncapKey{}).Equal(nameKey) {
+		t.Fatal("zero key reported as equal")
+	}
+}
+
+func TestTokenKeyEqual(t *testing.T) {
+	tokenKey := &loadPrivateKey(t).PublicKey
+	sameKey := &loadPrivateKey(t).PublicKey
+	if !TokenKeyEqual(tokenKey, sameKey) {
+		t.Fatal("same token key reported as different")
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if TokenKeyEqual(tokenKey, &otherKey.PublicKey) {
+		t.Fatal("different token keys reported as equal")
+	}
+	otherExponent := *tokenKey
+	otherExponent.E = 3
+	if TokenKeyEqual(tokenKey, &otherExponent) {
+		t.Fatal("keys with different exponents reported as equal")
+	}
+	if TokenKeyEqual(tokenKey, nil) || TokenKeyEqual(nil, tokenKey) {
+		t.Fatal("nil key reported as equal")
+	}
+	if !TokenKeyEqual(nil, nil) {
+		t.Fatal("nil keys reported as different")
+	}
+}
+
+func TestEncapKeyMarshalRoundTrip(t *testing.T) {
+	kemIDs := []hpke.KEMID{hpke.DHKEM_X25519, hpke.DHKEM_X448, hpke.DHKEM_P256, hpke.DHKEM_P521}
+	kdfIDs := []hpke.KDFID{hpke.KDF_HKDF_SHA256, hpke.KDF_HKDF_SHA384, hpke.KDF_HKDF_SHA512}
+	aeadIDs := []hpke.AEADID{hpke.AEAD_AESGCM128, hpke.AEAD_AESGCM256, hpke.AEAD_CHACHA20POLY1305}
+	for _, kemID := range kemIDs {
+		for _, kdfID := range kdfIDs {
+			for _, aeadID := range aeadIDs {
+				suite, err := hpke.AssembleCipherSuite(kemID, kdfID, aeadID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ikm := make([]byte, suite.KEM.PrivateKeySize())
+				rand.Reader.Read(ikm)
+				_, publicKey, err := suite.KEM.DeriveKeyPair(ikm)
+				if err != nil {
+					t.Fatal(err)
+				}
+				nameKey := EncapKey{id: 0x05, suite: suite, publicKey: publicKey}
+
+				decoded, err := UnmarshalEncapKey(nameKey.Marshal())
+				if err != nil {
+					t.Fatalf("suite 0x%04x/0x%04x/0x%04x: %v", kemID, kdfID, aeadID, err)
+				}
+				if decoded.id != nameKey.id || !decoded.Compatible(nameKey) {
+					t.Fatalf("suite 0x%04x/0x%04x/0x%04x: decoded key differs", kemID, kdfID, aeadID)
+				}
+				if !bytes.Equal(decoded.Marshal(), nameKey.Marshal()) {
+					t.Fatalf("suite 0x%04x/0x%04x/0x%04x: encoding differs after round trip", kemID, kdfID, aeadID)
+				}
+			}
+		}
+	}
+}
+
+func TestIssuerBadBlindedMessage(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	curve := elliptic.P384()
+	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+
+	modulus := issuer.TokenKey().N.FillBytes(make([]byte, tokenKeyLen(issuer.TokenKey())))
+	for _, blindedMessage := range [][]byte{modulus, make([]byte, len(modulus))} {
+		blinded, err := client.blindTokenRequest(rand.Reader, nonce, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blinded.blindedMessage = blindedMessage
+		requestState, err := client.encryptTokenRequest(rand.Reader, blinded, issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := issuer.Evaluate(requestState.Request().Marshal()); !errors.Is(err, ErrBadBlindedMessage) {
+			t.Fatalf("expected ErrBadBlindedMessage, got %v", err)
+		}
+	}
+}
+
+func TestContextHash(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	curve := elliptic.P384()
+	secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRateLimitedClientFromSecret(secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = client.WithContextHash(crypto.SHA512_256)
+
+	challenge := make([]byte, 32)
+	rand.Reader.Read(challenge)
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+
+	requestState, err := client.CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := requestState.FinalizeToken(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaultParams := RateLimitedParams()
+	if defaultParams.ContextHash != crypto.SHA256 {
+		t.Fatalf("unexpected default context hash %v", defaultParams.ContextHash)
+	}
+	defaultContext, err := defaultParams.TokenContext(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := RateLimitedParams()
+	params.ContextHash = crypto.SHA512_256
+	context, err := params.TokenContext(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(context, defaultContext) {
+		t.Fatal("context hash did not change the context")
+	}
+	if !bytes.Equal(token.Context, context) {
+		t.Fatal("token context mismatch")
+	}
+
+	if !params.TokenMatchesChallenge(token, challenge) {
+		t.Fatal("token does not match its challenge")
+	}
+	if defaultParams.TokenMatchesChallenge(token, challenge) || token.MatchesAnyChallenge([][]byte{challenge}) {
+		t.Fatal("token matches its challenge under SHA-256")
+	}
+
+	// Context hashes must produce contexts of the fixed size
+	params.ContextHash = crypto.SHA384
+	if _, err := params.TokenContext(challenge); !errors.Is(err, ErrUnsupportedContextHash) {
+		t.Fatalf("expected ErrUnsupportedContextHash, got %v", err)
+	}
+	if _, err := client.WithContextHash(crypto.SHA384).CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey()); !errors.Is(err, ErrUnsupportedContextHash) {
+		t.Fatalf("expected ErrUnsupportedContextHash, got %v", err)
+	}
+}
+
+func TestIssuerInvalidEnc(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	request := requestState.Request()
+	encLen := issuer.NameKey().suite.KEM.PublicKeySize()
+
+	zeroed := *request
+	zeroed.EncryptedTokenRequest = append(make([]byte, encLen), request.EncryptedTokenRequest[encLen:]...)
+	if _, _, err := issuer.Evaluate(zeroed.Marshal()); !errors.Is(err, ErrInvalidEnc) {
+		t.Fatalf("expected ErrInvalidEnc, got %v", err)
+	}
+
+	truncated := *request
+	truncated.EncryptedTokenRequest = request.EncryptedTokenRequest[:encLen-1]
+	if _, _, err := issuer.Evaluate(truncated.Marshal()); !errors.Is(err, ErrInvalidEnc) {
+		t.Fatalf("expected ErrInvalidEnc, got %v", err)
+	}
+
+	if _, _, err := issuer.Evaluate(request.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedemptionContext(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	client, _ := createTestTokenRequest(t, issuer, testOrigin)
+	blindKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := make([]byte, 32)
+	rand.Reader.Read(challenge)
+
+	redemptionContexts := [][]byte{[]byte("session-1"), []byte("session-2")}
+	tokenList := make([]tokens.Token, len(redemptionContexts))
+	for j, redemptionContext := range redemptionContexts {
+		nonce := make([]byte, 32)
+		rand.Reader.Read(nonce)
+		requestState, err := client.WithRedemptionContext(redemptionContext).CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokenList[j], err = requestState.FinalizeToken(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := VerifyTokenAny(tokenList[j], []*rsa.PublicKey{issuer.TokenKey()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for j, token := range tokenList {
+		for k, redemptionContext := range redemptionContexts {
+			if TokenMatchesRedemptionContext(token, challenge, redemptionContext) != (j == k) {
+				t.Fatalf("token %d matching redemption context %d: expected %v", j, k, j == k)
+			}
+		}
+		if RateLimitedParams().TokenMatchesChallenge(token, challenge) {
+			t.Fatalf("token %d matches the challenge's unbound context", j)
+		}
+	}
+
+	// An empty redemption context restores the default context
+	if client.WithRedemptionContext([]byte("session-1")).WithRedemptionContext(nil).redemptionContext != nil {
+		t.Fatal("redemption context not cleared")
+	}
+
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+	conflicting := client.WithOriginBoundContext(true).WithRedemptionContext(redemptionContexts[0])
+	if _, err := conflicting.CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey()); !errors.Is(err, ErrConflictingContexts) {
+		t.Fatalf("expected ErrConflictingContexts, got %v", err)
+	}
+}
+
+func TestRequestSignatureLeadingZeros(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	curve := elliptic.P384()
+	scalarLen := (curve.Params().BitSize + 7) / 8
+	encoded := encodeRequestSignature(curve, big.NewInt(1), big.NewInt(0x0102))
+	if len(encoded) != 2*scalarLen {
+		t.Fatalf("expected %d bytes, got %d", 2*scalarLen, len(encoded))
+	}
+	if encoded[scalarLen-1] != 0x01 || encoded[2*scalarLen-2] != 0x01 || encoded[2*scalarLen-1] != 0x02 {
+		t.Fatalf("scalars not left-padded: %x", encoded)
+	}
+
+	client, _ := createTestTokenRequest(t, issuer, testOrigin)
+	blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+	blinded, err := client.blindTokenRequest(rand.Reader, nonce, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Re-sign until r or s has a leading zero byte, which happens for about
+	// one signature in 128
+	for attempt := 0; ; attempt++ {
+		if attempt == 10000 {
+			t.Fatal("no signature with a leading zero byte")
+		}
+		requestState, err := client.encryptTokenRequest(rand.Reader, blinded, issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature := requestState.Request().Signature
+		if signature[0] != 0x00 && signature[scalarLen] != 0x00 {
+			continue
+		}
+		if len(signature) != 2*scalarLen {
+			t.Fatalf("expected %d byte signature, got %d", 2*scalarLen, len(signature))
+		}
+
+		encodedRequest := requestState.Request().Marshal()
+		decoded := &RateLimitedTokenRequest{}
+		if !decoded.Unmarshal(encodedRequest) {
+			t.Fatal("failed to decode request")
+		}
+		if !bytes.Equal(decoded.Signature, signature) {
+			t.Fatal("signature changed in round trip")
+		}
+		response, _, err := issuer.Evaluate(encodedRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := requestState.FinalizeToken(response); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+}
+
+func TestCreateTokenRequestChallengeSkew(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	client, _ := createTestTokenRequest(t, issuer, testOrigin)
+	blindKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+
+	// Expiries have a resolution of one second
+	now := time.Unix(1700000000, 0)
+	maxSkew := 10 * time.Minute
+	client = client.WithClock(func() time.Time { return now }).WithMaxChallengeSkew(maxSkew)
+
+	createChallenge := func(expiry time.Time) []byte {
+		redemptionNonce, err := tokens.NewExpiringRedemptionNonce(expiry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokens.TokenChallenge{
+			TokenType:       RateLimitedTokenType,
+			IssuerName:      "issuer.example",
+			RedemptionNonce: redemptionNonce,
+			OriginInfo:      []string{testOrigin},
+		}.Marshal()
+	}
+
+	testCases := []struct {
+		expiry time.Time
+		err    error
+	}{
+		{now.Add(maxSkew), nil},
+		{now.Add(maxSkew + time.Second), ErrChallengeClockSkew},
+		{now.Add(time.Second), nil},
+		{now, tokens.ErrChallengeExpired},
+	}
+	for _, tc := range testCases {
+		challenge := createChallenge(tc.expiry)
+		_, err := client.CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+		if tc.err == nil && err != nil {
+			t.Fatalf("expiry %v after now: %v", tc.expiry.Sub(now), err)
+		}
+		if tc.err != nil && !errors.Is(err, tc.err) {
+			t.Fatalf("expiry %v after now: expected %v, got %v", tc.expiry.Sub(now), tc.err, err)
+		}
+	}
+
+	// Without a bound, any future expiry is accepted
+	challenge := createChallenge(now.Add(24 * time.Hour))
+	if _, err := client.WithMaxChallengeSkew(0).CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReEncryptForNameKey(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	oldRequest := requestState.Request()
+	blindedMessage := requestState.blindedMessage
+
+	// The name key is rotated while the request is in flight
+	newNameKey, err := issuer.RotateNameKey(0x01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := issuer.RetireNameKey(0x00); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := issuer.Evaluate(oldRequest.Marshal()); !errors.Is(err, ErrNameKeyRetired) {
+		t.Fatalf("expected ErrNameKeyRetired, got %v", err)
+	}
+
+	request, err := requestState.ReEncryptForNameKey(newNameKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request != requestState.Request() {
+		t.Fatal("request state not updated")
+	}
+	if !bytes.Equal(request.RequestKey, oldRequest.RequestKey) || bytes.Equal(request.NameKeyID, oldRequest.NameKeyID) {
+		t.Fatal("unexpected request keys")
+	}
+	if !bytes.Equal(requestState.blindedMessage, blindedMessage) {
+		t.Fatal("blinded message changed")
+	}
+
+	response, _, err := issuer.Evaluate(request.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := requestState.FinalizeToken(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyTokenAny(token, []*rsa.PublicKey{issuer.TokenKey()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := requestState.ReEncryptForNameKey(EncapKey{}); !errors.Is(err, ErrZeroNameKey) {
+		t.Fatalf("expected ErrZeroNameKey, got %v", err)
+	}
+}
+
+func TestEvaluateDoesNotModifyRequest(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	encodedRequest := requestState.Request().Marshal()
+	original := append([]byte{}, encodedRequest...)
+	encryptedTokenRequest := append([]byte{}, requestState.Request().EncryptedTokenRequest...)
+
+	responses := make([][]byte, 2)
+	for j := range responses {
+		response, _, err := issuer.Evaluate(encodedRequest)
+		if err != nil {
+			t.Fatalf("evaluation %d: %v", j, err)
+		}
+		if !bytes.Equal(encodedRequest, original) {
+			t.Fatalf("evaluation %d modified the request", j)
+		}
+		responses[j] = response
+	}
+
+	// Finalizing must not modify the request either, so that it can be
+	// retried
+	for j, response := range responses {
+		if _, err := requestState.FinalizeToken(response); err != nil {
+			t.Fatalf("response %d: %v", j, err)
+		}
+		if !bytes.Equal(requestState.Request().EncryptedTokenRequest, encryptedTokenRequest) {
+			t.Fatalf("finalizing response %d modified the request", j)
+		}
+	}
+}
+
+func TestDecryptMalformedOriginTokenRequest(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	nameKey := issuer.NameKey()
+	requestKey := make([]byte, RateLimitedParams().RequestKeySize)
+	rand.Reader.Read(requestKey)
+
+	tokenRequest := InnerTokenRequest{
+		blindedMsg:   make([]byte, 256),
+		tokenKeyId:   0x01,
+		paddedOrigin: padOriginName("origin.example"),
+	}
+	encoded := tokenRequest.Marshal()
+
+	// Well-formed ciphertexts of truncated origin token requests
+	for _, truncatedLen := range []int{0, 1, 257, len(encoded) - 1} {
+		enc, context, err := hpke.SetupBaseS(nameKey.suite, rand.Reader, nameKey.publicKey, []byte("TokenRequest"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct := context.Seal(originTokenRequestAAD(nameKey, requestKey), encoded[:truncatedLen])
+		_, _, err = decryptOriginTokenRequest(issuer.nameKey, requestKey, append(enc, ct...), BlindedMessageSize)
+		if !errors.Is(err, ErrMalformedOriginTokenRequest) {
+			t.Fatalf("truncated to %d bytes: expected ErrMalformedOriginTokenRequest, got %v", truncatedLen, err)
+		}
+	}
+}
+
+func TestClientFromInvalidSecret(t *testing.T) {
+	n := elliptic.P384().Params().N
+	for _, secret := range [][]byte{
+		nil,
+		{},
+		make([]byte, 48),
+		n.Bytes(),
+		new(big.Int).Add(n, big.NewInt(1)).Bytes(),
+		bytes.Repeat([]byte{0xff}, 64),
+	} {
+		if _, err := NewRateLimitedClientFromSecret(secret); !errors.Is(err, ErrInvalidClientKey) {
+			t.Fatalf("expected ErrInvalidClientKey for %x, got %v", secret, err)
+		}
+	}
+
+	if _, err := NewRateLimitedClientFromSecret(new(big.Int).Sub(n, big.NewInt(1)).Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("entropy source unavailable")
+}
+
+func TestNewIssuerNameKeyFailure(t *testing.T) {
+	nameKeyRandReader = failingReader{}
+	defer func() {
+		nameKeyRandReader = rand.Reader
+	}()
+
+	issuer, err := NewRateLimitedIssuer(loadPrivateKey(t))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if issuer != nil {
+		t.Fatal("issuer returned with an error")
+	}
+}
+
+func TestIssuerWithSuite(t *testing.T) {
+	testOrigin := "origin.example"
+	testCases := []struct {
+		kem  hpke.KEMID
+		aead hpke.AEADID
+	}{
+		{hpke.DHKEM_X25519, hpke.AEAD_AESGCM128},
+		{hpke.DHKEM_X25519, hpke.AEAD_AESGCM256},
+		{hpke.DHKEM_X25519, hpke.AEAD_CHACHA20POLY1305},
+		{hpke.DHKEM_P256, hpke.AEAD_AESGCM128},
+	}
+	for _, tc := range testCases {
+		suite, err := hpke.AssembleCipherSuite(tc.kem, hpke.KDF_HKDF_SHA256, tc.aead)
+		if err != nil {
+			t.Fatal(err)
+		}
+		issuer, err := NewRateLimitedIssuerWithSuite(loadPrivateKey(t), suite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		issuer.AddOrigin(testOrigin)
+
+		// Clients learn the suite from the encoded name key
+		nameKey, err := UnmarshalEncapKey(issuer.NameKey().Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nameKey.suite.KEM.ID() != tc.kem || nameKey.suite.AEAD.ID() != tc.aead {
+			t.Fatalf("name key suite mismatch for KEM 0x%04x, AEAD 0x%04x", tc.kem, tc.aead)
+		}
+
+		client, _ := createTestTokenRequest(t, issuer, testOrigin)
+		nonce := make([]byte, 32)
+		rand.Reader.Read(nonce)
+		blindKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requestState, err := client.CreateTokenRequest(nonce, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, nameKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+		if err != nil {
+			t.Fatalf("KEM 0x%04x, AEAD 0x%04x: %v", tc.kem, tc.aead, err)
+		}
+		token, err := requestState.FinalizeToken(response)
+		if err != nil {
+			t.Fatalf("KEM 0x%04x, AEAD 0x%04x: %v", tc.kem, tc.aead, err)
+		}
+		if _, err := VerifyTokenAny(token, []*rsa.PublicKey{issuer.TokenKey()}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Rotated name keys keep the suite
+		rotated, err := issuer.RotateNameKey(0x01)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rotated.suite.AEAD.ID() != tc.aead {
+			t.Fatal("rotated name key changed suite")
+		}
+	}
+
+	if _, err := NewRateLimitedIssuerWithSuite(loadPrivateKey(t), hpke.CipherSuite{}); err == nil {
+		t.Fatal("expected an error for an incomplete suite")
+	}
+}
+
+func TestRequestKeyCurves(t *testing.T) {
+	for _, curve := range []elliptic.Curve{elliptic.P384(), elliptic.P256()} {
+		t.Run(curve.Params().Name, func(t *testing.T) {
+			params, err := RateLimitedParamsForCurve(curve)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			issuer := createTestIssuer(t, loadPrivateKey(t))
+			if err := issuer.SetRequestKeyCurve(curve); err != nil {
+				t.Fatal(err)
+			}
+			testOrigin := "origin.example"
+			issuer.AddOrigin(testOrigin)
+
+			secretKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blindKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := NewRateLimitedClientFromSecretWithCurve(curve, secretKey.D.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			attester := NewRateLimitedAttester(NewMemoryClientStateCache())
+
+			challenge := make([]byte, 32)
+			rand.Reader.Read(challenge)
+			nonce := make([]byte, 32)
+			rand.Reader.Read(nonce)
+			anonymousOriginID := make([]byte, 32)
+			rand.Reader.Read(anonymousOriginID)
+
+			requestState, err := client.CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+			if err != nil {
+				t.Fatal(err)
+			}
+			request := requestState.Request()
+			if len(request.RequestKey) != params.RequestKeySize || len(request.Signature) != params.SignatureSize {
+				t.Fatalf("request key and signature are %d and %d bytes, expected %d and %d", len(request.RequestKey), len(request.Signature), params.RequestKeySize, params.SignatureSize)
+			}
+
+			decoded := new(RateLimitedTokenRequest)
+			if !decoded.UnmarshalForCurve(curve, request.Marshal()) || !decoded.Equal(*request) {
+				t.Fatal("request did not round-trip")
+			}
+			encodedCBOR, err := request.MarshalCBOR()
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded = new(RateLimitedTokenRequest)
+			if err := decoded.UnmarshalCBOR(encodedCBOR); err != nil || !decoded.Equal(*request) {
+				t.Fatalf("CBOR request did not round-trip: %v", err)
+			}
+
+			clientKeyEnc := requestState.ClientKey()
+			if err := attester.VerifyRequest(*request, blindKey.D.Bytes(), clientKeyEnc, anonymousOriginID); err != nil {
+				t.Fatal(err)
+			}
+
+			response, blindedRequestKey, err := issuer.Evaluate(request.Marshal())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := requestState.FinalizeToken(response); err != nil {
+				t.Fatal(err)
+			}
+
+			index, err := attester.FinalizeIndex(clientKeyEnc, blindKey.D.Bytes(), blindedRequestKey, anonymousOriginID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			originIndexPublicKey, err := issuer.OriginIndexPublicKey(testOrigin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			predictedIndex, err := client.PredictIndex(blindKey.D.Bytes(), originIndexPublicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(index, predictedIndex) {
+				t.Fatal("predicted index does not match attester index")
+			}
+		})
+	}
+}
+
+func TestRequestKeyCurveMismatch(t *testing.T) {
+	if _, err := RateLimitedParamsForCurve(elliptic.P224()); !errors.Is(err, ErrUnsupportedCurve) {
+		t.Fatalf("expected ErrUnsupportedCurve, got %v", err)
+	}
+	if _, err := NewRateLimitedClientFromSecretWithCurve(elliptic.P521(), []byte{0x01}); !errors.Is(err, ErrUnsupportedCurve) {
+		t.Fatalf("expected ErrUnsupportedCurve, got %v", err)
+	}
+
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	if err := issuer.SetRequestKeyCurve(elliptic.P224()); !errors.Is(err, ErrUnsupportedCurve) {
+		t.Fatalf("expected ErrUnsupportedCurve, got %v", err)
+	}
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+	if err := issuer.SetRequestKeyCurve(elliptic.P256()); !errors.Is(err, ErrOriginsRegistered) {
+		t.Fatalf("expected ErrOriginsRegistered, got %v", err)
+	}
+
+	otherCurveKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := issuer.AddOriginWithIndexKey("other.example", otherCurveKey); !errors.Is(err, ErrUnsupportedCurve) {
+		t.Fatalf("expected ErrUnsupportedCurve, got %v", err)
+	}
+
+	// A P-256 request does not parse as a P-384 one
+	secretKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRateLimitedClientFromSecretWithCurve(elliptic.P256(), secretKey.D.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := make([]byte, 32)
+	rand.Reader.Read(challenge)
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+	requestState, err := client.CreateTokenRequest(challenge, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := issuer.Evaluate(requestState.Request().Marshal()); !errors.Is(err, ErrMalformedRequest) {
+		t.Fatalf("expected ErrMalformedRequest, got %v", err)
+	}
+}
+
+func TestRemoveOrigin(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	for _, origin := range []string{"b.example", "a.example"} {
+		if err := issuer.AddOrigin(origin); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if origins := issuer.ListOrigins(); !reflect.DeepEqual(origins, []string{"a.example", "b.example"}) {
+		t.Fatalf("unexpected origins %v", origins)
+	}
+
+	_, requestState := createTestTokenRequest(t, issuer, "a.example")
+	if err := issuer.RemoveOrigin("a.example"); err != nil {
+		t.Fatal(err)
+	}
+	if origins := issuer.ListOrigins(); !reflect.DeepEqual(origins, []string{"b.example"}) {
+		t.Fatalf("unexpected origins %v", origins)
+	}
+	if issuer.OriginIndexKey("a.example") != nil {
+		t.Fatal("removed origin still has an index key")
+	}
+	if _, _, err := issuer.Evaluate(requestState.Request().Marshal()); !errors.Is(err, ErrUnknownOrigin) {
+		t.Fatalf("expected ErrUnknownOrigin, got %v", err)
+	}
+
+	if err := issuer.RemoveOrigin("a.example"); !errors.Is(err, ErrUnknownOrigin) {
+		t.Fatalf("expected ErrUnknownOrigin, got %v", err)
+	}
+	if err := issuer.RemoveOrigin("c.example"); !errors.Is(err, ErrUnknownOrigin) {
+		t.Fatalf("expected ErrUnknownOrigin, got %v", err)
+	}
+	if origins := issuer.ListOrigins(); !reflect.DeepEqual(origins, []string{"b.example"}) {
+		t.Fatalf("unexpected origins %v", origins)
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := requestState.FinalizeToken(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyToken(token, issuer.TokenKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	flipped := token
+	flipped.Authenticator = append([]byte{}, token.Authenticator...)
+	flipped.Authenticator[len(flipped.Authenticator)/2] ^= 0x01
+	if err := VerifyToken(flipped, issuer.TokenKey()); err == nil {
+		t.Fatal("token with flipped authenticator bit verified")
+	}
+
+	if err := VerifyToken(token, nil); !errors.Is(err, ErrNilTokenKey) {
+		t.Fatalf("expected ErrNilTokenKey, got %v", err)
+	}
+}
+
+func TestVerifyIndex(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	otherOrigin := "other.example"
+	issuer.AddOrigin(testOrigin)
+	issuer.AddOrigin(otherOrigin)
+
+	client, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	_, blindedRequestKey, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	originIndexPublicKey, err := issuer.OriginIndexPublicKey(testOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedIndex, err := client.PredictIndex(requestState.Blind(), originIndexPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := requestState.VerifyIndex(requestState.Blind(), blindedRequestKey, expectedIndex); err != nil {
+		t.Fatal(err)
+	}
+
+	// A blinded request key made with another origin's index key is a valid
+	// point, but maps the client to a different index
+	otherIndexKey := issuer.OriginIndexKey(otherOrigin)
+	requestKey, err := unmarshalPublicKey(elliptic.P384(), requestState.Request().RequestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamperedKey, err := ecdsa.BlindPublicKeyWithContext(elliptic.P384(), requestKey, otherIndexKey, blindContext(labelIssuerBlind))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := elliptic.MarshalCompressed(elliptic.P384(), tamperedKey.X, tamperedKey.Y)
+	if err := requestState.VerifyIndex(requestState.Blind(), tampered, expectedIndex); !errors.Is(err, ErrIndexMismatch) {
+		t.Fatalf("expected ErrIndexMismatch, got %v", err)
+	}
+
+	flipped := append([]byte{}, blindedRequestKey...)
+	flipped[len(flipped)-1] ^= 0x01
+	if err := requestState.VerifyIndex(requestState.Blind(), flipped, expectedIndex); err == nil {
+		t.Fatal("tampered blinded request key verified")
+	}
+}
+
+func TestTokenKeySize3072(t *testing.T) {
+	tokenKey, err := rsa.GenerateKey(rand.Reader, 3072)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := createTestIssuer(t, tokenKey)
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+	if err := issuer.ValidateConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := requestState.FinalizeToken(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token.Authenticator) != 384 {
+		t.Fatalf("unexpected authenticator length %d", len(token.Authenticator))
+	}
+
+	parsedToken, err := UnmarshalToken(token.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateToken(parsedToken, issuer.TokenKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyToken(parsedToken, issuer.TokenKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := UnmarshalToken(token.Marshal()[:len(token.Marshal())-1]); err == nil {
+		t.Fatal("truncated token unmarshaled")
+	}
+}
+
+func TestUnmarshalTokenChallenge(t *testing.T) {
+	challenge := tokens.TokenChallenge{
+		TokenType:  RateLimitedTokenType,
+		IssuerName: "issuer.example",
+	}
+	recoveredChallenge, err := UnmarshalTokenChallenge(challenge.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !challenge.Equals(recoveredChallenge) {
+		t.Fatal("challenge mismatch")
+	}
+
+	challenge.TokenType = 0x0002
+	if _, err := UnmarshalTokenChallenge(challenge.Marshal()); !errors.Is(err, ErrUnexpectedTokenType) {
+		t.Fatalf("expected ErrUnexpectedTokenType, got %v", err)
+	}
+	if _, err := UnmarshalTokenChallenge([]byte{0x00, 0x03}); err == nil {
+		t.Fatal("truncated challenge unmarshaled")
+	}
+}
+
+func TestEvaluateContextCancelled(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+
+	client, requestState := createTestTokenRequest(t, issuer, testOrigin)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, _, err := issuer.EvaluateContext(ctx, requestState.Request().Marshal()); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, err := requestState.FinalizeTokenContext(ctx, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	nonce := make([]byte, 32)
+	blindKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CreateTokenRequestContext(ctx, nonce, nonce, blindKey.D.Bytes(), issuer.TokenKeyID(), issuer.TokenKey(), testOrigin, issuer.NameKey()); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// A live context evaluates as usual
+	response, _, err := issuer.EvaluateContext(context.Background(), requestState.Request().Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := requestState.FinalizeTokenContext(context.Background(), response); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIssuerMultipleTokenKeys(t *testing.T) {
+	issuer := createTestIssuer(t, loadPrivateKey(t))
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+	currentKeyID := issuer.TokenKeyID()
+
+	// Requests select their key by wire key ID, so the second key must not
+	// share it with the first
+	var otherKey *rsa.PrivateKey
+	var otherKeyID []byte
+	for otherKey == nil || otherKeyID[0] == currentKeyID[0] {
+		var err error
+		otherKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherKeyID, err = FullKeyID(&otherKey.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := issuer.AddTokenKey(otherKey); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(issuer.TokenKeyID(), currentKeyID) {
+		t.Fatal("adding a token key changed the current key")
+	}
+
+	client, _ := createTestTokenRequest(t, issuer, testOrigin)
+	nonce := make([]byte, 32)
+	issue := func(tokenKeyID []byte, tokenKey *rsa.PublicKey) (tokens.Token, error) {
+		blindKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requestState, err := client.CreateTokenRequest(nonce, nonce, blindKey.D.Bytes(), tokenKeyID, tokenKey, testOrigin, issuer.NameKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, _, err := issuer.Evaluate(requestState.Request().Marshal())
+		if err != nil {
+			return tokens.Token{}, err
+		}
+		return requestState.FinalizeToken(response)
+	}
+
+	for _, key := range []*rsa.PublicKey{issuer.TokenKey(), &otherKey.PublicKey} {
+		keyID, err := FullKeyID(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := issue(keyID, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyToken(token, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A key with the same wire key ID as a held key is ambiguous. Generating a
+	// real collision takes hundreds of keys, so plant a held key ID instead
+	collidingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collidingKeyID, err := FullKeyID(&collidingKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plantedKeyID := string(append([]byte{collidingKeyID[0]}, make([]byte, len(collidingKeyID)-1)...))
+	issuer.tokenKeys[plantedKeyID] = otherKey
+	if err := issuer.AddTokenKey(collidingKey); !errors.Is(err, ErrTokenKeyIDInUse) {
+		t.Fatalf("expected ErrTokenKeyIDInUse, got %v", err)
+	}
+	if err := issuer.SetTokenKey(collidingKey); !errors.Is(err, ErrTokenKeyIDInUse) {
+		t.Fatalf("expected ErrTokenKeyIDInUse, got %v", err)
+	}
+	if !bytes.Equal(issuer.TokenKeyID(), currentKeyID) {
+		t.Fatal("rejected token key replaced the current key")
+	}
+	delete(issuer.tokenKeys, plantedKeyID)
+
+	if err := issuer.RemoveTokenKey(currentKeyID); !errors.Is(err, ErrRemoveCurrentTokenKey) {
+		t.Fatalf("expected ErrRemoveCurrentTokenKey, got %v", err)
+	}
+	if err := issuer.RemoveTokenKey(otherKeyID); err != nil {
+		t.Fatal(err)
+	}
+	if err := issuer.RemoveTokenKey(otherKeyID); !errors.Is(err, ErrUnknownTokenKey) {
+		t.Fatalf("expected ErrUnknownTokenKey, got %v", err)
+	}
+	if _, err := issue(otherKeyID, &otherKey.PublicKey); !errors.Is(err, ErrUnknownTokenKey) {
+		t.Fatalf("expected ErrUnknownTokenKey, got %v", err)
+	}
+}
+
+func TestTokenKeyRotationDuringEvaluate(t *testing.T) {
+	currentKey := loadPrivateKey(t)
+	issuer := createTestIssuer(t, currentKey)
+	testOrigin := "origin.example"
+	issuer.AddOrigin(testOrigin)
+	currentKeyID := issuer.TokenKeyID()
+
+	var otherKey *rsa.PrivateKey
+	var otherKeyID []byte
+	for otherKey == nil || otherKeyID[0] == currentKeyID[0] {
+		var err error
+		otherKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherKeyID, err = FullKeyID(&otherKey.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	requests := make([][]byte, 16)
+	for j := range requests {
+		_, requestState := createTestTokenRequest(t, issuer, testOrigin)
+		requests[j] = requestState.Request().Marshal()
+	}
+
+	// Requests for the first key succeed while other keys come and go, and
+	// the current key is replaced
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for j := 0; j < 8; j++ {
+			if err := issuer.AddTokenKey(otherKey); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := issuer.SetTokenKey(otherKey); err != nil {
+				t.Error(err)
+				return
+			}
+			issuer.TokenKey()
+			if err := issuer.SetTokenKey(currentKey); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := issuer.RemoveTokenKey(otherKeyID); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for _, request := range requests {
+		if _, _, err := issuer.Evaluate(request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
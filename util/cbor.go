@@ -0,0 +1,168 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Minimal deterministic CBOR (RFC 8949, Section 4.2) for maps with unsigned
+// integer keys whose values are unsigned integers or byte strings, which is
+// all the token structures need.
+
+const (
+	cborMajorUint  = 0
+	cborMajorBytes = 2
+	cborMajorMap   = 5
+)
+
+var (
+	ErrInvalidCBOR = errors.New("invalid CBOR encoding")
+)
+
+func appendCBORHead(out []byte, major byte, value uint64) []byte {
+	var n int
+	switch {
+	case value < 24:
+		return append(out, major<<5|byte(value))
+	case value <= 0xff:
+		out, n = append(out, major<<5|24), 1
+	case value <= 0xffff:
+		out, n = append(out, major<<5|25), 2
+	case value <= 0xffffffff:
+		out, n = append(out, major<<5|26), 4
+	default:
+		out, n = append(out, major<<5|27), 8
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], value)
+	return append(out, buf[8-n:]...)
+}
+
+// MarshalCBORMap encodes fields as a deterministic CBOR map. Values must be
+// uint64 or []byte.
+func MarshalCBORMap(fields map[uint64]interface{}) ([]byte, error) {
+	keys := make([]uint64, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	out := appendCBORHead(nil, cborMajorMap, uint64(len(keys)))
+	for _, key := range keys {
+		out = appendCBORHead(out, cborMajorUint, key)
+		switch value := fields[key].(type) {
+		case uint64:
+			out = appendCBORHead(out, cborMajorUint, value)
+		case []byte:
+			out = appendCBORHead(out, cborMajorBytes, uint64(len(value)))
+			out = append(out, value...)
+		default:
+			return nil, fmt.Errorf("unsupported CBOR value type %T for key %d", value, key)
+		}
+	}
+	return out, nil
+}
+
+func readCBORHead(data []byte) (major byte, value uint64, rest []byte, err error) {
+	if len(data) == 0 {
+		return 0, 0, nil, ErrInvalidCBOR
+	}
+	major = data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	var n int
+	switch {
+	case info < 24:
+		return major, uint64(info), data, nil
+	case info == 24:
+		n = 1
+	case info == 25:
+		n = 2
+	case info == 26:
+		n = 4
+	case info == 27:
+		n = 8
+	default:
+		// Indefinite lengths and reserved values are not deterministic
+		return 0, 0, nil, ErrInvalidCBOR
+	}
+	if len(data) < n {
+		return 0, 0, nil, ErrInvalidCBOR
+	}
+	for _, b := range data[:n] {
+		value = value<<8 | uint64(b)
+	}
+
+	// Deterministic encoding requires the shortest head
+	if len(appendCBORHead(nil, major, value)) != 1+n {
+		return 0, 0, nil, ErrInvalidCBOR
+	}
+	return major, value, data[n:], nil
+}
+
+// UnmarshalCBORMap decodes a deterministic CBOR map produced by
+// MarshalCBORMap. Values are returned as uint64 or []byte. Non-deterministic
+// encodings, duplicate or unsorted keys, and trailing data are rejected.
+func UnmarshalCBORMap(data []byte) (map[uint64]interface{}, error) {
+	major, count, data, err := readCBORHead(data)
+	if err != nil {
+		return nil, err
+	}
+	if major != cborMajorMap || count > uint64(len(data)) {
+		return nil, ErrInvalidCBOR
+	}
+
+	fields := make(map[uint64]interface{}, count)
+	var previousKey uint64
+	for i := uint64(0); i < count; i++ {
+		var key uint64
+		major, key, data, err = readCBORHead(data)
+		if err != nil {
+			return nil, err
+		}
+		if major != cborMajorUint || (i > 0 && key <= previousKey) {
+			return nil, ErrInvalidCBOR
+		}
+		previousKey = key
+
+		var value uint64
+		major, value, data, err = readCBORHead(data)
+		if err != nil {
+			return nil, err
+		}
+		switch major {
+		case cborMajorUint:
+			fields[key] = value
+		case cborMajorBytes:
+			if value > uint64(len(data)) {
+				return nil, ErrInvalidCBOR
+			}
+			fields[key] = append([]byte{}, data[:value]...)
+			data = data[value:]
+		default:
+			return nil, ErrInvalidCBOR
+		}
+	}
+	if len(data) != 0 {
+		return nil, ErrInvalidCBOR
+	}
+
+	return fields, nil
+}
+
+// CBORBytes returns the byte string value of key in fields decoded by
+// UnmarshalCBORMap.
+func CBORBytes(fields map[uint64]interface{}, key uint64) ([]byte, bool) {
+	value, ok := fields[key].([]byte)
+	return value, ok
+}
+
+// CBORUint returns the unsigned integer value of key in fields decoded by
+// UnmarshalCBORMap.
+func CBORUint(fields map[uint64]interface{}, key uint64) (uint64, bool) {
+	value, ok := fields[key].(uint64)
+	return value, ok
+}
@@ -0,0 +1,72 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCBORMapRoundTrip(t *testing.T) {
+	fields := map[uint64]interface{}{
+		1:   uint64(3),
+		2:   []byte("nonce"),
+		24:  uint64(0x10000),
+		300: make([]byte, 300),
+	}
+	encoded, err := MarshalCBORMap(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := UnmarshalCBORMap(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(fields) {
+		t.Fatal("field count mismatch")
+	}
+	if v, ok := CBORUint(decoded, 1); !ok || v != 3 {
+		t.Fatal("uint field mismatch")
+	}
+	if v, ok := CBORUint(decoded, 24); !ok || v != 0x10000 {
+		t.Fatal("uint field mismatch")
+	}
+	if v, ok := CBORBytes(decoded, 2); !ok || !bytes.Equal(v, []byte("nonce")) {
+		t.Fatal("bytes field mismatch")
+	}
+	if v, ok := CBORBytes(decoded, 300); !ok || len(v) != 300 {
+		t.Fatal("bytes field mismatch")
+	}
+}
+
+func TestCBORMapKnownEncoding(t *testing.T) {
+	// {1: 3, 2: h'0102'}
+	expected := []byte{0xa2, 0x01, 0x03, 0x02, 0x42, 0x01, 0x02}
+	encoded, err := MarshalCBORMap(map[uint64]interface{}{
+		2: []byte{0x01, 0x02},
+		1: uint64(3),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encoded, expected) {
+		t.Fatalf("unexpected encoding %x", encoded)
+	}
+}
+
+func TestCBORMapRejectsNonDeterministic(t *testing.T) {
+	invalid := [][]byte{
+		{},
+		{0xa1, 0x01},                         // missing value
+		{0xa1, 0x18, 0x01, 0x03},             // non-shortest key
+		{0xa2, 0x02, 0x03, 0x01, 0x03},       // unsorted keys
+		{0xa2, 0x01, 0x03, 0x01, 0x03},       // duplicate keys
+		{0xbf, 0x01, 0x03, 0xff},             // indefinite-length map
+		{0xa1, 0x01, 0x43, 0x01},             // truncated byte string
+		{0xa1, 0x01, 0x03, 0x00},             // trailing data
+		{0xa1, 0x01, 0x63, 0x61, 0x62, 0x63}, // text string value
+	}
+	for _, data := range invalid {
+		if _, err := UnmarshalCBORMap(data); err == nil {
+			t.Fatalf("decoded invalid CBOR %x", data)
+		}
+	}
+}